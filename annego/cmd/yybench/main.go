@@ -0,0 +1,21 @@
+// yybench YY协议服务的压测工具
+//
+// 用法: yybench -addr 127.0.0.1:8000 -templates req.json [-c 10] [-qps 1000] [-d 10s] [-n 0] [-format yy]
+// 模板文件为yybench.Template的JSON数组，该命令没有注册消息类型，只能使用fields或raw描述包体:
+//
+//	[{"uri": 1, "fields": [{"type": "uint32", "value": 1}, {"type": "str16", "value": "abc"}]}]
+//
+// 需要用body按消息类型编写JSON时，在自己的命令中注册消息类型后调用yybench.Main:
+//
+//	func main() {
+//		register := packet.NewYYRegister()
+//		register.Register(new(proto.PLogin))
+//		yybench.Main(register)
+//	}
+package main
+
+import "goBase/annego/yybench"
+
+func main() {
+	yybench.Main(nil)
+}
@@ -0,0 +1,65 @@
+// yyreplay 将YYServer.SetRecorder记录的抓包文件回放到目标服务，并比较回复
+//
+// 用法: yyreplay -addr 127.0.0.1:8000 [-speed 1] [-concurrency 1] capture.yycap.2 capture.yycap.1 capture.yycap
+// 滚动产生的多个文件按时间从旧到新的顺序传入
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"goBase/annego/yyserver"
+)
+
+func main() {
+	network := flag.String("network", "tcp", "target network")
+	addr := flag.String("addr", "", "target address")
+	speed := flag.Float64("speed", 1, "replay speed multiplier, 0 sends without delay")
+	concurrency := flag.Int("concurrency", 1, "sessions replayed at the same time")
+	timeout := flag.Duration("timeout", 5*time.Second, "time to wait for replies after a session is sent")
+	maxDiffs := flag.Int("diffs", 20, "max diffs printed")
+	flag.Parse()
+
+	if *addr == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	records := make([]*yyserver.CaptureRecord, 0)
+	for _, path := range flag.Args() {
+		list, err := yyserver.ReadCaptureFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "read %s error %v\n", path, err)
+			os.Exit(1)
+		}
+		records = append(records, list...)
+	}
+
+	replayer := &yyserver.Replayer{
+		Network:     *network,
+		Address:     *addr,
+		Speed:       *speed,
+		Concurrency: *concurrency,
+		Timeout:     *timeout,
+	}
+	result := replayer.Replay(context.Background(), records)
+
+	fmt.Printf("sessions %d sent %d received %d errors %d diffs %d\n",
+		result.Sessions, result.Sent, result.Received, len(result.Errors), len(result.Diffs))
+	for _, err := range result.Errors {
+		fmt.Printf("error: %v\n", err)
+	}
+	for i, diff := range result.Diffs {
+		if i >= *maxDiffs {
+			fmt.Printf("... %d more diffs\n", len(result.Diffs)-i)
+			break
+		}
+		fmt.Printf("diff: %v\n", diff)
+	}
+	if len(result.Errors) > 0 || len(result.Diffs) > 0 {
+		os.Exit(1)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"time"
 
 	"goBase/annego/logger"
-	"goBase/annego/packet"
 	"goBase/annego/yyserver"
 )
 
@@ -15,8 +14,8 @@ func connect(yyconn *yyserver.YYConnect) bool {
 	return true
 }
 
-func message(yyconn *yyserver.YYConnect, recvmsg packet.Marshallable) bool {
-	msg := recvmsg.(*PTest)
+// message 通过RegisterFunc注册，参数类型决定处理的URI
+func message(yyconn *yyserver.YYConnect, msg *PTest) bool {
 	var sum uint32
 	for _, i := range msg.List {
 		sum += i
@@ -37,7 +36,7 @@ func main() {
 	server := yyserver.NewYYServer()
 	server.RegisterConnectFunc(connect)
 	server.RegisterCloseFunc(close)
-	server.RegisterHandle(&PTest{}, message)
+	server.RegisterFunc(message)
 	if err := server.Start(os.Args[1]); err != nil {
 		logger.Warning("accept error %s", err)
 		return
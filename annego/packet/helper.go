@@ -1,6 +1,7 @@
 package packet
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"reflect"
@@ -29,6 +30,47 @@ func UnmarshalBody(data []byte, msg Marshallable) error {
 	return msg.Unmarshal(up)
 }
 
+// PeekHeader 解析data开头的包头，不移动数据，数据不足包头长度返回ErrInputNotEnough
+func PeekHeader(data []byte) (*Header, error) {
+	if len(data) < HeaderLength {
+		return nil, ErrInputNotEnough
+	}
+	return &Header{
+		Length:  binary.LittleEndian.Uint32(data[0:4]),
+		URI:     binary.LittleEndian.Uint32(data[4:8]),
+		ResCode: binary.LittleEndian.Uint16(data[8:10]),
+	}, nil
+}
+
+// FrameLength 返回data开头完整数据帧的长度
+// 数据不足一个完整帧返回ErrInputNotEnough，包头长度异常返回其他错误
+func FrameLength(data []byte) (int, error) {
+	header, err := PeekHeader(data)
+	if err != nil {
+		return 0, err
+	}
+	if header.Length < HeaderLength {
+		return 0, fmt.Errorf("unmarshal header length too short, length %d uri %d", header.Length, header.URI)
+	}
+	if MaxPacketLength < header.Length {
+		return 0, fmt.Errorf("unmarshal header length too long, length %d uri %d", header.Length, header.URI)
+	}
+	if len(data) < int(header.Length) {
+		return 0, ErrInputNotEnough
+	}
+	return int(header.Length), nil
+}
+
+// PackFrame 使用已编码的body生成完整数据帧
+func PackFrame(uri uint32, resCode uint16, body []byte) []byte {
+	frame := make([]byte, HeaderLength+len(body))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(frame[4:8], uri)
+	binary.LittleEndian.PutUint16(frame[8:10], resCode)
+	copy(frame[HeaderLength:], body)
+	return frame
+}
+
 type YYRegister struct {
 	register map[uint32]reflect.Type
 }
@@ -45,6 +87,15 @@ func (reg *YYRegister) Register(msg Marshallable) bool {
 	return !ok
 }
 
+// New 创建uri对应的注册类型的新实例，未注册时返回false
+func (reg *YYRegister) New(uri uint32) (Marshallable, bool) {
+	msgtype, ok := reg.register[uri]
+	if !ok {
+		return nil, false
+	}
+	return reflect.New(msgtype).Interface().(Marshallable), true
+}
+
 // Unmarshal 直接解析Unpack
 func (reg *YYRegister) Unmarshal(unpack *Unpack) (Marshallable, error) {
 	var header *Header
@@ -55,12 +106,10 @@ func (reg *YYRegister) Unmarshal(unpack *Unpack) (Marshallable, error) {
 			return nil, err
 		}
 	}
-	msgtype, ok := reg.register[header.URI]
+	msg, ok := reg.New(header.URI)
 	if !ok {
 		return nil, fmt.Errorf("not register uri:%d", header.URI)
 	}
-	msgvalue := reflect.New(msgtype)
-	msg := msgvalue.Interface().(Marshallable)
 	err = msg.Unmarshal(unpack)
 	if err != nil {
 		return nil, err
@@ -78,7 +127,7 @@ func (reg *YYRegister) UnmarshalBytes(data []byte) (msg Marshallable, readsize i
 	err = nil
 
 	unpack := NewUnpack(data)
-	if unpack.Length() <= HeaderLength {
+	if unpack.Length() < HeaderLength {
 		err = ErrInputNotEnough
 		return
 	}
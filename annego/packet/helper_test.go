@@ -76,3 +76,64 @@ func TestUnmarshalBody(t *testing.T) {
 	assert.Equal(t, msg1.i, msg2.i)
 	assert.Equal(t, msg1.s, msg2.s)
 }
+
+func TestFrameLength(t *testing.T) {
+	pack := GetMarshalPack(&simpleProto{1, "abc"})
+	data := pack.Bytes()
+
+	_, err := FrameLength(data[:8])
+	assert.Equal(t, ErrInputNotEnough, err)
+	_, err = FrameLength(data[:len(data)-1])
+	assert.Equal(t, ErrInputNotEnough, err)
+
+	length, err := FrameLength(append(data, 1, 2, 3))
+	assert.NoError(t, err)
+	assert.Equal(t, pack.Len(), length)
+
+	header, err := PeekHeader(data)
+	assert.NoError(t, err)
+	assert.Equal(t, &Header{uint32(pack.Len()), 1, ResSuccess}, header)
+
+	// 包头长度小于包头本身
+	bad := PackFrame(1, ResSuccess, nil)
+	bad[0] = 4
+	_, err = FrameLength(bad)
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrInputNotEnough, err)
+}
+
+func TestPackFrame(t *testing.T) {
+	msg := &simpleProto{1234, "abcdefg"}
+	frame := PackFrame(msg.GetURI(), ResSuccess, MarshalBody(msg))
+	assert.Equal(t, GetMarshalPack(msg).Bytes(), frame)
+
+	// 只有包头的数据帧
+	register := NewYYRegister()
+	register.Register(&emptyProto{})
+	res, readsize, err := register.UnmarshalBytes(PackFrame(2, 500, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, HeaderLength, readsize)
+	assert.IsType(t, &emptyProto{}, res)
+}
+
+func TestRegisterNew(t *testing.T) {
+	register := NewYYRegister()
+	register.Register(&simpleProto{})
+	msg, ok := register.New(1)
+	assert.True(t, ok)
+	assert.Equal(t, &simpleProto{}, msg)
+	_, ok = register.New(2)
+	assert.False(t, ok)
+}
+
+type emptyProto struct{}
+
+func (self *emptyProto) GetURI() uint32 {
+	return 2
+}
+
+func (self *emptyProto) Marshal(pk *Pack) {}
+
+func (self *emptyProto) Unmarshal(up *Unpack) error {
+	return nil
+}
@@ -1,10 +1,10 @@
 package s2s
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -92,14 +92,30 @@ func (p *S2SPool) Put(conn *S2SPoolItem, forceClose bool) {
 	p.Pool.Put(conn, forceClose)
 }
 
-func (p *S2SPool) doDial() (io.Closer, error) {
+// Pick 使用Filter从当前的节点中选择地址，没有可用节点时返回ErrEmptyProxy
+func (p *S2SPool) Pick() (addr string, serverID int64, err error) {
 	p.mut.Lock()
-	item := new(S2SPoolItem)
-	item.Addr, item.ServerID = p.Filter.Filter(p.proxys)
+	addr, serverID = p.Filter.Filter(p.proxys)
 	p.mut.Unlock()
 
-	if item.ServerID == 0 {
-		return nil, ErrEmptyProxy
+	if serverID == 0 {
+		return "", 0, ErrEmptyProxy
+	}
+	return addr, serverID, nil
+}
+
+// Target 使用Filter选择地址，可以作为yyserver.Client.Target
+func (p *S2SPool) Target() (string, error) {
+	addr, _, err := p.Pick()
+	return addr, err
+}
+
+func (p *S2SPool) doDial() (io.Closer, error) {
+	item := new(S2SPoolItem)
+	var err error
+	item.Addr, item.ServerID, err = p.Pick()
+	if err != nil {
+		return nil, err
 	}
 	conn, err := p.Dial(item.Addr)
 	if err != nil {
@@ -137,9 +153,19 @@ func (p *S2SPool) deletePool(serverID int64) {
 	})
 }
 
+// DefaultSocketOptions DefaultDial使用的套接字选项
+var DefaultSocketOptions util.SocketOptions
+
 // DefaultDial 默认建立TCP连接
 func DefaultDial(addr string) (io.Closer, error) {
-	return net.Dial("tcp", addr)
+	return DefaultSocketOptions.DialContext(context.Background(), "tcp", addr)
+}
+
+// DialWithOptions 返回按options建立TCP连接的Dial函数
+func DialWithOptions(options util.SocketOptions) func(string) (io.Closer, error) {
+	return func(addr string) (io.Closer, error) {
+		return options.DialContext(context.Background(), "tcp", addr)
+	}
 }
 
 // DefaultFilter 默认地址选择方法，轮询选择所有IP地址
@@ -0,0 +1,115 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket 令牌桶限流，按rate每秒生成令牌，最多累积burst个，并发安全
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket 创建令牌桶，初始时令牌是满的
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill 按经过的时间补充令牌，调用时需持有mu
+func (b *TokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// Allow 获取一个令牌，令牌不足返回false
+func (b *TokenBucket) Allow() bool {
+	return b.AllowN(time.Now(), 1)
+}
+
+// AllowN 在now时刻获取n个令牌，令牌不足返回false且不消耗令牌
+func (b *TokenBucket) AllowN(now time.Time, n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Reserve 获取一个令牌，令牌不足时预支并返回需要等待的时间
+// 等待时间超过maxWait时不消耗令牌并返回false
+func (b *TokenBucket) Reserve(maxWait time.Duration) (time.Duration, bool) {
+	return b.ReserveN(time.Now(), 1, maxWait)
+}
+
+// ReserveN 在now时刻获取n个令牌，令牌不足时预支并返回需要等待的时间
+func (b *TokenBucket) ReserveN(now time.Time, n int, maxWait time.Duration) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	need := float64(n) - b.tokens
+	var wait time.Duration
+	if need > 0 {
+		if b.rate <= 0 {
+			return 0, false
+		}
+		wait = time.Duration(need / b.rate * float64(time.Second))
+		if wait > maxWait {
+			return 0, false
+		}
+	}
+	b.tokens -= float64(n)
+	return wait, true
+}
+
+// RefundN 归还n个已获取或预支的令牌，用于获取后请求被其他原因拒绝，最多累积到burst
+func (b *TokenBucket) RefundN(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += float64(n)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// SetRate 修改生成速率和最大累积数，当前令牌超过新的burst时截断
+func (b *TokenBucket) SetRate(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.rate = rate
+	b.burst = float64(burst)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Tokens 返回当前可用的令牌数，预支后为负数
+func (b *TokenBucket) Tokens() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	return b.tokens
+}
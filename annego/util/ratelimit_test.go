@@ -0,0 +1,72 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(10, 5)
+	now := time.Now()
+
+	// 初始令牌为burst
+	for i := 0; i < 5; i++ {
+		assert.True(t, b.AllowN(now, 1))
+	}
+	assert.False(t, b.AllowN(now, 1))
+
+	// 100ms生成1个令牌
+	now = now.Add(100 * time.Millisecond)
+	assert.True(t, b.AllowN(now, 1))
+	assert.False(t, b.AllowN(now, 1))
+
+	// 令牌最多累积burst个
+	now = now.Add(10 * time.Second)
+	assert.False(t, b.AllowN(now, 6))
+	assert.True(t, b.AllowN(now, 5))
+	assert.False(t, b.AllowN(now, 1))
+}
+
+func TestTokenBucketRefund(t *testing.T) {
+	b := NewTokenBucket(10, 2)
+	now := time.Now()
+	assert.True(t, b.AllowN(now, 2))
+	b.RefundN(1)
+	assert.True(t, b.AllowN(now, 1))
+	assert.False(t, b.AllowN(now, 1))
+
+	// 归还预支的令牌，最多累积burst个
+	_, ok := b.ReserveN(now, 1, time.Second)
+	assert.True(t, ok)
+	b.RefundN(5)
+	assert.InDelta(t, 2, b.Tokens(), 0.1)
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	b := NewTokenBucket(10, 1)
+	now := time.Now()
+
+	wait, ok := b.ReserveN(now, 1, 0)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), wait)
+
+	// 预支令牌，需要等待100ms
+	wait, ok = b.ReserveN(now, 1, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, 100*time.Millisecond, wait)
+	wait, ok = b.ReserveN(now, 1, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, 200*time.Millisecond, wait)
+
+	// 超过最长等待时间不消耗令牌
+	_, ok = b.ReserveN(now, 1, 100*time.Millisecond)
+	assert.False(t, ok)
+	wait, ok = b.ReserveN(now.Add(300*time.Millisecond), 1, 0)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), wait)
+
+	b.SetRate(1, 3)
+	assert.True(t, b.Tokens() <= 3)
+}
@@ -0,0 +1,138 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// ErrSockOptUnsupported 当前平台不支持的套接字选项
+var ErrSockOptUnsupported = errors.New("util: socket option unsupported on this platform")
+
+// SocketOptions TCP套接字选项，零值表示使用系统和Go的默认设置
+// Linux上通过syscall在bind之前设置，其他平台不支持ReusePort、ReuseAddr和Backlog
+type SocketOptions struct {
+	// ReusePort SO_REUSEPORT，多个进程可以监听同一端口，由内核在进程间分配连接
+	// Linux上mips、sparc等取值不同的架构不支持，返回ErrSockOptUnsupported
+	ReusePort bool
+	// ReuseAddr SO_REUSEADDR，Go在Linux上监听时默认开启
+	ReuseAddr bool
+	// Nagle 为true时启用Nagle算法，即关闭TCP_NODELAY，Go默认开启TCP_NODELAY
+	Nagle bool
+	// KeepAlive TCP keepalive探测间隔，为0使用Go的默认值，小于0关闭keepalive
+	KeepAlive time.Duration
+	// SendBuffer、RecvBuffer SO_SNDBUF、SO_RCVBUF，为0使用系统默认值
+	// 监听时设置在listener上，由接受的连接继承
+	SendBuffer int
+	RecvBuffer int
+	// Backlog 监听队列长度，为0使用系统默认值somaxconn
+	Backlog int
+}
+
+// Listen 按选项监听地址
+func (o *SocketOptions) Listen(network, address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: o.control, KeepAlive: o.KeepAlive}
+	l, err := lc.Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	if o.Backlog > 0 {
+		if err := o.setBacklog(l); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if o.needSetup() {
+		l = &sockListener{Listener: l, options: o}
+	}
+	return l, nil
+}
+
+// ListenPacket 按选项监听UDP地址，Nagle和Backlog不生效
+func (o *SocketOptions) ListenPacket(network, address string) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: o.control}
+	return lc.ListenPacket(context.Background(), network, address)
+}
+
+// DialContext 按选项建立连接，可以用作yyserver.Dialer.DialContextFunc
+func (o *SocketOptions) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d := net.Dialer{Control: o.control, KeepAlive: o.KeepAlive}
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.setupConn(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// setupConn 设置无法通过listener继承的选项
+func (o *SocketOptions) setupConn(conn net.Conn) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if o.Nagle {
+		if err := tcp.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	if !sockoptInherit {
+		if o.SendBuffer > 0 {
+			if err := tcp.SetWriteBuffer(o.SendBuffer); err != nil {
+				return err
+			}
+		}
+		if o.RecvBuffer > 0 {
+			if err := tcp.SetReadBuffer(o.RecvBuffer); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (o *SocketOptions) needSetup() bool {
+	return o.Nagle || (!sockoptInherit && (o.SendBuffer > 0 || o.RecvBuffer > 0))
+}
+
+// sockListener 对接受的连接设置选项
+type sockListener struct {
+	net.Listener
+	options *SocketOptions
+}
+
+func (l *sockListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.options.setupConn(conn); err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "accept", Net: l.Addr().Network(), Addr: l.Addr(), Err: &tempError{err}}
+	}
+	return conn, nil
+}
+
+// tempError 单个连接设置失败不影响继续接受连接
+type tempError struct {
+	error
+}
+
+func (e *tempError) Timeout() bool   { return false }
+func (e *tempError) Temporary() bool { return true }
+
+// rawControl 在syscall.RawConn上执行fn并返回fn的错误
+func rawControl(c syscall.RawConn, fn func(fd uintptr) error) error {
+	var ferr error
+	if err := c.Control(func(fd uintptr) {
+		ferr = fn(fd)
+	}); err != nil {
+		return err
+	}
+	return ferr
+}
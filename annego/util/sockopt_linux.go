@@ -0,0 +1,64 @@
+//go:build linux
+// +build linux
+
+package util
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// sockoptInherit 接受的连接继承listener的SO_SNDBUF、SO_RCVBUF
+const sockoptInherit = true
+
+// control 在bind之前设置套接字选项
+func (o *SocketOptions) control(network, address string, c syscall.RawConn) error {
+	return rawControl(c, func(fd uintptr) error {
+		set := func(name string, opt, value int) error {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, opt, value); err != nil {
+				return os.NewSyscallError("setsockopt "+name, err)
+			}
+			return nil
+		}
+		if o.ReusePort {
+			if soReusePort == 0 {
+				return ErrSockOptUnsupported
+			}
+			if err := set("SO_REUSEPORT", soReusePort, 1); err != nil {
+				return err
+			}
+		}
+		if o.ReuseAddr {
+			if err := set("SO_REUSEADDR", syscall.SO_REUSEADDR, 1); err != nil {
+				return err
+			}
+		}
+		if o.SendBuffer > 0 {
+			if err := set("SO_SNDBUF", syscall.SO_SNDBUF, o.SendBuffer); err != nil {
+				return err
+			}
+		}
+		if o.RecvBuffer > 0 {
+			if err := set("SO_RCVBUF", syscall.SO_RCVBUF, o.RecvBuffer); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// setBacklog 对已监听的套接字再次调用listen修改队列长度
+func (o *SocketOptions) setBacklog(l net.Listener) error {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return ErrSockOptUnsupported
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return rawControl(raw, func(fd uintptr) error {
+		return os.NewSyscallError("listen", syscall.Listen(int(fd), o.Backlog))
+	})
+}
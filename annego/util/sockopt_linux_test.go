@@ -0,0 +1,79 @@
+//go:build linux
+// +build linux
+
+package util
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getsockopt(t *testing.T, conn interface{}, level, opt int) int {
+	raw, err := conn.(syscall.Conn).SyscallConn()
+	assert.Nil(t, err)
+	var value int
+	err = rawControl(raw, func(fd uintptr) error {
+		var err error
+		value, err = syscall.GetsockoptInt(int(fd), level, opt)
+		return err
+	})
+	assert.Nil(t, err)
+	return value
+}
+
+func TestSocketOptionsReusePort(t *testing.T) {
+	if soReusePort == 0 {
+		t.Skip("SO_REUSEPORT unsupported on this architecture")
+	}
+	options := SocketOptions{ReusePort: true, Backlog: 16}
+	l1, err := options.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l1.Close()
+	l2, err := options.Listen("tcp", l1.Addr().String())
+	assert.Nil(t, err)
+	defer l2.Close()
+
+	_, err = net.Listen("tcp", l1.Addr().String())
+	assert.NotNil(t, err)
+}
+
+func TestSocketOptionsConn(t *testing.T) {
+	options := SocketOptions{Nagle: true, SendBuffer: 64 * 1024, RecvBuffer: 64 * 1024}
+	l, err := options.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	client, err := options.DialContext(context.Background(), "tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+	server := <-accepted
+	defer server.Close()
+
+	for _, conn := range []net.Conn{client, server} {
+		assert.Equal(t, 0, getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY))
+		// 内核设置为请求值的2倍
+		assert.True(t, getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF) >= 64*1024)
+		assert.True(t, getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF) >= 64*1024)
+	}
+
+	var defaults SocketOptions
+	conn, err := defaults.DialContext(context.Background(), "tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	assert.Equal(t, 1, getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY))
+	(<-accepted).Close()
+}
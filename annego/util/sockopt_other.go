@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package util
+
+import (
+	"net"
+	"syscall"
+)
+
+// sockoptInherit 其他平台在接受连接后设置SO_SNDBUF、SO_RCVBUF
+const sockoptInherit = false
+
+func (o *SocketOptions) control(network, address string, c syscall.RawConn) error {
+	if o.ReusePort || o.ReuseAddr {
+		return ErrSockOptUnsupported
+	}
+	return nil
+}
+
+func (o *SocketOptions) setBacklog(l net.Listener) error {
+	return ErrSockOptUnsupported
+}
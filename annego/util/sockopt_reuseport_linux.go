@@ -0,0 +1,7 @@
+//go:build 386 || amd64 || arm || arm64 || loong64 || ppc64 || ppc64le || riscv64 || s390x
+// +build 386 amd64 arm arm64 loong64 ppc64 ppc64le riscv64 s390x
+
+package util
+
+// soReusePort SO_REUSEPORT，syscall包未定义，这些架构的取值为0xf
+const soReusePort = 0xf
@@ -0,0 +1,7 @@
+//go:build !386 && !amd64 && !arm && !arm64 && !loong64 && !ppc64 && !ppc64le && !riscv64 && !s390x
+// +build !386,!amd64,!arm,!arm64,!loong64,!ppc64,!ppc64le,!riscv64,!s390x
+
+package util
+
+// soReusePort mips、sparc等架构SO_REUSEPORT的取值不同，为0表示不支持
+const soReusePort = 0
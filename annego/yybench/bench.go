@@ -0,0 +1,467 @@
+package yybench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"goBase/annego/packet"
+)
+
+// Config 压测配置
+type Config struct {
+	Network string
+	Address string
+	// Dial 建立连接，为nil时使用net.Dialer
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// Format 数据帧格式，默认为YYFormat
+	Format Format
+	// Requests 请求数据帧，各连接按顺序轮流发送，可以使用Build从模板生成
+	Requests [][]byte
+
+	// Connections 连接数，默认为1
+	Connections int
+	// QPS 所有连接的目标QPS，为0时为闭环模式，每个连接收到回复后再发送下一个请求
+	QPS float64
+	// Inflight QPS模式下单个连接未收到回复的最大请求数，默认为1024
+	Inflight int
+	// Duration 压测时间，Total和Duration至少设置一个，先达到的生效
+	Duration time.Duration
+	// Total 发送的请求总数
+	Total int
+	// Timeout 单个请求等待回复的时间，默认为5秒
+	Timeout time.Duration
+
+	// Key 从请求和回复数据帧中提取关联key，key相同的请求和回复按顺序对应
+	// 为nil时每个连接上的请求和回复按顺序对应
+	Key func(frame []byte) (string, bool)
+}
+
+// LatencyStats 延迟统计
+type LatencyStats struct {
+	Min  time.Duration
+	Mean time.Duration
+	P50  time.Duration
+	P90  time.Duration
+	P99  time.Duration
+	P999 time.Duration
+	Max  time.Duration
+}
+
+// Report 压测结果
+type Report struct {
+	Elapsed    time.Duration
+	Sent       uint64
+	Received   uint64
+	Timeouts   uint64
+	Errors     map[string]uint64 // 按错误类型统计
+	Throughput float64           // 每秒收到的回复数
+	Latency    LatencyStats
+}
+
+// ErrorCount 返回错误总数，不包括超时
+func (r *Report) ErrorCount() uint64 {
+	var total uint64
+	for _, n := range r.Errors {
+		total += n
+	}
+	return total
+}
+
+func (r *Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "elapsed %v sent %d received %d timeouts %d errors %d\n",
+		r.Elapsed.Round(time.Millisecond), r.Sent, r.Received, r.Timeouts, r.ErrorCount())
+	fmt.Fprintf(&b, "throughput %.1f/s\n", r.Throughput)
+	l := r.Latency
+	fmt.Fprintf(&b, "latency min %v mean %v p50 %v p90 %v p99 %v p999 %v max %v\n",
+		l.Min, l.Mean, l.P50, l.P90, l.P99, l.P999, l.Max)
+	kinds := make([]string, 0, len(r.Errors))
+	for kind := range r.Errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(&b, "error %s %d\n", kind, r.Errors[kind])
+	}
+	return b.String()
+}
+
+// bench 一次压测的状态
+type bench struct {
+	config   Config
+	interval time.Duration // 单个连接的发送间隔，闭环模式为0
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	issued   int64 // 已分配的请求数，原子操作
+	sent     uint64
+	received uint64
+	timeouts uint64
+
+	mut       sync.Mutex
+	errors    map[string]uint64
+	latencies []time.Duration
+}
+
+// Run 执行压测直到达到Duration或Total，或者ctx取消
+func Run(ctx context.Context, config Config) (*Report, error) {
+	if len(config.Requests) == 0 {
+		return nil, errors.New("yybench: no request")
+	}
+	if config.Duration <= 0 && config.Total <= 0 {
+		return nil, errors.New("yybench: Duration or Total required")
+	}
+	if config.Format == nil {
+		config.Format = YYFormat
+	}
+	if config.Connections <= 0 {
+		config.Connections = 1
+	}
+	if config.Inflight <= 0 {
+		config.Inflight = 1024
+	}
+	if config.QPS <= 0 {
+		config.Inflight = 1
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.Dial == nil {
+		var dialer net.Dialer
+		config.Dial = dialer.DialContext
+	}
+
+	b := &bench{
+		config: config,
+		stop:   make(chan struct{}),
+		errors: make(map[string]uint64),
+	}
+	if config.QPS > 0 {
+		b.interval = time.Duration(float64(time.Second) * float64(config.Connections) / config.QPS)
+	}
+	if config.Duration > 0 {
+		timer := time.AfterFunc(config.Duration, b.finish)
+		defer timer.Stop()
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.finish()
+		case <-b.stop:
+		}
+	}()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < config.Connections; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b.runWorker(i)
+		}(i)
+	}
+	wg.Wait()
+	b.finish()
+	return b.report(time.Since(start)), nil
+}
+
+func (b *bench) finish() {
+	b.stopOnce.Do(func() { close(b.stop) })
+}
+
+func (b *bench) stopped() bool {
+	select {
+	case <-b.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// next 分配下一个请求的序号，达到Total时返回false
+func (b *bench) next() (int, bool) {
+	n := atomic.AddInt64(&b.issued, 1) - 1
+	if b.config.Total > 0 && n >= int64(b.config.Total) {
+		return 0, false
+	}
+	return int(n), true
+}
+
+func (b *bench) exhausted() bool {
+	return b.config.Total > 0 && atomic.LoadInt64(&b.issued) >= int64(b.config.Total)
+}
+
+func (b *bench) addError(kind string, n uint64) {
+	if n == 0 {
+		return
+	}
+	b.mut.Lock()
+	b.errors[kind] += n
+	b.mut.Unlock()
+}
+
+func (b *bench) addLatencies(list []time.Duration) {
+	b.mut.Lock()
+	b.latencies = append(b.latencies, list...)
+	b.mut.Unlock()
+}
+
+// runWorker 单个连接的压测，连接断开后重连
+func (b *bench) runWorker(index int) {
+	for !b.stopped() && !b.exhausted() {
+		ctx, cancel := context.WithTimeout(context.Background(), b.config.Timeout)
+		conn, err := b.config.Dial(ctx, b.config.Network, b.config.Address)
+		cancel()
+		if err != nil {
+			b.addError("dial", 1)
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-b.stop:
+			}
+			continue
+		}
+		b.runConn(conn)
+	}
+}
+
+// pendingList 等待回复的请求发送时间，按key分组
+type pendingList struct {
+	mut   sync.Mutex
+	byKey map[string][]time.Time
+	count int
+}
+
+func (p *pendingList) push(key string, t time.Time) {
+	p.mut.Lock()
+	p.byKey[key] = append(p.byKey[key], t)
+	p.count++
+	p.mut.Unlock()
+}
+
+func (p *pendingList) pop(key string) (time.Time, bool) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	list := p.byKey[key]
+	if len(list) == 0 {
+		return time.Time{}, false
+	}
+	t := list[0]
+	if len(list) == 1 {
+		delete(p.byKey, key)
+	} else {
+		p.byKey[key] = list[1:]
+	}
+	p.count--
+	return t, true
+}
+
+// expire 移除发送时间早于deadline的请求，返回移除的数量
+func (p *pendingList) expire(deadline time.Time) int {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	expired := 0
+	for key, list := range p.byKey {
+		i := 0
+		for i < len(list) && list[i].Before(deadline) {
+			i++
+		}
+		if i == 0 {
+			continue
+		}
+		expired += i
+		if i == len(list) {
+			delete(p.byKey, key)
+		} else {
+			p.byKey[key] = list[i:]
+		}
+	}
+	p.count -= expired
+	return expired
+}
+
+func (p *pendingList) len() int {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	return p.count
+}
+
+func (b *bench) key(frame []byte) string {
+	if b.config.Key == nil {
+		return ""
+	}
+	key, _ := b.config.Key(frame)
+	return key
+}
+
+// runConn 在连接上发送请求直到压测结束或连接出错
+func (b *bench) runConn(conn net.Conn) {
+	pending := &pendingList{byKey: make(map[string][]time.Time)}
+	slots := make(chan struct{}, b.config.Inflight)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.readLoop(conn, pending, slots)
+	}()
+
+	nextSend := time.Now()
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-b.stop:
+			goto DRAIN
+		case <-done:
+			goto DRAIN
+		}
+		if b.interval > 0 {
+			if wait := time.Until(nextSend); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-b.stop:
+					goto DRAIN
+				case <-done:
+					goto DRAIN
+				}
+			}
+			nextSend = nextSend.Add(b.interval)
+		}
+		n, ok := b.next()
+		if !ok {
+			goto DRAIN
+		}
+		frame := b.config.Requests[n%len(b.config.Requests)]
+		pending.push(b.key(frame), time.Now())
+		conn.SetWriteDeadline(time.Now().Add(b.config.Timeout))
+		if _, err := conn.Write(frame); err != nil {
+			pending.pop(b.key(frame))
+			b.addError("write", 1)
+			goto DRAIN
+		}
+		atomic.AddUint64(&b.sent, 1)
+	}
+
+DRAIN:
+	// 等待已发送请求的回复
+	deadline := time.Now().Add(b.config.Timeout)
+	for pending.len() > 0 && time.Now().Before(deadline) {
+		select {
+		case <-done:
+			deadline = time.Now()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	conn.Close()
+	<-done
+	atomic.AddUint64(&b.timeouts, uint64(pending.len()))
+}
+
+// readLoop 读取回复并与请求关联，连接出错时返回
+func (b *bench) readLoop(conn net.Conn, pending *pendingList, slots chan struct{}) {
+	buf := make([]byte, 0, 64*1024)
+	chunk := make([]byte, 64*1024)
+	latencies := make([]time.Duration, 0, 1024)
+	defer func() {
+		b.addLatencies(latencies)
+	}()
+
+	for {
+		for {
+			length, err := b.config.Format.FrameLength(buf)
+			if err == packet.ErrInputNotEnough {
+				break
+			}
+			if err != nil {
+				b.addError("frame", 1)
+				return
+			}
+			frame := buf[:length]
+			if sendTime, ok := pending.pop(b.key(frame)); ok {
+				latencies = append(latencies, time.Since(sendTime))
+				atomic.AddUint64(&b.received, 1)
+				<-slots
+			} else {
+				b.addError("unmatched", 1)
+			}
+			buf = buf[:copy(buf, buf[length:])]
+		}
+		if len(latencies) >= 1024 {
+			b.addLatencies(latencies)
+			latencies = latencies[:0]
+		}
+
+		conn.SetReadDeadline(time.Now().Add(b.config.Timeout))
+		n, err := conn.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		if err != nil {
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				expired := pending.expire(time.Now().Add(-b.config.Timeout))
+				atomic.AddUint64(&b.timeouts, uint64(expired))
+				for i := 0; i < expired; i++ {
+					<-slots
+				}
+				continue
+			}
+			if !b.stopped() && !b.exhausted() {
+				b.addError("read", 1)
+			}
+			return
+		}
+	}
+}
+
+func (b *bench) report(elapsed time.Duration) *Report {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	r := &Report{
+		Elapsed:  elapsed,
+		Sent:     atomic.LoadUint64(&b.sent),
+		Received: atomic.LoadUint64(&b.received),
+		Timeouts: atomic.LoadUint64(&b.timeouts),
+		Errors:   b.errors,
+		Latency:  latencyStats(b.latencies),
+	}
+	if elapsed > 0 {
+		r.Throughput = float64(r.Received) / elapsed.Seconds()
+	}
+	return r
+}
+
+func latencyStats(list []time.Duration) LatencyStats {
+	if len(list) == 0 {
+		return LatencyStats{}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	var sum time.Duration
+	for _, d := range list {
+		sum += d
+	}
+	return LatencyStats{
+		Min:  list[0],
+		Mean: sum / time.Duration(len(list)),
+		P50:  percentile(list, 0.5),
+		P90:  percentile(list, 0.9),
+		P99:  percentile(list, 0.99),
+		P999: percentile(list, 0.999),
+		Max:  list[len(list)-1],
+	}
+}
+
+// percentile 已排序列表的分位数，使用nearest-rank
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	rank := int(math.Ceil(q * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,208 @@
+package yybench
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+	"goBase/annego/yyserver"
+)
+
+type PTest struct {
+	Int uint32
+	Str string
+}
+
+func (self *PTest) GetURI() uint32 {
+	return 1
+}
+
+func (self *PTest) Marshal(pk *packet.Pack) {
+	packet.DefaultMarshal(self, pk)
+}
+
+func (self *PTest) Unmarshal(up *packet.Unpack) error {
+	return packet.DefaultUnmarshal(self, up)
+}
+
+func TestBuild(t *testing.T) {
+	register := packet.NewYYRegister()
+	register.Register(new(PTest))
+
+	var templates []Template
+	assert.Nil(t, json.Unmarshal([]byte(`[
+		{"uri": 1, "body": {"Int": 7, "Str": "abc"}, "weight": 2},
+		{"uri": 1, "fields": [{"type": "uint32", "value": 7}, {"type": "str16", "value": "abc"}]},
+		{"uri": 3, "raw": "AQI="}
+	]`), &templates))
+	frames, err := Build(templates, register, YYFormat)
+	assert.Nil(t, err)
+	assert.Len(t, frames, 4)
+	expected := packet.GetMarshalPack(&PTest{7, "abc"}).Bytes()
+	assert.Equal(t, expected, frames[0])
+	assert.Equal(t, expected, frames[1])
+	assert.Equal(t, expected, frames[2])
+	assert.Equal(t, packet.PackFrame(3, packet.ResSuccess, []byte{1, 2}), frames[3])
+
+	_, err = Build([]Template{{URI: 2, Body: json.RawMessage(`{}`)}}, register, YYFormat)
+	assert.NotNil(t, err)
+	_, err = Build([]Template{{URI: 1, Fields: []Field{{Type: "float", Value: json.RawMessage(`1`)}}}}, nil, YYFormat)
+	assert.NotNil(t, err)
+}
+
+func TestStreamFormat(t *testing.T) {
+	frame := StreamFormat.Pack(0x102, []byte("12345678x"))
+	assert.Equal(t, []byte{0, 0, 0, 14, 0x02}, frame[:5])
+	assert.Equal(t, uint32(2), StreamFormat.URI(frame))
+	length, err := StreamFormat.FrameLength(append(frame, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, 14, length)
+	_, err = StreamFormat.FrameLength(frame[:10])
+	assert.Equal(t, packet.ErrInputNotEnough, err)
+	_, err = StreamFormat.FrameLength([]byte{0, 0, 0, 3})
+	assert.NotNil(t, err)
+	key, ok := StreamIDKey(frame)
+	assert.True(t, ok)
+	assert.Equal(t, "12345678", key)
+}
+
+func TestPercentile(t *testing.T) {
+	list := make([]time.Duration, 0, 100)
+	for i := 100; i > 0; i-- {
+		list = append(list, time.Duration(i))
+	}
+	stats := latencyStats(list)
+	assert.Equal(t, time.Duration(1), stats.Min)
+	assert.Equal(t, time.Duration(50), stats.P50)
+	assert.Equal(t, time.Duration(90), stats.P90)
+	assert.Equal(t, time.Duration(99), stats.P99)
+	assert.Equal(t, time.Duration(100), stats.P999)
+	assert.Equal(t, time.Duration(100), stats.Max)
+}
+
+func startYYServer(t *testing.T) string {
+	server := yyserver.NewYYServer()
+	server.RegisterHandle(new(PTest), func(c *yyserver.YYConnect, msg packet.Marshallable) bool {
+		c.Send(msg)
+		return true
+	})
+	assert.Nil(t, server.Start("127.0.0.1:0"))
+	return server.GetListenAddr().String()
+}
+
+func TestRunClosedLoop(t *testing.T) {
+	addr := startYYServer(t)
+	report, err := Run(context.Background(), Config{
+		Network:     "tcp",
+		Address:     addr,
+		Requests:    [][]byte{packet.GetMarshalPack(&PTest{1, "bench"}).Bytes()},
+		Connections: 4,
+		Total:       200,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(200), report.Sent)
+	assert.Equal(t, uint64(200), report.Received)
+	assert.Equal(t, uint64(0), report.Timeouts)
+	assert.Equal(t, uint64(0), report.ErrorCount())
+	assert.True(t, report.Latency.Max >= report.Latency.P50)
+	assert.True(t, report.Throughput > 0)
+	assert.Contains(t, report.String(), "received 200")
+}
+
+func TestRunQPS(t *testing.T) {
+	addr := startYYServer(t)
+	report, err := Run(context.Background(), Config{
+		Network:     "tcp",
+		Address:     addr,
+		Requests:    [][]byte{packet.GetMarshalPack(&PTest{1, "bench"}).Bytes()},
+		Connections: 2,
+		QPS:         200,
+		Duration:    500 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+	assert.InDelta(t, 100, float64(report.Sent), 20)
+	assert.Equal(t, report.Sent, report.Received)
+	assert.Equal(t, uint64(0), report.ErrorCount())
+}
+
+// startStreamServer tcp-stream-proto格式的服务，两个请求为一组倒序回复
+func startStreamServer(t *testing.T, reply bool) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				var batch [][]byte
+				for {
+					head := make([]byte, 4)
+					if _, err := io.ReadFull(conn, head); err != nil {
+						return
+					}
+					frame := make([]byte, binary.BigEndian.Uint32(head))
+					copy(frame, head)
+					if _, err := io.ReadFull(conn, frame[4:]); err != nil {
+						return
+					}
+					if !reply {
+						continue
+					}
+					batch = append(batch, StreamFormat.Pack(0x82, append(frame[5:13], 0)))
+					if len(batch) == 2 {
+						conn.Write(batch[1])
+						conn.Write(batch[0])
+						batch = batch[:0]
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestRunStreamFormat(t *testing.T) {
+	addr := startStreamServer(t, true)
+	report, err := Run(context.Background(), Config{
+		Network: "tcp",
+		Address: addr,
+		Format:  StreamFormat,
+		Requests: [][]byte{
+			StreamFormat.Pack(0x02, []byte("00000001payload")),
+			StreamFormat.Pack(0x02, []byte("00000002payload")),
+		},
+		QPS:      1000,
+		Total:    100,
+		Inflight: 2,
+		Key:      StreamIDKey,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), report.Received)
+	assert.Equal(t, uint64(0), report.ErrorCount())
+}
+
+func TestRunTimeout(t *testing.T) {
+	addr := startStreamServer(t, false)
+	report, err := Run(context.Background(), Config{
+		Network:  "tcp",
+		Address:  addr,
+		Format:   StreamFormat,
+		Requests: [][]byte{StreamFormat.Pack(0x02, []byte("00000001"))},
+		Total:    3,
+		Timeout:  100 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), report.Sent)
+	assert.Equal(t, uint64(0), report.Received)
+	assert.Equal(t, uint64(3), report.Timeouts)
+}
@@ -0,0 +1,92 @@
+package yybench
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"goBase/annego/packet"
+)
+
+// Format 数据帧格式
+type Format interface {
+	// Pack 将协议号和包体打包为完整的数据帧
+	Pack(uri uint32, body []byte) []byte
+	// FrameLength 返回data开头完整数据帧的长度，数据不足时返回packet.ErrInputNotEnough
+	FrameLength(data []byte) (int, error)
+	// URI 返回数据帧的协议号
+	URI(frame []byte) uint32
+}
+
+// YYFormat YY协议包头: Length(4, 小端, 包含包头) + URI(4) + ResCode(2)
+var YYFormat Format = yyFormat{}
+
+// StreamFormat tcp-stream-proto的帧格式: Length(4, 大端, 包含长度字段) + CommandID(1)
+// URI的低8位作为CommandID
+var StreamFormat Format = streamFormat{}
+
+// streamHeaderLength Length 4 + CommandID 1
+const streamHeaderLength = 5
+
+type yyFormat struct{}
+
+func (yyFormat) Pack(uri uint32, body []byte) []byte {
+	return packet.PackFrame(uri, packet.ResSuccess, body)
+}
+
+func (yyFormat) FrameLength(data []byte) (int, error) {
+	return packet.FrameLength(data)
+}
+
+func (yyFormat) URI(frame []byte) uint32 {
+	return binary.LittleEndian.Uint32(frame[4:8])
+}
+
+type streamFormat struct{}
+
+func (streamFormat) Pack(uri uint32, body []byte) []byte {
+	frame := make([]byte, streamHeaderLength+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)))
+	frame[4] = byte(uri)
+	copy(frame[streamHeaderLength:], body)
+	return frame
+}
+
+func (streamFormat) FrameLength(data []byte) (int, error) {
+	if len(data) < 4 {
+		return 0, packet.ErrInputNotEnough
+	}
+	length := binary.BigEndian.Uint32(data)
+	if length < streamHeaderLength {
+		return 0, fmt.Errorf("stream frame length too short, length %d", length)
+	}
+	if length > packet.MaxPacketLength {
+		return 0, fmt.Errorf("stream frame length too long, length %d", length)
+	}
+	if len(data) < int(length) {
+		return 0, packet.ErrInputNotEnough
+	}
+	return int(length), nil
+}
+
+func (streamFormat) URI(frame []byte) uint32 {
+	return uint32(frame[4])
+}
+
+// StreamIDKey 使用tcp-stream-proto submit/submit ack包体开头8字节的ID关联请求和回复
+func StreamIDKey(frame []byte) (string, bool) {
+	if len(frame) < streamHeaderLength+8 {
+		return "", false
+	}
+	return string(frame[streamHeaderLength : streamHeaderLength+8]), true
+}
+
+// ParseFormat 根据名字返回帧格式，支持yy和stream
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "yy":
+		return YYFormat, nil
+	case "stream":
+		return StreamFormat, nil
+	}
+	return nil, fmt.Errorf("unknown frame format %s", name)
+}
@@ -0,0 +1,99 @@
+package yybench
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"goBase/annego/packet"
+)
+
+const templateUsage = `
+模板文件为Template的JSON数组，包体来源按优先级为body、fields、raw:
+  body   按uri注册的消息类型解码的JSON，需要调用Main时传入注册了该类型的YYRegister
+  fields 按顺序打包的字段，type为bool uint8 uint16 uint32 uint64 str16 str32 bytes16 bytes32
+  raw    base64编码的原始包体
+
+  [{"uri": 1, "fields": [{"type": "uint32", "value": 1}, {"type": "str16", "value": "abc"}]},
+   {"uri": 2, "raw": "AQAAAA==", "weight": 2}]
+`
+
+// Main 解析命令行参数并运行压测，结束后退出进程
+// register为nil时模板不能使用body；需要body时在自己的main中注册消息类型后调用Main
+func Main(register *packet.YYRegister) {
+	network := flag.String("network", "tcp", "target network")
+	addr := flag.String("addr", "", "target address")
+	templates := flag.String("templates", "", "request template json file")
+	format := flag.String("format", "yy", "frame format: yy or stream")
+	connections := flag.Int("c", 1, "connections")
+	qps := flag.Float64("qps", 0, "target qps of all connections, 0 for closed-loop")
+	inflight := flag.Int("inflight", 0, "max inflight requests per connection in qps mode")
+	duration := flag.Duration("d", 10*time.Second, "bench duration")
+	total := flag.Int("n", 0, "total requests, 0 for no limit")
+	timeout := flag.Duration("timeout", 5*time.Second, "reply timeout")
+	streamID := flag.Bool("stream-id", false, "correlate stream frames by 8 bytes submit id")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "usage: %s -addr host:port -templates req.json [options]\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(out, templateUsage)
+		if register == nil {
+			fmt.Fprintln(out, "\n当前命令没有注册消息类型，模板只能使用fields或raw")
+		}
+	}
+	flag.Parse()
+
+	if *addr == "" || *templates == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	frameFormat, err := ParseFormat(*format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	list, err := LoadTemplates(*templates)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	requests, err := Build(list, register, frameFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	config := Config{
+		Network:     *network,
+		Address:     *addr,
+		Format:      frameFormat,
+		Requests:    requests,
+		Connections: *connections,
+		QPS:         *qps,
+		Inflight:    *inflight,
+		Duration:    *duration,
+		Total:       *total,
+		Timeout:     *timeout,
+	}
+	if *streamID {
+		config.Key = StreamIDKey
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	report, err := Run(ctx, config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Print(report)
+}
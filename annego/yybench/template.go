@@ -0,0 +1,145 @@
+package yybench
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"goBase/annego/packet"
+)
+
+// Template 请求模板，包体来源按优先级为Body、Fields、Raw
+type Template struct {
+	URI uint32 `json:"uri"`
+	// Body 按URI在YYRegister中注册的类型解码的JSON
+	Body json.RawMessage `json:"body,omitempty"`
+	// Fields 按顺序打包的字段，用于没有注册类型的场景
+	Fields []Field `json:"fields,omitempty"`
+	// Raw 原始包体，JSON中为base64
+	Raw []byte `json:"raw,omitempty"`
+	// Weight 发送比例，默认为1
+	Weight int `json:"weight,omitempty"`
+}
+
+// Field 模板中的单个字段
+// Type支持bool uint8 uint16 uint32 uint64 str16 str32 bytes16 bytes32，
+// 与packet.Pack的PutXXX对应，bytes的Value为base64
+type Field struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// LoadTemplates 从JSON文件读取模板列表
+func LoadTemplates(path string) ([]Template, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var templates []Template
+	if err := json.Unmarshal(data, &templates); err != nil {
+		return nil, fmt.Errorf("parse templates %s error %v", path, err)
+	}
+	return templates, nil
+}
+
+// Build 将模板打包为请求数据帧，按Weight重复，register为nil时不支持Body
+func Build(templates []Template, register *packet.YYRegister, format Format) ([][]byte, error) {
+	frames := make([][]byte, 0, len(templates))
+	for i, template := range templates {
+		body, err := template.body(register)
+		if err != nil {
+			return nil, fmt.Errorf("template %d uri %d: %v", i, template.URI, err)
+		}
+		frame := format.Pack(template.URI, body)
+		weight := template.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		for j := 0; j < weight; j++ {
+			frames = append(frames, frame)
+		}
+	}
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("no request template")
+	}
+	return frames, nil
+}
+
+func (t *Template) body(register *packet.YYRegister) ([]byte, error) {
+	switch {
+	case len(t.Body) > 0:
+		if register == nil {
+			return nil, fmt.Errorf("body need register, use fields or raw")
+		}
+		msg, ok := register.New(t.URI)
+		if !ok {
+			return nil, fmt.Errorf("not register uri")
+		}
+		if err := json.Unmarshal(t.Body, msg); err != nil {
+			return nil, err
+		}
+		return packet.MarshalBody(msg), nil
+	case len(t.Fields) > 0:
+		return packFields(t.Fields)
+	}
+	return t.Raw, nil
+}
+
+func packFields(fields []Field) ([]byte, error) {
+	pack := packet.NewPack()
+	for _, field := range fields {
+		if err := packField(pack, field); err != nil {
+			return nil, fmt.Errorf("field %s: %v", field.Type, err)
+		}
+	}
+	return pack.BodyBytes(), nil
+}
+
+func packField(pack *packet.Pack, field Field) error {
+	switch field.Type {
+	case "bool":
+		var v bool
+		if err := json.Unmarshal(field.Value, &v); err != nil {
+			return err
+		}
+		pack.PutBool(v)
+	case "uint8", "uint16", "uint32", "uint64":
+		var v uint64
+		if err := json.Unmarshal(field.Value, &v); err != nil {
+			return err
+		}
+		switch field.Type {
+		case "uint8":
+			pack.PutUint8(uint8(v))
+		case "uint16":
+			pack.PutUint16(uint16(v))
+		case "uint32":
+			pack.PutUint32(uint32(v))
+		default:
+			pack.PutUint64(v)
+		}
+	case "str16", "str32":
+		var v string
+		if err := json.Unmarshal(field.Value, &v); err != nil {
+			return err
+		}
+		if field.Type == "str16" {
+			pack.PutShortStr(v)
+		} else {
+			pack.PutLongStr(v)
+		}
+	case "bytes16", "bytes32":
+		var v []byte
+		if err := json.Unmarshal(field.Value, &v); err != nil {
+			return err
+		}
+		if field.Type == "bytes16" {
+			pack.PutShortSlice(v)
+		} else {
+			pack.PutByteSlice(v)
+		}
+	default:
+		return fmt.Errorf("unknown type")
+	}
+	return nil
+}
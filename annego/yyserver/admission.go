@@ -0,0 +1,215 @@
+package yyserver
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"goBase/annego/packet"
+	"goBase/annego/util"
+)
+
+// RefuseReason 拒绝连接的原因
+type RefuseReason int
+
+const (
+	// RefuseMaxConn 超过最大连接数
+	RefuseMaxConn RefuseReason = iota
+	// RefusePerIP 超过单个IP的最大连接数
+	RefusePerIP
+	// RefuseRate 超过接受连接的速率
+	RefuseRate
+	// RefuseDeny 命中黑名单或不在白名单内
+	RefuseDeny
+
+	refuseReasonCount
+)
+
+func (r RefuseReason) String() string {
+	switch r {
+	case RefuseMaxConn:
+		return "max_conn"
+	case RefusePerIP:
+		return "per_ip"
+	case RefuseRate:
+		return "rate"
+	case RefuseDeny:
+		return "deny"
+	}
+	return fmt.Sprintf("RefuseReason(%d)", int(r))
+}
+
+// AdmissionConfig 连接准入配置，各项为零值时表示不限制
+type AdmissionConfig struct {
+	// MaxConn 最大连接数
+	MaxConn int
+
+	// MaxConnPerIP 单个来源IP的最大连接数
+	MaxConnPerIP int
+
+	// AcceptRate 每秒接受的连接数，AcceptBurst为允许的突发数量
+	AcceptRate  float64
+	AcceptBurst int
+
+	// Allow CIDR白名单，非空时只接受白名单内的地址
+	Allow []string
+
+	// Deny CIDR黑名单，优先于白名单
+	Deny []string
+
+	// Refuse 拒绝连接时调用，返回的消息发送给对端后关闭连接，返回nil直接关闭
+	Refuse func(RefuseReason, net.Addr) packet.Marshallable
+}
+
+// refuseWriteTimeout 发送拒绝消息的超时时间
+const refuseWriteTimeout = time.Second
+
+type admission struct {
+	config AdmissionConfig
+	allow  []*net.IPNet
+	deny   []*net.IPNet
+	bucket *util.TokenBucket
+
+	refused [refuseReasonCount]uint64
+
+	mut    sync.Mutex
+	active int
+	perIP  map[string]int
+}
+
+func parseCIDRList(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func newAdmission(config AdmissionConfig) (*admission, error) {
+	a := &admission{config: config, perIP: make(map[string]int)}
+	var err error
+	if a.allow, err = parseCIDRList(config.Allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parseCIDRList(config.Deny); err != nil {
+		return nil, err
+	}
+	if config.AcceptRate > 0 {
+		a.bucket = util.NewTokenBucket(config.AcceptRate, config.AcceptBurst)
+	}
+	return a, nil
+}
+
+// addrIP 返回地址中的IP，非IP地址返回nil
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// acquire 判断是否接受来自addr的连接，接受的连接结束时需要调用release
+func (a *admission) acquire(addr net.Addr) (RefuseReason, bool) {
+	ip := addrIP(addr)
+	if ip != nil {
+		if containsIP(a.deny, ip) || (len(a.allow) > 0 && !containsIP(a.allow, ip)) {
+			return a.refuse(RefuseDeny)
+		}
+	}
+	if a.bucket != nil && !a.bucket.Allow() {
+		return a.refuse(RefuseRate)
+	}
+
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if a.config.MaxConn > 0 && a.active >= a.config.MaxConn {
+		return a.refuse(RefuseMaxConn)
+	}
+	if ip != nil && a.config.MaxConnPerIP > 0 {
+		key := ip.String()
+		if a.perIP[key] >= a.config.MaxConnPerIP {
+			return a.refuse(RefusePerIP)
+		}
+		a.perIP[key]++
+	}
+	a.active++
+	return 0, true
+}
+
+func (a *admission) refuse(reason RefuseReason) (RefuseReason, bool) {
+	atomic.AddUint64(&a.refused[reason], 1)
+	return reason, false
+}
+
+func (a *admission) release(addr net.Addr) {
+	ip := addrIP(addr)
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	a.active--
+	if ip != nil && a.config.MaxConnPerIP > 0 {
+		key := ip.String()
+		if a.perIP[key] <= 1 {
+			delete(a.perIP, key)
+		} else {
+			a.perIP[key]--
+		}
+	}
+}
+
+// refuseConn 发送拒绝消息后关闭连接
+func (a *admission) refuseConn(conn net.Conn, reason RefuseReason) {
+	defer conn.Close()
+	if a.config.Refuse == nil {
+		return
+	}
+	msg := a.config.Refuse(reason, conn.RemoteAddr())
+	if msg == nil {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(refuseWriteTimeout))
+	conn.Write(packet.GetMarshalPack(msg).Bytes())
+}
+
+// SetAdmission 设置连接准入控制，应该在程序启动时调用，CIDR格式错误返回error
+func (self *YYServer) SetAdmission(config AdmissionConfig) error {
+	if self.running {
+		panic("YYServer is runing")
+	}
+	a, err := newAdmission(config)
+	if err != nil {
+		return err
+	}
+	self.admission = a
+	return nil
+}
+
+// RefuseStats 返回各拒绝原因的累计连接数
+func (self *YYServer) RefuseStats() map[RefuseReason]uint64 {
+	stats := make(map[RefuseReason]uint64, refuseReasonCount)
+	for reason := RefuseReason(0); reason < refuseReasonCount; reason++ {
+		var count uint64
+		if self.admission != nil {
+			count = atomic.LoadUint64(&self.admission.refused[reason])
+		}
+		stats[reason] = count
+	}
+	return stats
+}
@@ -0,0 +1,94 @@
+package yyserver
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+)
+
+func startAdmissionServer(t *testing.T, config AdmissionConfig) (*YYServer, string) {
+	config.Refuse = func(reason RefuseReason, addr net.Addr) packet.Marshallable {
+		return &PTestRes{Int: uint32(reason), Str: reason.String()}
+	}
+	server := NewYYServer()
+	assert.Nil(t, server.SetAdmission(config))
+	return server, startEchoServer(t, server)
+}
+
+// dialEcho 建立连接并确认连接被接受
+func dialEcho(t *testing.T, addr string) *YYConnect {
+	conn, err := Dial("tcp", addr)
+	assert.Nil(t, err)
+	conn.SetTimeout(time.Second, time.Second)
+	conn.Send(&PTest{Int: 1000})
+	msg, err := conn.Recv(newTestRegister())
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1000), msg.(*PTestRes).Int)
+	return conn
+}
+
+// expectRefuse 建立连接并确认收到拒绝消息后连接关闭
+func expectRefuse(t *testing.T, addr string, reason RefuseReason) {
+	conn, err := Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetTimeout(time.Second, time.Second)
+	reg := newTestRegister()
+	msg, err := conn.Recv(reg)
+	assert.Nil(t, err)
+	assert.Equal(t, &PTestRes{Int: uint32(reason), Str: reason.String()}, msg)
+	_, err = conn.Recv(reg)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestAdmissionMaxConn(t *testing.T) {
+	server, addr := startAdmissionServer(t, AdmissionConfig{MaxConn: 2})
+	c1 := dialEcho(t, addr)
+	c2 := dialEcho(t, addr)
+	defer c2.Close()
+	expectRefuse(t, addr, RefuseMaxConn)
+	assert.Equal(t, uint64(1), server.RefuseStats()[RefuseMaxConn])
+
+	// 连接关闭后释放名额
+	c1.Close()
+	assert.Eventually(t, func() bool {
+		return server.Count() == 1
+	}, time.Second, time.Millisecond)
+	dialEcho(t, addr).Close()
+}
+
+func TestAdmissionPerIP(t *testing.T) {
+	server, addr := startAdmissionServer(t, AdmissionConfig{MaxConnPerIP: 1})
+	c1 := dialEcho(t, addr)
+	defer c1.Close()
+	expectRefuse(t, addr, RefusePerIP)
+	expectRefuse(t, addr, RefusePerIP)
+	assert.Equal(t, uint64(2), server.RefuseStats()[RefusePerIP])
+	assert.Equal(t, uint64(0), server.RefuseStats()[RefuseMaxConn])
+}
+
+func TestAdmissionRate(t *testing.T) {
+	server, addr := startAdmissionServer(t, AdmissionConfig{AcceptRate: 0.1, AcceptBurst: 1})
+	dialEcho(t, addr).Close()
+	expectRefuse(t, addr, RefuseRate)
+	assert.Equal(t, uint64(1), server.RefuseStats()[RefuseRate])
+}
+
+func TestAdmissionCIDR(t *testing.T) {
+	server, addr := startAdmissionServer(t, AdmissionConfig{Deny: []string{"127.0.0.0/8"}})
+	expectRefuse(t, addr, RefuseDeny)
+	assert.Equal(t, uint64(1), server.RefuseStats()[RefuseDeny])
+
+	_, addr = startAdmissionServer(t, AdmissionConfig{Allow: []string{"10.0.0.0/8"}})
+	expectRefuse(t, addr, RefuseDeny)
+
+	_, addr = startAdmissionServer(t, AdmissionConfig{Allow: []string{"127.0.0.1/32", "::1/128"}})
+	dialEcho(t, addr).Close()
+
+	assert.Error(t, NewYYServer().SetAdmission(AdmissionConfig{Allow: []string{"127.0.0.1"}}))
+}
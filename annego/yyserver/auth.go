@@ -0,0 +1,209 @@
+package yyserver
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"goBase/annego/packet"
+)
+
+var (
+	// ErrAuthTimeout 超过AuthConfig.Deadline未完成认证
+	ErrAuthTimeout = errors.New("yyserver: auth timeout")
+	// ErrAuthFailed 认证失败次数超过AuthConfig.MaxFailures
+	ErrAuthFailed = errors.New("yyserver: auth failed")
+	// ErrUnauthenticated 未认证的连接发送不在白名单内的消息，AuthConfig.CloseUnauthenticated为true
+	ErrUnauthenticated = errors.New("yyserver: unauthenticated")
+)
+
+// Principal 连接认证后的身份
+type Principal struct {
+	UID   uint64            // 用户ID
+	Name  string            // 用户名或服务名
+	Attrs map[string]string // 认证得到的其他属性
+}
+
+// Authenticator 校验登录消息
+type Authenticator interface {
+	// Authenticate 返回认证后的身份，error不为nil表示认证失败
+	// 在连接的读goroutine中执行，可以通过conn回复登录结果
+	// EventLoop和UDP连接共享读goroutine，在单独的goroutine中执行，之后收到的消息等待认证完成后按顺序处理
+	Authenticate(conn *YYConnect, login packet.Marshallable) (*Principal, error)
+}
+
+// AuthenticatorFunc 函数形式的Authenticator
+type AuthenticatorFunc func(conn *YYConnect, login packet.Marshallable) (*Principal, error)
+
+func (f AuthenticatorFunc) Authenticate(conn *YYConnect, login packet.Marshallable) (*Principal, error) {
+	return f(conn, login)
+}
+
+// AuthConfig 连接认证配置
+type AuthConfig struct {
+	// Login 登录消息，收到后交给Authenticator，不调用MessageHandle
+	// 认证成功后再次收到时重新认证
+	Login         packet.Marshallable
+	Authenticator Authenticator
+
+	// Allow 认证前允许交给MessageHandle的URI，其他消息被丢弃
+	// HTTPHandler的请求不能认证，只接受Login和Allow内的URI
+	Allow []uint32
+
+	// CloseUnauthenticated 为true时认证前收到不在Allow内的消息以ErrUnauthenticated关闭连接
+	CloseUnauthenticated bool
+
+	// Deadline 连接建立后完成认证的期限，超时以ErrAuthTimeout关闭连接，为0表示不限制
+	Deadline time.Duration
+
+	// MaxFailures 允许认证失败的次数，超过后以ErrAuthFailed关闭连接，为0表示第一次失败即关闭
+	MaxFailures int
+}
+
+type authState struct {
+	config AuthConfig
+	uri    uint32
+	allow  map[uint32]bool
+}
+
+// SetAuth 设置连接认证，应该在程序启动时调用
+// Login注册到服务的协议中，不能再通过RegisterHandle注册相同的URI
+// 认证完成后才处理之后的消息，保证之后的消息可以读取到Principal
+func (self *YYServer) SetAuth(config AuthConfig) error {
+	if self.running {
+		panic("YYServer is runing")
+	}
+	if config.Login == nil || config.Authenticator == nil {
+		return errors.New("yyserver: auth without Login or Authenticator")
+	}
+	if !self.register.Register(config.Login) {
+		return fmt.Errorf("yyserver: auth login uri %d has register", config.Login.GetURI())
+	}
+	a := &authState{config: config, uri: config.Login.GetURI(), allow: make(map[uint32]bool)}
+	for _, uri := range config.Allow {
+		a.allow[uri] = true
+	}
+	self.auth = a
+	return nil
+}
+
+// startAuth 新连接开始认证期限计时，到期时连接已关闭则不做处理
+func (self *YYServer) startAuth(yyconn *YYConnect) {
+	if self.auth == nil || self.auth.config.Deadline <= 0 {
+		return
+	}
+	time.AfterFunc(self.auth.config.Deadline, func() {
+		if !yyconn.Authenticated() {
+			yyconn.closeWith(ErrAuthTimeout)
+		}
+	})
+}
+
+// authTask 等待认证完成后处理的消息
+type authTask struct {
+	msg  packet.Marshallable
+	info recvInfo
+}
+
+// deferAuth 共享读goroutine的连接收到登录消息时，在单独的goroutine中认证，避免Authenticator阻塞其他连接
+// 认证期间收到的消息排队，由该goroutine按顺序处理，返回true表示消息已交给该goroutine
+func (self *YYServer) deferAuth(yyconn *YYConnect, msg packet.Marshallable, info recvInfo) bool {
+	if self.auth == nil || !yyconn.shared {
+		return false
+	}
+	yyconn.authMut.Lock()
+	defer yyconn.authMut.Unlock()
+	if !yyconn.authRunning && msg.GetURI() != self.auth.uri {
+		return false
+	}
+	yyconn.authQueue = append(yyconn.authQueue, authTask{msg, info})
+	if !yyconn.authRunning {
+		yyconn.authRunning = true
+		yyconn.pending.Add(1)
+		go self.runAuth(yyconn)
+	}
+	return true
+}
+
+// runAuth 按顺序处理排队的消息，队列为空时结束
+func (self *YYServer) runAuth(yyconn *YYConnect) {
+	defer yyconn.pending.Done()
+	for {
+		yyconn.authMut.Lock()
+		if len(yyconn.authQueue) == 0 {
+			yyconn.authRunning = false
+			yyconn.authMut.Unlock()
+			return
+		}
+		task := yyconn.authQueue[0]
+		yyconn.authQueue = yyconn.authQueue[1:]
+		yyconn.authMut.Unlock()
+
+		if closed, _ := yyconn.closeReason(); closed {
+			continue
+		}
+		// MessageHandle返回false，主动关闭连接
+		if !self.handleAuth(yyconn, task.msg, task.info) {
+			yyconn.closeWith(nil)
+		}
+	}
+}
+
+// authenticate 处理登录消息和未认证连接的消息，返回true表示消息已处理，不再交给MessageHandle
+func (self *YYServer) authenticate(yyconn *YYConnect, msg packet.Marshallable) bool {
+	a := self.auth
+	if a == nil {
+		return false
+	}
+	uri := msg.GetURI()
+	if uri == a.uri {
+		principal, err := a.config.Authenticator.Authenticate(yyconn, msg)
+		if err != nil {
+			// 流上的认证失败计入所在的连接
+			if root := yyconn.root(); int(atomic.AddInt32(&root.authFailures, 1)) > a.config.MaxFailures {
+				root.closeWith(ErrAuthFailed)
+			}
+			return true
+		}
+		if principal == nil {
+			principal = &Principal{}
+		}
+		yyconn.SetPrincipal(principal)
+		return true
+	}
+	return self.unauthenticated(yyconn, uri)
+}
+
+// unauthenticated 未认证的连接收到不在白名单内的URI时返回true，按配置关闭连接
+func (self *YYServer) unauthenticated(yyconn *YYConnect, uri uint32) bool {
+	a := self.auth
+	if a == nil || yyconn.Authenticated() || a.allow[uri] {
+		return false
+	}
+	if a.config.CloseUnauthenticated {
+		// 由读取错误结束连接，CloseHandle收到记录的关闭原因
+		yyconn.root().closeWith(ErrUnauthenticated)
+	}
+	return true
+}
+
+// Principal 返回连接认证后的身份，未认证时返回nil，流返回所在连接的身份
+func (c *YYConnect) Principal() *Principal {
+	p, _ := c.root().principal.Load().(*Principal)
+	return p
+}
+
+// Authenticated 连接是否已认证
+func (c *YYConnect) Authenticated() bool {
+	return c.Principal() != nil
+}
+
+// SetPrincipal 设置连接的身份，例如在ConnectHandle中按TLS客户端证书认证
+// 设置后连接视为已认证，不能设置为nil，流设置所在连接的身份
+func (c *YYConnect) SetPrincipal(p *Principal) {
+	if p == nil {
+		panic("YYConnect: SetPrincipal nil")
+	}
+	c.root().principal.Store(p)
+}
@@ -0,0 +1,200 @@
+package yyserver
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+)
+
+type PLogin struct {
+	UID   uint64
+	Token string
+}
+
+func (self *PLogin) GetURI() uint32 {
+	return 10
+}
+
+func (self *PLogin) Marshal(pk *packet.Pack) {
+	packet.DefaultMarshal(self, pk)
+}
+
+func (self *PLogin) Unmarshal(up *packet.Unpack) error {
+	return packet.DefaultUnmarshal(self, up)
+}
+
+// testAuthenticator Token为secret时认证成功，回复Int为100的PTestRes
+var testAuthenticator = AuthenticatorFunc(func(c *YYConnect, msg packet.Marshallable) (*Principal, error) {
+	login := msg.(*PLogin)
+	if login.Token != "secret" {
+		return nil, errors.New("bad token")
+	}
+	c.Send(&PTestRes{Int: 100})
+	return &Principal{UID: login.UID}, nil
+})
+
+// startAuthServer 启动认证服务，PTest回复的Int为连接的UID
+func startAuthServer(t *testing.T, config AuthConfig) (*YYServer, string, chan error) {
+	server := NewYYServer()
+	config.Login = new(PLogin)
+	config.Authenticator = testAuthenticator
+	assert.Nil(t, server.SetAuth(config))
+	closed := make(chan error, 1)
+	server.RegisterCloseFunc(func(c *YYConnect, err error) {
+		closed <- err
+	})
+	server.RegisterHandle(new(PTest), func(c *YYConnect, msg packet.Marshallable) bool {
+		var uid uint64
+		if p := c.Principal(); p != nil {
+			uid = p.UID
+		}
+		c.Send(&PTestRes{Int: uint32(uid), Str: msg.(*PTest).Str})
+		return true
+	})
+	server.RegisterHandle(new(PBig), func(c *YYConnect, msg packet.Marshallable) bool {
+		return true
+	})
+	assert.Nil(t, server.Start("127.0.0.1:0"))
+	return server, server.GetListenAddr().String(), closed
+}
+
+func dialAuth(t *testing.T, addr string) *YYConnect {
+	conn, err := Dial("tcp", addr)
+	assert.Nil(t, err)
+	conn.SetTimeout(5*time.Second, 5*time.Second)
+	return conn
+}
+
+func expectClosed(t *testing.T, closed chan error, reason error) {
+	select {
+	case err := <-closed:
+		assert.Equal(t, reason, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestAuthLogin(t *testing.T) {
+	server, addr, _ := startAuthServer(t, AuthConfig{})
+	defer stopServer(server)
+	conn := dialAuth(t, addr)
+	defer conn.Close()
+	reg := newTestRegister()
+
+	// 认证前的消息被丢弃
+	assert.Nil(t, conn.Send(&PTest{Str: "before"}))
+	assert.Nil(t, conn.Send(&PLogin{UID: 7, Token: "secret"}))
+	msg, err := conn.Recv(reg)
+	assert.Nil(t, err)
+	assert.Equal(t, &PTestRes{Int: 100}, msg)
+
+	assert.Nil(t, conn.Send(&PTest{Str: "after"}))
+	msg, err = conn.Recv(reg)
+	assert.Nil(t, err)
+	assert.Equal(t, &PTestRes{Int: 7, Str: "after"}, msg)
+
+	// Login不能再注册MessageHandle
+	assert.Panics(t, func() {
+		s := NewYYServer()
+		s.SetAuth(AuthConfig{Login: new(PLogin), Authenticator: testAuthenticator})
+		s.RegisterHandle(new(PLogin), nil)
+	})
+}
+
+func TestAuthSharedConn(t *testing.T) {
+	for _, engine := range []Engine{EngineGoroutine, EngineEventLoop} {
+		server := NewYYServer()
+		assert.Nil(t, server.SetEngine(engine, 1))
+		started, release := make(chan struct{}), make(chan struct{})
+		assert.Nil(t, server.SetAuth(AuthConfig{
+			Login: new(PLogin),
+			Authenticator: AuthenticatorFunc(func(c *YYConnect, msg packet.Marshallable) (*Principal, error) {
+				started <- struct{}{}
+				<-release
+				return testAuthenticator(c, msg)
+			}),
+			Allow: []uint32{new(PTest).GetURI()},
+		}))
+		server.RegisterHandle(new(PTest), func(c *YYConnect, msg packet.Marshallable) bool {
+			// 已认证时回复UID，否则回复请求的Int
+			req := msg.(*PTest)
+			if p := c.Principal(); p != nil {
+				req.Int = uint32(p.UID)
+			}
+			c.Send(&PTestRes{req.Int, req.Str})
+			return true
+		})
+		assert.Nil(t, server.Start("127.0.0.1:0"))
+		addr := server.GetListenAddr().String()
+		other := dialAuth(t, addr)
+		assertEcho(t, other, "")
+		conn := dialAuth(t, addr)
+		reg := newTestRegister()
+
+		// 认证未完成时其他连接不受影响，之后的消息在认证完成后处理
+		assert.Nil(t, conn.Send(&PLogin{UID: 7, Token: "secret"}))
+		assert.Nil(t, conn.Send(&PTest{Str: "after"}))
+		<-started
+		assertEcho(t, other, "")
+		close(release)
+		msg, err := conn.Recv(reg)
+		assert.Nil(t, err)
+		assert.Equal(t, &PTestRes{Int: 100}, msg)
+		msg, err = conn.Recv(reg)
+		assert.Nil(t, err)
+		assert.Equal(t, &PTestRes{Int: 7, Str: "after"}, msg)
+
+		conn.Close()
+		other.Close()
+		stopServer(server)
+	}
+}
+
+func TestAuthFailed(t *testing.T) {
+	server, addr, closed := startAuthServer(t, AuthConfig{MaxFailures: 1})
+	defer stopServer(server)
+	conn := dialAuth(t, addr)
+	defer conn.Close()
+
+	assert.Nil(t, conn.Send(&PLogin{Token: "bad"}))
+	assert.Nil(t, conn.Send(&PLogin{Token: "bad"}))
+	expectClosed(t, closed, ErrAuthFailed)
+}
+
+func TestAuthDeadline(t *testing.T) {
+	server, addr, closed := startAuthServer(t, AuthConfig{Deadline: 50 * time.Millisecond})
+	defer stopServer(server)
+	conn := dialAuth(t, addr)
+	defer conn.Close()
+	expectClosed(t, closed, ErrAuthTimeout)
+
+	// 期限内完成认证不会关闭
+	conn = dialAuth(t, addr)
+	defer conn.Close()
+	assert.Nil(t, conn.Send(&PLogin{UID: 1, Token: "secret"}))
+	_, err := conn.Recv(newTestRegister())
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	// UID为1，回复与assertEcho相同
+	assertEcho(t, conn, "alive")
+}
+
+func TestAuthAllow(t *testing.T) {
+	server, addr, closed := startAuthServer(t, AuthConfig{Allow: []uint32{1}, CloseUnauthenticated: true})
+	defer stopServer(server)
+	conn := dialAuth(t, addr)
+	defer conn.Close()
+
+	// 白名单内的消息在认证前处理
+	assert.Nil(t, conn.Send(&PTest{Str: "allow"}))
+	msg, err := conn.Recv(newTestRegister())
+	assert.Nil(t, err)
+	assert.Equal(t, &PTestRes{Str: "allow"}, msg)
+
+	assert.Nil(t, conn.Send(&PBig{}))
+	expectClosed(t, closed, ErrUnauthenticated)
+}
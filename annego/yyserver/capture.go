@@ -0,0 +1,238 @@
+package yyserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"goBase/annego/packet"
+)
+
+// CaptureDirection 抓包记录的方向
+type CaptureDirection uint8
+
+const (
+	CaptureIn  CaptureDirection = 1 // 从对端接收
+	CaptureOut CaptureDirection = 2 // 发送给对端
+)
+
+func (d CaptureDirection) String() string {
+	switch d {
+	case CaptureIn:
+		return "in"
+	case CaptureOut:
+		return "out"
+	}
+	return fmt.Sprintf("CaptureDirection(%d)", uint8(d))
+}
+
+// captureMagic 抓包文件头
+const captureMagic = "YYCAP001"
+
+// captureRecordHeader 记录头长度: Time 8 + ConnID 8 + Direction 1 + Length 4
+const captureRecordHeader = 21
+
+// ErrCaptureFormat 抓包文件格式错误
+var ErrCaptureFormat = errors.New("yyserver: invalid capture file")
+
+// CaptureRecord 抓包文件中的一条记录，Frame为完整的YY数据帧
+type CaptureRecord struct {
+	Time      time.Time
+	ConnID    uint64
+	Direction CaptureDirection
+	Frame     []byte
+}
+
+// Recorder 将连接收发的数据帧写入抓包文件，文件超过MaxSize后滚动
+// 滚动时path重命名为path.1，原有的path.N重命名为path.N+1，最多保留MaxFiles个历史文件
+type Recorder struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mut    sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	err    error
+}
+
+// NewRecorder 创建抓包文件，maxSize为0时不滚动
+func NewRecorder(path string, maxSize int64, maxFiles int) (*Recorder, error) {
+	r := &Recorder{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Recorder) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	r.file = file
+	r.writer = bufio.NewWriter(file)
+	r.size = int64(len(captureMagic))
+	_, err = r.writer.WriteString(captureMagic)
+	return err
+}
+
+// rotate 调用时需持有mut
+func (r *Recorder) rotate() error {
+	if err := r.writer.Flush(); err != nil {
+		return err
+	}
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	if r.maxFiles > 0 {
+		for i := r.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	}
+	return r.open()
+}
+
+// Record 写入一条记录，写入失败后不再记录，错误由Close返回
+func (r *Recorder) Record(connID uint64, direction CaptureDirection, frame []byte) {
+	var head [captureRecordHeader]byte
+	binary.BigEndian.PutUint64(head[0:8], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint64(head[8:16], connID)
+	head[16] = byte(direction)
+	binary.BigEndian.PutUint32(head[17:21], uint32(len(frame)))
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.err != nil {
+		return
+	}
+	if r.maxSize > 0 && r.size+int64(len(head)+len(frame)) > r.maxSize && r.size > int64(len(captureMagic)) {
+		if r.err = r.rotate(); r.err != nil {
+			return
+		}
+	}
+	if _, r.err = r.writer.Write(head[:]); r.err != nil {
+		return
+	}
+	_, r.err = r.writer.Write(frame)
+	r.size += int64(len(head) + len(frame))
+}
+
+// Flush 将缓冲的记录写入文件
+func (r *Recorder) Flush() error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	return r.writer.Flush()
+}
+
+// Close 写入缓冲的记录并关闭文件
+func (r *Recorder) Close() error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	err := r.writer.Flush()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	if r.err != nil {
+		return r.err
+	}
+	r.err = ErrConnClosed
+	return err
+}
+
+// CaptureReader 读取抓包文件
+type CaptureReader struct {
+	reader *bufio.Reader
+	header bool
+}
+
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	return &CaptureReader{reader: bufio.NewReader(r)}
+}
+
+// Next 读取下一条记录，文件结束返回io.EOF
+func (r *CaptureReader) Next() (*CaptureRecord, error) {
+	if !r.header {
+		magic := make([]byte, len(captureMagic))
+		if _, err := io.ReadFull(r.reader, magic); err != nil || string(magic) != captureMagic {
+			return nil, ErrCaptureFormat
+		}
+		r.header = true
+	}
+
+	var head [captureRecordHeader]byte
+	if _, err := io.ReadFull(r.reader, head[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrCaptureFormat
+		}
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(head[17:21])
+	if length < packet.HeaderLength || length > packet.MaxPacketLength {
+		return nil, ErrCaptureFormat
+	}
+	record := &CaptureRecord{
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(head[0:8]))),
+		ConnID:    binary.BigEndian.Uint64(head[8:16]),
+		Direction: CaptureDirection(head[16]),
+		Frame:     make([]byte, length),
+	}
+	if _, err := io.ReadFull(r.reader, record.Frame); err != nil {
+		return nil, ErrCaptureFormat
+	}
+	return record, nil
+}
+
+// ReadCaptureFile 读取抓包文件中的全部记录
+func ReadCaptureFile(path string) ([]*CaptureRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := NewCaptureReader(file)
+	records := make([]*CaptureRecord, 0)
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+// SetRecorder 记录连接收发的所有数据帧，包括心跳，应该在首次收发前调用
+func (c *YYConnect) SetRecorder(recorder *Recorder) {
+	c.recorder = recorder
+}
+
+func (c *YYConnect) record(direction CaptureDirection, frame []byte) {
+	if c.recorder != nil {
+		c.recorder.Record(c.id, direction, frame)
+	}
+}
+
+// SetRecorder 记录所有连接收发的数据帧，应该在程序启动时调用
+// recorder由调用者关闭
+func (self *YYServer) SetRecorder(recorder *Recorder) {
+	if self.running {
+		panic("YYServer is runing")
+	}
+	self.recorder = recorder
+}
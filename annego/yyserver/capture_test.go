@@ -0,0 +1,115 @@
+package yyserver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+)
+
+func TestRecorderRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yycap")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.yycap")
+
+	frame := packet.GetMarshalPack(&PTest{1, "abc"}).Bytes()
+	recordSize := int64(captureRecordHeader + len(frame))
+	// 每个文件最多保存2条记录
+	recorder, err := NewRecorder(path, int64(len(captureMagic))+2*recordSize, 2)
+	assert.Nil(t, err)
+	for i := 0; i < 7; i++ {
+		recorder.Record(uint64(i), CaptureIn, frame)
+	}
+	assert.Nil(t, recorder.Close())
+
+	counts := map[string]int{"": 1, ".1": 2, ".2": 2}
+	for suffix, count := range counts {
+		records, err := ReadCaptureFile(path + suffix)
+		assert.Nil(t, err)
+		assert.Len(t, records, count, suffix)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	records, _ := ReadCaptureFile(path)
+	assert.Equal(t, uint64(6), records[0].ConnID)
+	assert.Equal(t, CaptureIn, records[0].Direction)
+	assert.Equal(t, frame, records[0].Frame)
+	assert.WithinDuration(t, time.Now(), records[0].Time, time.Minute)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("bad"), 0644))
+	_, err = ReadCaptureFile(path)
+	assert.Equal(t, ErrCaptureFormat, err)
+}
+
+func TestCaptureAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yycap")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.yycap")
+
+	recorder, err := NewRecorder(path, 0, 0)
+	assert.Nil(t, err)
+	server := NewYYServer()
+	server.SetRecorder(recorder)
+	addr := startEchoServer(t, server)
+
+	for i := 0; i < 2; i++ {
+		conn, err := Dial("tcp", addr)
+		assert.Nil(t, err)
+		assertEcho(t, conn, "first")
+		assertEcho(t, conn, "second")
+		conn.Close()
+	}
+	assert.Eventually(t, func() bool {
+		return server.Metrics().Snapshot().Closed == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, recorder.Close())
+
+	records, err := ReadCaptureFile(path)
+	assert.Nil(t, err)
+	assert.Len(t, records, 8)
+	sessions := groupSessions(records)
+	assert.Len(t, sessions, 2)
+	for _, sess := range sessions {
+		assert.Len(t, sess.in, 2)
+		assert.Len(t, sess.out, 2)
+		msg, _, err := newTestRegister().UnmarshalBytes(sess.out[1])
+		assert.Nil(t, err)
+		assert.Equal(t, &PTestRes{1, "second"}, msg)
+	}
+
+	replayer := &Replayer{Network: "tcp", Address: addr, Speed: 10, Concurrency: 2, Timeout: time.Second}
+	result := replayer.Replay(context.Background(), records)
+	assert.Equal(t, 2, result.Sessions)
+	assert.Equal(t, 4, result.Sent)
+	assert.Equal(t, 4, result.Received)
+	assert.Empty(t, result.Errors)
+	assert.Empty(t, result.Diffs)
+
+	// 回复内容变化的服务
+	changed := NewYYServer()
+	changed.RegisterHandle(new(PTest), func(c *YYConnect, msg packet.Marshallable) bool {
+		req := msg.(*PTest)
+		if req.Str == "second" {
+			return false
+		}
+		c.Send(&PTestRes{req.Int + 1, req.Str})
+		return true
+	})
+	assert.Nil(t, changed.Start("127.0.0.1:0"))
+	replayer.Address = changed.GetListenAddr().String()
+	result = replayer.Replay(context.Background(), records)
+	assert.Equal(t, 2, result.Received)
+	assert.Len(t, result.Diffs, 4)
+	assert.NotNil(t, result.Diffs[0].Actual)
+	assert.Nil(t, result.Diffs[1].Actual)
+	assert.Contains(t, result.Diffs[0].String(), "expected uri 2")
+}
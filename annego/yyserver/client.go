@@ -0,0 +1,345 @@
+package yyserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"goBase/annego/logger"
+	"goBase/annego/packet"
+)
+
+var (
+	// ErrNotConnected Client未连接且PendingPolicy为PendingFail
+	ErrNotConnected = errors.New("yyserver: client not connected")
+	// ErrClientClosed Client已经关闭
+	ErrClientClosed = errors.New("yyserver: client closed")
+)
+
+// ClientState Client的连接状态
+type ClientState int
+
+const (
+	StateDisconnected ClientState = iota
+	StateConnecting
+	StateConnected
+	StateClosed
+)
+
+func (s ClientState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ClientState(%d)", int(s))
+}
+
+// PendingPolicy 未连接时Send的处理方式
+type PendingPolicy int
+
+const (
+	// PendingBuffer 缓存消息，连接建立并执行OnConnected后按顺序发送，缓存满时返回ErrSendQueueFull
+	PendingBuffer PendingPolicy = iota
+	// PendingFail 立即返回ErrNotConnected
+	PendingFail
+)
+
+// DefaultMaxPending Client默认的最大缓存消息数
+const DefaultMaxPending = 1024
+
+// Client 自动重连的YY客户端，连接断开后按指数退避重连
+// 导出的字段为配置，应该在Start之前设置
+type Client struct {
+	Network string
+	Address string
+	// Target 不为nil时每次连接前调用以选择地址，优先于Address，可以使用s2s.S2SPool.Target
+	Target func() (string, error)
+	// Dialer 建立连接使用的配置，为nil时使用默认配置
+	Dialer *Dialer
+	// Register 解析收到的消息，为nil时使用packet.DefaultYYRegister
+	Register *packet.YYRegister
+
+	// MinBackoff 第一次重连的等待时间，默认为100ms，之后每次加倍直到MaxBackoff
+	MinBackoff time.Duration
+	// MaxBackoff 重连等待时间上限，默认为30s
+	MaxBackoff time.Duration
+	// Jitter 重连等待时间的随机浮动比例，取值0到1，为0时使用0.2，小于0时不浮动
+	Jitter float64
+
+	// Pending 未连接时Send的处理方式
+	Pending PendingPolicy
+	// MaxPending PendingBuffer缓存的最大消息数，默认为DefaultMaxPending
+	MaxPending int
+
+	// OnConnected 连接建立后、缓存的消息发送前调用，用于登录、订阅等，可以直接在conn上Send和Recv
+	// 返回错误时关闭连接并重连
+	OnConnected func(conn *YYConnect) error
+	// OnMessage 在Client的goroutine中处理收到的消息
+	OnMessage func(c *Client, msg packet.Marshallable)
+	// OnStateChange 连接状态变化时调用，err为断开或连接失败的原因
+	OnStateChange func(old, new ClientState, err error)
+
+	mut     sync.Mutex
+	state   ClientState
+	conn    *YYConnect
+	pending [][]byte
+	started bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// Start 在新的goroutine中连接并在断开后自动重连，Start立即返回
+func (c *Client) Start() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.started {
+		panic("yyserver: Client started again")
+	}
+	c.started = true
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.done = make(chan struct{})
+	go c.run()
+}
+
+// State 返回当前连接状态
+func (c *Client) State() ClientState {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.state
+}
+
+// Conn 返回当前的连接，未连接时返回nil
+func (c *Client) Conn() *YYConnect {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.conn
+}
+
+// Send 已连接时同步发送，未连接时按Pending处理
+// 发送失败时关闭当前连接触发重连，失败的消息不会重发
+func (c *Client) Send(msg packet.Marshallable) error {
+	frame := packet.GetMarshalPack(msg).Bytes()
+
+	c.mut.Lock()
+	switch {
+	case c.state == StateClosed:
+		c.mut.Unlock()
+		return ErrClientClosed
+	case c.conn != nil:
+		conn := c.conn
+		c.mut.Unlock()
+		if err := conn.writeFrame(frame); err != nil {
+			conn.Close()
+			return err
+		}
+		return nil
+	case c.Pending == PendingFail:
+		c.mut.Unlock()
+		return ErrNotConnected
+	}
+	defer c.mut.Unlock()
+	maxPending := c.MaxPending
+	if maxPending <= 0 {
+		maxPending = DefaultMaxPending
+	}
+	if len(c.pending) >= maxPending {
+		return ErrSendQueueFull
+	}
+	c.pending = append(c.pending, frame)
+	return nil
+}
+
+// Close 关闭连接并停止重连，缓存的消息被丢弃
+func (c *Client) Close() error {
+	c.mut.Lock()
+	if c.state == StateClosed {
+		c.mut.Unlock()
+		return nil
+	}
+	conn := c.conn
+	c.pending = nil
+	started := c.started
+	c.mut.Unlock()
+
+	if started {
+		c.cancel()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	if started {
+		<-c.done
+	}
+	c.setState(StateClosed, nil)
+	return nil
+}
+
+// setState 修改状态并调用OnStateChange，已关闭后不再修改
+func (c *Client) setState(state ClientState, err error) {
+	c.mut.Lock()
+	old := c.state
+	if old == state || old == StateClosed {
+		c.mut.Unlock()
+		return
+	}
+	c.state = state
+	c.mut.Unlock()
+
+	if c.OnStateChange != nil {
+		c.OnStateChange(old, state, err)
+	}
+}
+
+func (c *Client) closed() bool {
+	select {
+	case <-c.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) run() {
+	defer close(c.done)
+	attempt := 0
+	for !c.closed() {
+		c.setState(StateConnecting, nil)
+		conn, err := c.connect()
+		if err != nil {
+			logger.Info("client connect error %v", err)
+			c.setState(StateDisconnected, err)
+			if !c.wait(c.backoff(attempt)) {
+				return
+			}
+			attempt++
+			continue
+		}
+		attempt = 0
+
+		err = c.serve(conn)
+		c.setState(StateDisconnected, err)
+		if !c.wait(c.backoff(0)) {
+			return
+		}
+	}
+}
+
+// connect 建立连接、执行OnConnected并发送缓存的消息，成功后状态为StateConnected
+func (c *Client) connect() (*YYConnect, error) {
+	address := c.Address
+	if c.Target != nil {
+		var err error
+		if address, err = c.Target(); err != nil {
+			return nil, err
+		}
+	}
+	dialer := c.Dialer
+	if dialer == nil {
+		dialer = &Dialer{}
+	}
+	network := c.Network
+	if network == "" {
+		network = "tcp"
+	}
+	conn, err := dialer.DialContext(c.ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.OnConnected != nil {
+		if err := c.OnConnected(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	// 持有锁发送缓存的消息，期间的Send排在缓存之后
+	c.mut.Lock()
+	for len(c.pending) > 0 {
+		if err := conn.writeFrame(c.pending[0]); err != nil {
+			c.mut.Unlock()
+			conn.Close()
+			return nil, err
+		}
+		c.pending = c.pending[1:]
+	}
+	if c.closed() {
+		c.mut.Unlock()
+		conn.Close()
+		return nil, ErrClientClosed
+	}
+	c.conn = conn
+	c.mut.Unlock()
+
+	c.setState(StateConnected, nil)
+	return conn, nil
+}
+
+// serve 读取消息直到连接断开
+func (c *Client) serve(conn *YYConnect) error {
+	register := c.Register
+	if register == nil {
+		register = packet.DefaultYYRegister
+	}
+	var err error
+	for {
+		var msg packet.Marshallable
+		if msg, err = conn.Recv(register); err != nil {
+			break
+		}
+		if c.OnMessage != nil {
+			c.OnMessage(c, msg)
+		}
+	}
+
+	c.mut.Lock()
+	c.conn = nil
+	c.mut.Unlock()
+	conn.Close()
+	return err
+}
+
+// backoff 第attempt次重连的等待时间
+func (c *Client) backoff(attempt int) time.Duration {
+	min, max, jitter := c.MinBackoff, c.MaxBackoff, c.Jitter
+	if min <= 0 {
+		min = 100 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	if jitter == 0 {
+		jitter = 0.2
+	} else if jitter < 0 {
+		jitter = 0
+	}
+	d := min
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return time.Duration(float64(d) * (1 + jitter*(2*rand.Float64()-1)))
+}
+
+func (c *Client) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
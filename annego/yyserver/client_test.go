@@ -0,0 +1,125 @@
+package yyserver
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+)
+
+// stopServer 关闭监听并断开所有连接
+func stopServer(server *YYServer) {
+	server.listener.Close()
+	server.Range(func(conn *YYConnect) bool {
+		conn.Close()
+		return true
+	})
+}
+
+func TestClientReconnect(t *testing.T) {
+	var mut sync.Mutex
+	address := startEchoServer(t, NewYYServer())
+	logins := 0
+	states := make([]ClientState, 0)
+	received := make(chan *PTestRes, 16)
+
+	client := &Client{
+		Target: func() (string, error) {
+			mut.Lock()
+			defer mut.Unlock()
+			return address, nil
+		},
+		Register:   newTestRegister(),
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+		OnConnected: func(conn *YYConnect) error {
+			// 登录完成前不发送缓存的消息
+			conn.Send(&PTest{0, "login"})
+			msg, err := conn.Recv(newTestRegister())
+			if err != nil {
+				return err
+			}
+			if msg.(*PTestRes).Str != "login" {
+				return errors.New("login fail")
+			}
+			mut.Lock()
+			logins++
+			mut.Unlock()
+			return nil
+		},
+		OnMessage: func(c *Client, msg packet.Marshallable) {
+			received <- msg.(*PTestRes)
+		},
+		OnStateChange: func(old, new ClientState, err error) {
+			mut.Lock()
+			states = append(states, new)
+			mut.Unlock()
+		},
+	}
+	// 未连接时缓存
+	assert.Nil(t, client.Send(&PTest{1, "buffered"}))
+	client.Start()
+	defer client.Close()
+
+	assert.Equal(t, &PTestRes{1, "buffered"}, <-received)
+	assert.Equal(t, StateConnected, client.State())
+	old := client.Conn()
+
+	// 服务重启到新的地址
+	mut.Lock()
+	server := NewYYServer()
+	address = startEchoServer(t, server)
+	mut.Unlock()
+	old.Close()
+	assert.Eventually(t, func() bool {
+		conn := client.Conn()
+		return conn != nil && conn != old
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, client.Send(&PTest{2, "again"}))
+	assert.Equal(t, &PTestRes{2, "again"}, <-received)
+
+	// 服务不可用时持续重连
+	stopServer(server)
+	assert.Eventually(t, func() bool {
+		return client.State() != StateConnected
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	mut.Lock()
+	assert.Equal(t, 2, logins)
+	assert.Equal(t, []ClientState{StateConnecting, StateConnected, StateDisconnected,
+		StateConnecting, StateConnected, StateDisconnected}, states[:6])
+	mut.Unlock()
+
+	client.Close()
+	assert.Equal(t, StateClosed, client.State())
+	assert.Equal(t, ErrClientClosed, client.Send(&PTest{3, "closed"}))
+}
+
+func TestClientPendingPolicy(t *testing.T) {
+	client := &Client{Pending: PendingFail}
+	assert.Equal(t, ErrNotConnected, client.Send(&PTest{1, "fail"}))
+
+	client = &Client{MaxPending: 2}
+	assert.Nil(t, client.Send(&PTest{1, "a"}))
+	assert.Nil(t, client.Send(&PTest{2, "b"}))
+	assert.Equal(t, ErrSendQueueFull, client.Send(&PTest{3, "c"}))
+	client.Close()
+	assert.Equal(t, ErrClientClosed, client.Send(&PTest{4, "d"}))
+}
+
+func TestClientBackoff(t *testing.T) {
+	client := &Client{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: -1}
+	assert.Equal(t, 100*time.Millisecond, client.backoff(0))
+	assert.Equal(t, 400*time.Millisecond, client.backoff(2))
+	assert.Equal(t, time.Second, client.backoff(10))
+
+	client.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := client.backoff(1)
+		assert.True(t, d >= 100*time.Millisecond && d <= 300*time.Millisecond, d)
+	}
+}
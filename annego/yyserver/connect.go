@@ -2,33 +2,99 @@ package yyserver
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"goBase/annego/packet"
 )
 
+// 读缓冲区的默认配置
+const (
+	// DefaultReadSize 单次从连接读取的默认大小
+	DefaultReadSize = 4096 // 4KB
+	// DefaultMaxReadBuffer 默认的最大读缓冲区，限制了可以接收的数据帧长度
+	DefaultMaxReadBuffer = packet.MaxPacketLength
+)
+
+// shrinkRatio 缓冲区读空后超过readsize的shrinkRatio倍时释放，下次读取重新分配
+const shrinkRatio = 4
+
+// probeSize 池化的缓冲区读空后，先用连接自带的小缓冲区等待数据
+const probeSize = 128
+
+// ReadBufferConfig 连接读缓冲区的配置，零值字段使用默认值
+// UDP连接每次读取一个完整的数据报，忽略ReadSize和Pooled
+type ReadBufferConfig struct {
+	// ReadSize 单次从连接读取的大小，也是缓冲区的初始大小，默认DefaultReadSize
+	ReadSize int
+	// MaxSize 缓冲区最大长度，超过该长度的数据帧关闭连接，默认DefaultMaxReadBuffer
+	MaxSize int
+	// Pooled 为true时缓冲区读空后归还共享的缓冲池，空闲连接不占用读缓冲区
+	Pooled bool
+}
+
+// readBufferPools 按缓冲区大小划分的共享缓冲池，size -> *sync.Pool
+var readBufferPools sync.Map
+
+func getReadBuffer(size int) []byte {
+	if p, ok := readBufferPools.Load(size); ok {
+		if buf, ok := p.(*sync.Pool).Get().(*[]byte); ok {
+			return *buf
+		}
+	}
+	return make([]byte, size)
+}
+
+func putReadBuffer(buf []byte) {
+	p, _ := readBufferPools.LoadOrStore(len(buf), &sync.Pool{})
+	p.(*sync.Pool).Put(&buf)
+}
+
 type readBuffer struct {
 	buf      []byte
 	start    int
 	end      int
-	readsize int // 单次读取大小
-	maxsize  int // 最大缓冲区大小
+	readsize int  // 单次读取大小
+	maxsize  int  // 最大缓冲区大小
+	pooled   bool // 读空后归还缓冲池
+	datagram bool // 每次读取一个完整的数据报，readsize固定且不使用缓冲池
+	probe    []byte
 }
 
 func newReadBuffer() *readBuffer {
 	r := readBuffer{}
 	r.start = 0
 	r.end = 0
-	r.readsize = 4096       // 4KB
-	r.maxsize = 1024 * 1024 // 1MB
+	r.readsize = DefaultReadSize
+	r.maxsize = DefaultMaxReadBuffer
 	r.buf = make([]byte, r.readsize)
 	return &r
 }
 
+// setConfig 按配置修改缓冲区，零值字段保持不变
+func (b *readBuffer) setConfig(config ReadBufferConfig) {
+	if b.datagram {
+		config.ReadSize = 0
+		config.Pooled = false
+	}
+	if config.ReadSize > 0 {
+		b.SetReadsize(config.ReadSize)
+	}
+	if config.MaxSize > 0 {
+		b.SetMaxSize(config.MaxSize)
+	}
+	b.pooled = config.Pooled
+	if b.pooled && b.Len() == 0 {
+		b.release()
+	}
+}
+
 func (b *readBuffer) SetReadsize(s int) {
 	b.readsize = s
 }
@@ -41,13 +107,21 @@ func (b *readBuffer) Len() int {
 	return b.end - b.start
 }
 
+// Cap 返回当前占用的缓冲区大小
+func (b *readBuffer) Cap() int {
+	return len(b.buf)
+}
+
 // ReadFrom 从IO中读取数据，返回成功读取字节数和error
 func (b *readBuffer) ReadIO(conn io.Reader) (int, error) {
-	var err error
-	if err = b.grow(); err != nil {
+	if b.pooled && b.Len() == 0 {
+		return b.readProbe(conn)
+	}
+	size, err := b.grow()
+	if err != nil {
 		return 0, err
 	}
-	n, err := conn.Read(b.buf[b.end : b.end+b.readsize])
+	n, err := conn.Read(b.buf[b.end : b.end+size])
 	if err != nil {
 		return n, err
 	}
@@ -55,20 +129,62 @@ func (b *readBuffer) ReadIO(conn io.Reader) (int, error) {
 	return n, nil
 }
 
+// readProbe 缓冲区为空时归还缓冲池，用小缓冲区等待数据，收到数据后再取出缓冲区
+func (b *readBuffer) readProbe(conn io.Reader) (int, error) {
+	b.release()
+	if b.probe == nil {
+		size := probeSize
+		if size > b.readsize {
+			size = b.readsize
+		}
+		if size > b.maxsize {
+			size = b.maxsize
+		}
+		b.probe = make([]byte, size)
+	}
+	n, err := conn.Read(b.probe)
+	if n == 0 || err != nil {
+		return n, err
+	}
+	if _, err := b.grow(); err != nil {
+		return 0, err
+	}
+	b.end += copy(b.buf[b.end:], b.probe[:n])
+	return n, nil
+}
+
 func (b *readBuffer) Seek() []byte {
 	return b.buf[b.start:b.end]
 }
 
 // HasRead 设置已读取长度，必须小于等于buffer.Len()
+// 读空后超过readsize的shrinkRatio倍的缓冲区被释放，避免一次大数据帧长期占用内存
 func (b *readBuffer) HasRead(l int) {
 	if l > b.Len() {
 		panic(fmt.Sprintf("readBuffer HasRead %d > %d", l, b.Len()))
 	}
 	b.start += l
+	if b.start == b.end && len(b.buf) > b.readsize*shrinkRatio {
+		b.buf = nil
+		b.start, b.end = 0, 0
+	}
+}
+
+// release 缓冲区为空时释放，readsize大小的缓冲区归还缓冲池
+func (b *readBuffer) release() {
+	if b.buf == nil || b.Len() > 0 {
+		return
+	}
+	if len(b.buf) == b.readsize {
+		putReadBuffer(b.buf)
+	}
+	b.buf = nil
+	b.start, b.end = 0, 0
 }
 
-// 增长缓冲区长度，保证至少有readsize的可写空间
-func (b *readBuffer) grow() error {
+// 增长缓冲区长度，返回本次可以读取的大小，最多为readsize
+// 已满maxsize时返回错误
+func (b *readBuffer) grow() (int, error) {
 	if b.start > 0 {
 		if b.end > b.start {
 			copy(b.buf, b.buf[b.start:b.end])
@@ -77,23 +193,51 @@ func (b *readBuffer) grow() error {
 		b.start = 0
 	}
 
-	if b.end+b.readsize > b.maxsize {
-		return fmt.Errorf("buffer reach max size: %d", b.maxsize)
+	size := b.readsize
+	if b.end+size > b.maxsize {
+		size = b.maxsize - b.end
 	}
-	if b.end+b.readsize > len(b.buf) {
-		newbuf := make([]byte, len(b.buf)*2)
+	if size <= 0 {
+		return 0, fmt.Errorf("buffer reach max size: %d", b.maxsize)
+	}
+	if b.end+size > len(b.buf) {
+		if b.buf == nil && b.pooled && size == b.readsize {
+			b.buf = getReadBuffer(b.readsize)
+			return size, nil
+		}
+		newsize := len(b.buf) * 2
+		if newsize < b.readsize {
+			newsize = b.readsize
+		}
+		for b.end+size > newsize {
+			newsize *= 2
+		}
+		if newsize > b.maxsize {
+			newsize = b.maxsize
+		}
+		newbuf := make([]byte, newsize)
 		copy(newbuf, b.buf[:b.end])
 		b.buf = newbuf
 	}
-	return nil
+	return size, nil
 }
 
+// ErrConnClosed 连接已经关闭
+var ErrConnClosed = errors.New("yyserver: connection closed")
+
+// errRecvUnsupported 事件循环中的连接由事件循环读取
+var errRecvUnsupported = errors.New("yyserver: Recv unsupported on event loop connection")
+
+// connIDSeq 进程内唯一的连接ID
+var connIDSeq uint64
+
 // YYConnect 单个YY协议的连接，可以用来发送接收YY协议
 // 所有成员函数并发安全
 type YYConnect struct {
 	// UserData 可以用来保存任意的用户数据
 	UserData interface{}
 
+	id           uint64
 	conn         net.Conn
 	readMut      sync.Mutex
 	writeMut     sync.Mutex
@@ -101,20 +245,64 @@ type YYConnect struct {
 	writer       *bufio.Writer
 	readTimeout  time.Duration
 	writeTimeout time.Duration
+	idleTimeout  int64 // time.Duration，原子操作
+	heartbeat    Heartbeat
+	fragment     *fragmenter
+	mux          *muxSession        // 协商了流多路复用的连接
+	early        [][]byte           // 协商Mux期间收到的其他数据帧，之后的读取先返回
+	stream       *muxStream         // 不为nil时是mux上的一个流
+	maxFrame     int                // 大于0时限制发送的数据帧长度
+	capture      func([]byte) error // 不为nil时发送的数据帧交给capture，不写入conn
+	counters     connCounters
+	metrics      *Metrics // 所属服务的统计，客户端连接为nil
+	recorder     *Recorder
+	onClose      func() // 不为nil时在closeWith关闭conn之前调用
+	shared       bool   // 与其他连接共享读goroutine，处理消息时不能等待
+
+	principal    atomic.Value // *Principal
+	authFailures int32
+	authMut      sync.Mutex
+	authQueue    []authTask // 共享读goroutine的连接认证期间收到的消息
+	authRunning  bool       // 共享读goroutine的连接正在认证
+
+	limitMut sync.Mutex
+	limits   map[connLimitKey]*limitBucket // 按连接计数的限流令牌桶
+
+	proxyMut   sync.Mutex
+	proxyLinks map[int]*proxyLink // 按路由的后端连接，Sticky时断开的后端连接为nil
+
+	queueMut sync.Mutex
+	queue    *sendQueue
+
+	closeMut sync.Mutex
+	closed   chan struct{}
+	closeErr error
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	pending sync.WaitGroup // 工作goroutine中未处理完的消息
 }
 
 func NewYYConnect(conn net.Conn) *YYConnect {
 	return &YYConnect{
 		UserData:     nil,
+		id:           atomic.AddUint64(&connIDSeq, 1),
 		conn:         conn,
 		reader:       newReadBuffer(),
 		writer:       bufio.NewWriter(conn),
 		readTimeout:  0,
 		writeTimeout: 0,
+		closed:       make(chan struct{}),
 	}
 }
 
+// ID 返回进程内唯一的连接ID，连接生命周期内不变
+func (c *YYConnect) ID() uint64 {
+	return c.id
+}
+
 // SetTimeout 设置读写超时时间，只能在创建后设置一次
+// readTimeout为单次Recv的超时时间，需要按连接空闲时间判断超时请使用SetIdleTimeout
 func (c *YYConnect) SetTimeout(readTimeout, writeTimeout time.Duration) {
 	if c.readTimeout != 0 || c.writeTimeout != 0 {
 		panic("YYConnect: SetTimeout again")
@@ -123,72 +311,278 @@ func (c *YYConnect) SetTimeout(readTimeout, writeTimeout time.Duration) {
 	c.writeTimeout = writeTimeout
 }
 
-func (c *YYConnect) recvFromReader(register *packet.YYRegister) (packet.Marshallable, error) {
-	msg, readsize, err := register.UnmarshalBytes(c.reader.Seek())
-	if err != nil {
-		return nil, err
+// SetReadBuffer 设置读缓冲区，应该在首次Recv前调用
+func (c *YYConnect) SetReadBuffer(config ReadBufferConfig) {
+	if c.reader == nil {
+		return
 	}
-	c.reader.HasRead(readsize)
-	return msg, nil
+	c.readMut.Lock()
+	defer c.readMut.Unlock()
+	c.reader.setConfig(config)
 }
 
 // Recv 接收YY协议
 func (c *YYConnect) Recv(register *packet.YYRegister) (packet.Marshallable, error) {
+	msg, _, err := c.recv(register)
+	return msg, err
+}
+
+// recv 接收YY协议，同时返回用于统计的接收信息
+func (c *YYConnect) recv(register *packet.YYRegister) (packet.Marshallable, recvInfo, error) {
+	return c.recvWith(register, nil)
+}
+
+// recvWith 接收YY协议，intercept不为nil时数据帧先交给intercept，返回true表示已处理，继续读取下一个数据帧
+// 交给intercept的数据帧引用读缓冲区，intercept返回后不再有效
+func (c *YYConnect) recvWith(register *packet.YYRegister, intercept func([]byte) bool) (packet.Marshallable, recvInfo, error) {
+	if c.reader == nil {
+		return nil, recvInfo{}, errRecvUnsupported
+	}
 	c.readMut.Lock()
 	defer c.readMut.Unlock()
 
-	msg, err := c.recvFromReader(register)
-	if err == nil {
-		return msg, nil
-	} else if err != packet.ErrInputNotEnough {
-		return nil, err
+	frame, whole, err := c.readFrame()
+	for err == nil && intercept != nil && intercept(frame) {
+		frame, whole, err = c.readFrame()
+	}
+	if err != nil {
+		return nil, recvInfo{}, err
 	}
+	info := newRecvInfo(frame, time.Now())
+	if whole {
+		msg, err := unmarshalFrame(register, frame)
+		return msg, info, err
+	}
+	// 解包出的[]byte引用数据帧，复制后不受读缓冲区复用影响
+	frame = append([]byte(nil), frame...)
+	msg, _, err := register.UnmarshalBytes(frame)
+	return msg, info, err
+}
 
+// readFrame 读取一个完整的数据帧，调用时需持有readMut
+// 返回的数据引用读缓冲区，下次读取前有效；whole为true时是分片重组后的数据帧，不引用读缓冲区
+func (c *YYConnect) readFrame() (frame []byte, whole bool, err error) {
+	var deadline time.Time
 	if c.readTimeout != 0 {
-		err = c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
-		if err != nil {
-			return nil, err
-		}
+		deadline = time.Now().Add(c.readTimeout)
+	}
+	return c.readFrameBefore(deadline)
+}
+
+// readFrameBefore 同readFrame，deadline为本次读取的超时时间，为零值表示不限制
+func (c *YYConnect) readFrameBefore(deadline time.Time) (frame []byte, whole bool, err error) {
+	if len(c.early) > 0 {
+		frame := c.early[0]
+		c.early = c.early[1:]
+		return frame, true, nil
 	}
 
 	for {
-		if _, readerr := c.reader.ReadIO(c.conn); readerr != nil {
-			return nil, readerr
+		length, err := packet.FrameLength(c.reader.Seek())
+		if err == nil {
+			frame := c.reader.Seek()[:length]
+			c.reader.HasRead(length)
+			if c.handleHeartbeat(frame) {
+				c.recordIn(frame, false)
+				continue
+			}
+			if c.handleMux(frame) {
+				c.recordIn(frame, false)
+				continue
+			}
+			if c.isFragment(frame) {
+				full := c.reassemble(frame)
+				c.recordIn(frame, full != nil)
+				if full == nil {
+					continue
+				}
+				return full, true, nil
+			}
+			c.recordIn(frame, true)
+			return frame, false, nil
+		} else if err != packet.ErrInputNotEnough {
+			return nil, false, err
+		}
+		if err := checkFrameLength(c.reader.Seek(), c.reader.maxsize); err != nil {
+			return nil, false, err
 		}
 
-		msg, err = c.recvFromReader(register)
-		if err == packet.ErrInputNotEnough {
-			continue
+		idle, err := c.setReadDeadline(deadline)
+		if err != nil {
+			return nil, false, err
+		}
+		if _, err := c.reader.ReadIO(c.conn); err != nil {
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() && idle {
+				c.closeWith(ErrIdleTimeout)
+				return nil, false, ErrIdleTimeout
+			}
+			return nil, false, err
 		}
-		break
 	}
-	return msg, err
 }
 
-// Send 发送YY协议
+// checkFrameLength 数据帧长度超过max时返回错误，不必等到缓冲区读满
+func checkFrameLength(data []byte, max int) error {
+	if header, err := packet.PeekHeader(data); err == nil && int(header.Length) > max {
+		return fmt.Errorf("frame length %d exceeds read buffer max size %d", header.Length, max)
+	}
+	return nil
+}
+
+// setReadDeadline 设置本次读取的超时时间，返回是否由空闲超时决定
+func (c *YYConnect) setReadDeadline(deadline time.Time) (bool, error) {
+	idle := false
+	if timeout := c.IdleTimeout(); timeout > 0 {
+		idleDeadline := time.Now().Add(timeout)
+		if deadline.IsZero() || idleDeadline.Before(deadline) {
+			deadline = idleDeadline
+			idle = true
+		}
+	}
+	if deadline.IsZero() {
+		return false, nil
+	}
+	return idle, c.conn.SetReadDeadline(deadline)
+}
+
+// Send 发送YY协议，写入并Flush后返回
 func (c *YYConnect) Send(msg packet.Marshallable) error {
+	pack := packet.GetMarshalPack(msg)
+	return c.writeFrame(pack.Bytes())
+}
+
+// writeFrame 同步写入完整的数据帧
+func (c *YYConnect) writeFrame(data []byte) error {
+	if split, err := c.sendFragments(data, c.writeFrame); split {
+		return err
+	}
+	if err := c.checkFrame(data); err != nil {
+		return err
+	}
+	if c.capture != nil {
+		return c.capture(data)
+	}
 	c.writeMut.Lock()
 	defer c.writeMut.Unlock()
 
-	if c.writeTimeout != 0 {
-		err := c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
-		if err != nil {
-			return err
-		}
+	if err := c.setWriteDeadline(); err != nil {
+		return err
+	}
+	if err := c.write(data); err != nil {
+		return err
+	}
+	if err := c.flush(); err != nil {
+		return err
 	}
+	c.recordOut(data)
+	return nil
+}
 
-	pack := packet.GetMarshalPack(msg)
-	_, err := c.writer.Write(pack.Bytes())
-	if err != nil {
+// write 写入数据，没有写缓冲区时直接写入conn，调用时需持有writeMut
+func (c *YYConnect) write(data []byte) error {
+	if c.writer == nil {
+		_, err := c.conn.Write(data)
 		return err
 	}
+	_, err := c.writer.Write(data)
+	return err
+}
+
+// flush 调用时需持有writeMut
+func (c *YYConnect) flush() error {
+	if c.writer == nil {
+		return nil
+	}
 	return c.writer.Flush()
 }
 
+// checkFrame 检查数据帧是否超过连接允许的长度，超过的数据帧不写入连接
+func (c *YYConnect) checkFrame(data []byte) error {
+	if c.maxFrame > 0 && len(data) > c.maxFrame {
+		return ErrMessageTooLarge
+	}
+	return nil
+}
+
+// sendFrame 发送已打包的数据帧，设置了发送队列时异步发送
+func (c *YYConnect) sendFrame(data []byte) error {
+	c.queueMut.Lock()
+	q := c.queue
+	c.queueMut.Unlock()
+	if q != nil {
+		return c.enqueueFrame(data)
+	}
+	return c.writeFrame(data)
+}
+
+// setWriteDeadline 调用时需持有writeMut
+func (c *YYConnect) setWriteDeadline() error {
+	if c.writeTimeout != 0 {
+		return c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return nil
+}
+
+// Close 关闭连接，连接goroutine中CloseHandle收到io.ErrClosedPipe
 func (c *YYConnect) Close() error {
+	return c.closeWith(io.ErrClosedPipe)
+}
+
+// closeWith 关闭连接并记录关闭原因，只有第一次调用的原因生效
+func (c *YYConnect) closeWith(reason error) error {
+	c.closeMut.Lock()
+	select {
+	case <-c.closed:
+		c.closeMut.Unlock()
+		return nil
+	default:
+	}
+	c.closeErr = reason
+	close(c.closed)
+	cancel := c.cancel
+	c.closeMut.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	if c.fragment != nil {
+		c.fragment.close()
+	}
+	if c.mux != nil {
+		c.mux.close()
+	}
+	if c.onClose != nil {
+		c.onClose()
+	}
 	return c.conn.Close()
 }
 
+// Context 返回连接关闭时取消的context，首次调用时创建
+func (c *YYConnect) Context() context.Context {
+	c.closeMut.Lock()
+	defer c.closeMut.Unlock()
+	if c.ctx == nil {
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+		select {
+		case <-c.closed:
+			c.cancel()
+		default:
+		}
+	}
+	return c.ctx
+}
+
+// closeReason 返回连接是否通过closeWith关闭，以及关闭原因
+func (c *YYConnect) closeReason() (bool, error) {
+	c.closeMut.Lock()
+	defer c.closeMut.Unlock()
+	select {
+	case <-c.closed:
+		return true, c.closeErr
+	default:
+		return false, nil
+	}
+}
+
 func (c *YYConnect) LocalAddr() net.Addr {
 	return c.conn.LocalAddr()
 }
@@ -196,11 +590,3 @@ func (c *YYConnect) LocalAddr() net.Addr {
 func (c *YYConnect) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
-
-func Dial(network, address string) (*YYConnect, error) {
-	c, err := net.Dial(network, address)
-	if err != nil {
-		return nil, err
-	}
-	return NewYYConnect(c), nil
-}
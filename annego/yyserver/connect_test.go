@@ -3,8 +3,11 @@ package yyserver
 import (
 	"bytes"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
 )
 
 func TestBufferRead(t *testing.T) {
@@ -58,3 +61,118 @@ func TestBufferGrow(t *testing.T) {
 	assert.Equal(t, n3, total-n1-n2)
 	assert.Equal(t, buffer.Len(), int(total-1024))
 }
+
+func TestBufferGrowLargeReadsize(t *testing.T) {
+	buffer := newReadBuffer()
+	buffer.SetReadsize(64 * 1024)
+	reader := bytes.NewBuffer(make([]byte, 100*1024))
+
+	n, err := buffer.ReadIO(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, 64*1024, n)
+	assert.True(t, len(buffer.buf) >= 64*1024)
+}
+
+func TestBufferMaxSize(t *testing.T) {
+	buffer := newReadBuffer()
+	buffer.SetMaxSize(10000)
+	reader := bytes.NewBuffer(make([]byte, 20000))
+
+	total := 0
+	for total < 10000 {
+		n, err := buffer.ReadIO(reader)
+		assert.Nil(t, err)
+		total += n
+	}
+	// 恰好为maxsize的数据可以放入缓冲区
+	assert.Equal(t, 10000, buffer.Len())
+	assert.Equal(t, 10000, buffer.Cap())
+	_, err := buffer.ReadIO(reader)
+	assert.NotNil(t, err)
+}
+
+func TestBufferShrink(t *testing.T) {
+	buffer := newReadBuffer()
+	reader := bytes.NewBuffer(make([]byte, 100*1024))
+	for reader.Len() > 0 {
+		_, err := buffer.ReadIO(reader)
+		assert.Nil(t, err)
+	}
+	assert.True(t, buffer.Cap() >= 100*1024)
+
+	buffer.HasRead(buffer.Len() - 1)
+	assert.True(t, buffer.Cap() >= 100*1024)
+	buffer.HasRead(1)
+	assert.Equal(t, 0, buffer.Cap())
+
+	reader.WriteString("123")
+	n, err := buffer.ReadIO(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, buffer.readsize, buffer.Cap())
+}
+
+func TestBufferPooled(t *testing.T) {
+	buffer := newReadBuffer()
+	buffer.setConfig(ReadBufferConfig{ReadSize: 1024, Pooled: true})
+	assert.Equal(t, 0, buffer.Cap())
+
+	reader := bytes.NewBuffer(make([]byte, 1500))
+	n, err := buffer.ReadIO(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, probeSize, n)
+	assert.Equal(t, 1024, buffer.Cap())
+	n, err = buffer.ReadIO(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, 1024, n)
+
+	buffer.HasRead(1000)
+	n, err = buffer.ReadIO(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, 348, n)
+	buffer.HasRead(500)
+
+	// 读空后等待数据前归还缓冲池
+	_, err = buffer.ReadIO(reader)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, buffer.Cap())
+}
+
+func TestServerReadBuffer(t *testing.T) {
+	server := NewYYServer()
+	server.SetReadBuffer(ReadBufferConfig{MaxSize: 4 * 1024 * 1024, Pooled: true})
+	closed := make(chan error, 1)
+	server.RegisterCloseFunc(func(c *YYConnect, err error) {
+		closed <- err
+	})
+	server.RegisterHandle(new(PBig), func(c *YYConnect, msg packet.Marshallable) bool {
+		c.Send(msg)
+		return true
+	})
+	addr := startEchoServer(t, server)
+	defer stopServer(server)
+
+	conn, err := (&Dialer{ReadBuffer: ReadBufferConfig{Pooled: true}}).Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetTimeout(5*time.Second, 5*time.Second)
+	register := packet.NewYYRegister()
+	register.Register(new(PBig))
+
+	// 超过原来1MB限制的消息
+	big := &PBig{Data: bytes.Repeat([]byte{'a'}, 3*1024*1024)}
+	assert.Nil(t, conn.Send(big))
+	msg, err := conn.Recv(register)
+	assert.Nil(t, err)
+	assert.Equal(t, big, msg)
+	assert.Equal(t, 0, conn.reader.Cap())
+
+	// 服务端读到包头即关闭连接，发送可能失败
+	conn.Send(&PBig{Data: make([]byte, 5*1024*1024)})
+	select {
+	case err := <-closed:
+		assert.Contains(t, err.Error(), "exceeds read buffer max size")
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"goBase/annego/logger"
+	"goBase/annego/util"
 )
 
 // ConsoleHandle 接收的参数列表，已空格分割。返回命令执行结果
@@ -25,10 +26,19 @@ type Console struct {
 	commands map[string]consoleCommand
 	cmdList  *list.List
 	listener net.Listener
+	sockopt  util.SocketOptions
 }
 
 func NewConsole() *Console {
-	return &Console{make(map[string]consoleCommand), list.New(), nil}
+	return &Console{commands: make(map[string]consoleCommand), cmdList: list.New()}
+}
+
+// SetSocketOptions 设置Start和StartRange监听时的套接字选项，应该在Start前调用
+func (self *Console) SetSocketOptions(options util.SocketOptions) {
+	if self.listener != nil {
+		panic("Console is runing")
+	}
+	self.sockopt = options
 }
 
 func (self *Console) AddCommand(command string, help string, handle ConsoleHandle) {
@@ -54,24 +64,25 @@ func (self *Console) Start(addr string) error {
 		panic("Console is runing")
 	}
 
-	listener, err := net.Listen("tcp", addr)
+	listener, err := self.sockopt.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
-	self.AddCommand("help", "print all command", self.help)
+	self.Serve(listener)
+	return nil
+}
+
+// Serve 在listener上接受连接，Serve立即返回，listener关闭后停止接受
+func (self *Console) Serve(listener net.Listener) {
+	if self.listener != nil {
+		panic("Console is runing")
+	}
 
+	self.AddCommand("help", "print all command", self.help)
 	self.listener = listener
-	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err == nil {
-				go self.handleConnect(conn)
-			} else {
-				logger.Warning("accept %v error %v", addr, err)
-			}
-		}
-	}()
-	return nil
+	go acceptLoop(listener, func(conn net.Conn) {
+		go self.handleConnect(conn)
+	})
 }
 
 // StartRange 以此探测从addr开始的，trytime个端口
@@ -111,8 +122,10 @@ func (self *Console) GetListenPort() int {
 		return 0
 	}
 	addr := self.listener.Addr()
-	tcpaddr := addr.(*net.TCPAddr)
-	return tcpaddr.Port
+	if tcpaddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpaddr.Port
+	}
+	return 0
 }
 
 func (self *Console) handleConnect(conn net.Conn) {
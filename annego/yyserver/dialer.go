@@ -0,0 +1,159 @@
+package yyserver
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"goBase/annego/util"
+)
+
+// Dialer 建立YY连接的配置，零值与Dial相同
+// network为udp、udp4、udp6时每个YY包作为一个数据报发送，对应YYServer.ServeUDP
+type Dialer struct {
+	// Timeout 建立连接的超时时间，包含TLS握手，为0表示不超时
+	Timeout time.Duration
+
+	// DialContextFunc 建立底层连接的函数，为nil时按Socket建立连接
+	// 可以使用任意net.Conn，例如PipeListener.DialContext
+	DialContextFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// Socket 套接字选项，设置了DialContextFunc时不生效
+	Socket util.SocketOptions
+
+	// TLSConfig 不为nil时建立TLS连接，ServerName为空时使用address中的主机名
+	// 双向认证时设置Certificates或GetClientCertificate
+	TLSConfig *tls.Config
+
+	// Heartbeat 心跳协议，需要与服务端YYServer.SetHeartbeat一致
+	Heartbeat Heartbeat
+
+	// KeepAlive 大于0时按该间隔发送Heartbeat.PingURI
+	// 心跳回复在Recv中读取并丢弃，调用者需要持续调用Recv
+	KeepAlive time.Duration
+
+	// IdleTimeout 超过该时间未收到任何数据判定对端失效，Recv返回ErrIdleTimeout
+	// 为0且KeepAlive大于0时使用3倍KeepAlive
+	IdleTimeout time.Duration
+
+	// ReadBuffer 连接的读缓冲区，零值使用默认值
+	ReadBuffer ReadBufferConfig
+
+	// Fragment 大消息分片，需要与服务端YYServer.SetFragment一致，UDP连接不生效
+	Fragment FragmentConfig
+
+	// Mux 流多路复用，URI不为0时建立连接后与服务端协商，之后可以调用YYConnect.OpenStream
+	// 需要与服务端YYServer.SetMux一致，服务端未设置时Dial返回ErrMuxUnsupported，UDP连接不生效
+	Mux MuxConfig
+}
+
+// Dial 建立连接，并按配置启动心跳
+func (d *Dialer) Dial(network, address string) (*YYConnect, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext 建立连接，ctx用于取消建立连接和TLS握手，连接建立后不再生效
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (*YYConnect, error) {
+	if d.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	dial := d.DialContextFunc
+	if dial == nil {
+		dial = d.Socket.DialContext
+	}
+	c, err := dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if d.TLSConfig != nil {
+		if c, err = d.clientHandshake(ctx, c, address); err != nil {
+			return nil, err
+		}
+	}
+
+	var conn *YYConnect
+	if isDatagramNetwork(network) {
+		conn = newDatagramConnect(c)
+	} else {
+		conn = NewYYConnect(c)
+		conn.SetFragment(d.Fragment)
+		if err := d.negotiateMux(ctx, conn); err != nil {
+			return nil, err
+		}
+	}
+	d.setupConnect(conn)
+	return conn, nil
+}
+
+// setupConnect 按配置设置新建立的连接，并启动心跳
+func (d *Dialer) setupConnect(conn *YYConnect) {
+	conn.SetHeartbeat(d.Heartbeat)
+	conn.SetReadBuffer(d.ReadBuffer)
+	idle := d.IdleTimeout
+	if idle == 0 && d.KeepAlive > 0 {
+		idle = 3 * d.KeepAlive
+	}
+	conn.SetIdleTimeout(idle)
+	if d.KeepAlive > 0 && d.Heartbeat.PingURI != 0 {
+		go conn.keepAlive(d.KeepAlive)
+	}
+}
+
+// negotiateMux 设置了Mux时完成协商，失败时关闭连接
+func (d *Dialer) negotiateMux(ctx context.Context, conn *YYConnect) error {
+	if d.Mux.URI == 0 {
+		return nil
+	}
+	if err := conn.negotiateMux(ctx, d.Mux); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// Dial 使用默认配置建立连接
+func Dial(network, address string) (*YYConnect, error) {
+	var d Dialer
+	return d.Dial(network, address)
+}
+
+// clientHandshake 完成客户端TLS握手，失败时关闭连接
+func (d *Dialer) clientHandshake(ctx context.Context, c net.Conn, address string) (net.Conn, error) {
+	config := d.TLSConfig
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(c, config)
+	if deadline, ok := ctx.Deadline(); ok {
+		tlsConn.SetDeadline(deadline)
+	}
+	// 等待握手完成或ctx取消，ctx取消时关闭连接中断握手
+	done := make(chan error, 1)
+	go func() {
+		done <- tlsConn.Handshake()
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		c.Close()
+		<-done
+		err = ctx.Err()
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
@@ -0,0 +1,140 @@
+package yyserver
+
+import (
+	"runtime"
+	"time"
+
+	"goBase/annego/packet"
+)
+
+// DispatchMode MessageHandle的调度方式
+type DispatchMode int
+
+const (
+	// DispatchSerial 默认方式，在连接的读取goroutine中依次执行
+	DispatchSerial DispatchMode = iota
+	// DispatchPool 在共享的有界工作池中执行，同一连接的消息可能并发执行
+	DispatchPool
+	// DispatchPerConn 同一连接的消息按顺序执行，不同连接的消息并行执行
+	DispatchPerConn
+	// DispatchKeyed 按KeyFunc返回的key排序，key相同的消息按顺序执行
+	DispatchKeyed
+)
+
+// KeyFunc DispatchKeyed模式下计算消息的排序key
+type KeyFunc func(*YYConnect, packet.Marshallable) uint64
+
+// DispatchConfig 调度配置，除DispatchSerial外读取goroutine只负责解包
+// 工作队列满时读取goroutine阻塞，不再从连接读取数据，以此实现背压
+type DispatchConfig struct {
+	Mode DispatchMode
+
+	// Workers 工作goroutine数量，为0时使用runtime.NumCPU()
+	Workers int
+
+	// QueueSize 工作队列长度，为0时使用Workers的数量
+	// DispatchPool所有工作goroutine共享一个队列，其他模式每个工作goroutine各有一个队列
+	QueueSize int
+
+	// Key DispatchKeyed使用的默认排序key
+	// 为nil时同一连接内相同URI的消息按顺序执行，不同URI的消息并行执行
+	Key KeyFunc
+
+	// URIKey DispatchKeyed下指定URI的排序key，优先于Key
+	URIKey map[uint32]KeyFunc
+}
+
+type dispatchTask struct {
+	conn *YYConnect
+	msg  packet.Marshallable
+	info recvInfo
+}
+
+// recvInfo 消息接收时的信息，用于统计
+type recvInfo struct {
+	resCode uint16
+	start   time.Time
+}
+
+// newRecvInfo 取数据帧包头的ResCode，start为收到数据帧的时间
+func newRecvInfo(frame []byte, start time.Time) recvInfo {
+	info := recvInfo{start: start}
+	if header, err := packet.PeekHeader(frame); err == nil {
+		info.resCode = header.ResCode
+	}
+	return info
+}
+
+type dispatcher struct {
+	config  DispatchConfig
+	handle  func(*YYConnect, packet.Marshallable) bool
+	observe func(packet.Marshallable, recvInfo) // 不为nil时在handle返回后调用
+	queues  []chan dispatchTask
+}
+
+func newDispatcher(config DispatchConfig, handle func(*YYConnect, packet.Marshallable) bool) *dispatcher {
+	if config.Workers <= 0 {
+		config.Workers = runtime.NumCPU()
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = config.Workers
+	}
+
+	d := &dispatcher{config: config, handle: handle}
+	if config.Mode == DispatchPool {
+		queue := make(chan dispatchTask, config.QueueSize)
+		d.queues = []chan dispatchTask{queue}
+		for i := 0; i < config.Workers; i++ {
+			go d.work(queue)
+		}
+	} else {
+		d.queues = make([]chan dispatchTask, config.Workers)
+		for i := range d.queues {
+			d.queues[i] = make(chan dispatchTask, config.QueueSize)
+			go d.work(d.queues[i])
+		}
+	}
+	return d
+}
+
+func (d *dispatcher) work(queue chan dispatchTask) {
+	for task := range queue {
+		// 连接已经被关闭，丢弃排队中的消息
+		if closed, _ := task.conn.closeReason(); !closed {
+			if !d.handle(task.conn, task.msg) {
+				task.conn.closeWith(nil)
+			}
+			if d.observe != nil {
+				d.observe(task.msg, task.info)
+			}
+		}
+		task.conn.pending.Done()
+	}
+}
+
+func (d *dispatcher) key(conn *YYConnect, msg packet.Marshallable) uint64 {
+	switch d.config.Mode {
+	case DispatchPerConn:
+		return conn.ID()
+	case DispatchKeyed:
+		if keyfunc, ok := d.config.URIKey[msg.GetURI()]; ok {
+			return keyfunc(conn, msg)
+		}
+		if d.config.Key != nil {
+			return d.config.Key(conn, msg)
+		}
+		return conn.ID()*31 + uint64(msg.GetURI())
+	}
+	return 0
+}
+
+// dispatch 将消息放入工作队列，队列满时阻塞
+func (d *dispatcher) dispatch(conn *YYConnect, msg packet.Marshallable) {
+	d.dispatchInfo(conn, msg, recvInfo{start: time.Now()})
+}
+
+func (d *dispatcher) dispatchInfo(conn *YYConnect, msg packet.Marshallable, info recvInfo) {
+	queue := d.queues[d.key(conn, msg)%uint64(len(d.queues))]
+	conn.pending.Add(1)
+	queue <- dispatchTask{conn, msg, info}
+}
@@ -0,0 +1,187 @@
+package yyserver
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+)
+
+func newPipeConnect() *YYConnect {
+	client, server := net.Pipe()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := server.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return NewYYConnect(client)
+}
+
+func TestDispatchPoolConcurrent(t *testing.T) {
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	handle := func(c *YYConnect, msg packet.Marshallable) bool {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			old := atomic.LoadInt32(&maxRunning)
+			if n <= old || atomic.CompareAndSwapInt32(&maxRunning, old, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		wg.Done()
+		return true
+	}
+	d := newDispatcher(DispatchConfig{Mode: DispatchPool, Workers: 4}, handle)
+	conn := newPipeConnect()
+	defer conn.Close()
+
+	wg.Add(8)
+	for i := 0; i < 8; i++ {
+		d.dispatch(conn, &PTest{Int: uint32(i)})
+	}
+	wg.Wait()
+	assert.Equal(t, int32(4), maxRunning)
+}
+
+func TestDispatchPerConnOrder(t *testing.T) {
+	const conns = 4
+	const total = 200
+	var mut sync.Mutex
+	var wg sync.WaitGroup
+	received := make(map[*YYConnect][]uint32)
+	handle := func(c *YYConnect, msg packet.Marshallable) bool {
+		mut.Lock()
+		received[c] = append(received[c], msg.(*PTest).Int)
+		mut.Unlock()
+		wg.Done()
+		return true
+	}
+	d := newDispatcher(DispatchConfig{Mode: DispatchPerConn, Workers: 3, QueueSize: 8}, handle)
+
+	wg.Add(conns * total)
+	for i := 0; i < conns; i++ {
+		conn := newPipeConnect()
+		defer conn.Close()
+		go func() {
+			for j := 0; j < total; j++ {
+				d.dispatch(conn, &PTest{Int: uint32(j)})
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, conns, len(received))
+	for _, list := range received {
+		for j := 0; j < total; j++ {
+			assert.Equal(t, uint32(j), list[j])
+		}
+	}
+}
+
+func TestDispatchKeyed(t *testing.T) {
+	var mut sync.Mutex
+	var wg sync.WaitGroup
+	received := make(map[uint32][]uint32)
+	handle := func(c *YYConnect, msg packet.Marshallable) bool {
+		req := msg.(*PTest)
+		mut.Lock()
+		received[req.Int%3] = append(received[req.Int%3], req.Int)
+		mut.Unlock()
+		wg.Done()
+		return true
+	}
+	config := DispatchConfig{
+		Mode:    DispatchKeyed,
+		Workers: 4,
+		URIKey: map[uint32]KeyFunc{
+			1: func(c *YYConnect, msg packet.Marshallable) uint64 {
+				return uint64(msg.(*PTest).Int % 3)
+			},
+		},
+	}
+	d := newDispatcher(config, handle)
+	conn := newPipeConnect()
+	defer conn.Close()
+
+	const total = 300
+	wg.Add(total)
+	for i := 0; i < total; i++ {
+		d.dispatch(conn, &PTest{Int: uint32(i)})
+	}
+	wg.Wait()
+
+	for key, list := range received {
+		for j := 1; j < len(list); j++ {
+			assert.Equal(t, list[j-1]+3, list[j], "key %d", key)
+		}
+	}
+}
+
+func TestDispatchBackpressure(t *testing.T) {
+	block := make(chan struct{})
+	handle := func(c *YYConnect, msg packet.Marshallable) bool {
+		<-block
+		return true
+	}
+	d := newDispatcher(DispatchConfig{Mode: DispatchPool, Workers: 1, QueueSize: 2}, handle)
+	conn := newPipeConnect()
+	defer conn.Close()
+
+	var dispatched int32
+	go func() {
+		for i := 0; i < 10; i++ {
+			d.dispatch(conn, &PTest{Int: uint32(i)})
+			atomic.AddInt32(&dispatched, 1)
+		}
+	}()
+
+	// 1个执行中，2个排队，第4个阻塞
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&dispatched))
+	close(block)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&dispatched) == 10
+	}, time.Second, time.Millisecond)
+}
+
+func TestServerDispatchClose(t *testing.T) {
+	closed := make(chan error, 1)
+	var handled int32
+	server := NewYYServer()
+	server.SetDispatch(DispatchConfig{Mode: DispatchPerConn, Workers: 2})
+	server.RegisterHandle(new(PTest), func(c *YYConnect, msg packet.Marshallable) bool {
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&handled, 1)
+		return msg.(*PTest).Int != 0
+	})
+	server.RegisterCloseFunc(func(c *YYConnect, err error) {
+		closed <- err
+	})
+	assert.Nil(t, server.Start("127.0.0.1:0"))
+
+	conn, err := Dial("tcp", server.GetListenAddr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	for i := 3; i >= 0; i-- {
+		assert.Nil(t, conn.Send(&PTest{Int: uint32(i)}))
+	}
+
+	// MessageHandle返回false，CloseHandle在处理完成后收到nil
+	select {
+	case err := <-closed:
+		assert.Nil(t, err)
+		assert.Equal(t, int32(4), atomic.LoadInt32(&handled))
+	case <-time.After(time.Second):
+		t.Fatal("CloseHandle not called")
+	}
+}
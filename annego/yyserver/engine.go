@@ -0,0 +1,39 @@
+package yyserver
+
+import (
+	"errors"
+	"runtime"
+)
+
+// Engine YYServer读取连接的方式
+type Engine int
+
+const (
+	// EngineGoroutine 每个连接一个goroutine和独立的读缓冲区
+	EngineGoroutine Engine = iota
+	// EngineEventLoop 少量事件循环goroutine通过epoll读取所有连接，共享读缓冲区，适合大量空闲连接
+	// 只支持Linux上未使用TLS的TCP和Unix域套接字连接，其他连接仍使用EngineGoroutine
+	// MessageHandle默认在事件循环中执行，耗时的处理会阻塞同一事件循环的其他连接，可以使用SetDispatch
+	// 事件循环中的连接不能调用Recv，不支持SetTimeout设置的读超时
+	EngineEventLoop
+)
+
+// ErrEngineUnsupported 当前平台不支持该Engine
+var ErrEngineUnsupported = errors.New("yyserver: engine unsupported on this platform")
+
+// SetEngine 设置读取连接的方式，loops为事件循环数量，小于等于0时使用CPU数
+// 应该在程序启动时调用
+func (self *YYServer) SetEngine(engine Engine, loops int) error {
+	if self.running {
+		panic("YYServer is runing")
+	}
+	if engine == EngineEventLoop && !eventLoopSupported {
+		return ErrEngineUnsupported
+	}
+	if loops <= 0 {
+		loops = runtime.NumCPU()
+	}
+	self.engine = engine
+	self.engineLoops = loops
+	return nil
+}
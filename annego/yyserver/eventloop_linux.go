@@ -0,0 +1,367 @@
+//go:build linux
+// +build linux
+
+package yyserver
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"goBase/annego/logger"
+	"goBase/annego/packet"
+)
+
+const eventLoopSupported = true
+
+const (
+	eventReadSize      = 64 * 1024 // 事件循环共享读缓冲区大小
+	eventMaxEvents     = 256
+	eventSweepInterval = time.Second // 检查空闲超时的间隔
+)
+
+// eventEngine EngineEventLoop的实现，连接按轮询分配到各个事件循环
+type eventEngine struct {
+	loops []*eventLoop
+	next  uint32
+}
+
+func newEventEngine(server *YYServer, loops int) (*eventEngine, error) {
+	e := &eventEngine{}
+	for i := 0; i < loops; i++ {
+		epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+		if err != nil {
+			for _, l := range e.loops {
+				syscall.Close(l.epfd)
+			}
+			return nil, os.NewSyscallError("epoll_create1", err)
+		}
+		l := &eventLoop{
+			server: server,
+			epfd:   epfd,
+			buf:    make([]byte, eventReadSize),
+			conns:  make(map[int]*eventConn),
+		}
+		e.loops = append(e.loops, l)
+		go l.run()
+		go l.sweep()
+	}
+	return e, nil
+}
+
+// add 由事件循环接管连接，连接不支持时返回false
+func (e *eventEngine) add(conn net.Conn, release func()) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	fd := -1
+	if err := raw.Control(func(f uintptr) { fd = int(f) }); err != nil || fd < 0 {
+		return false
+	}
+	l := e.loops[atomic.AddUint32(&e.next, 1)%uint32(len(e.loops))]
+	l.add(conn, raw, fd, release)
+	return true
+}
+
+// eventConn 事件循环中的连接，除YYConnect外只保存未完成的数据帧
+type eventConn struct {
+	conn       *YYConnect
+	raw        syscall.RawConn
+	fd         int
+	release    func()
+	pending    pendingBuffer
+	lastActive int64 // UnixNano，原子操作
+
+	added    bool // 以下由eventLoop.mut保护
+	detached bool
+}
+
+type eventLoop struct {
+	server *YYServer
+	epfd   int
+	buf    []byte // 只在run中使用
+
+	mut   sync.Mutex
+	conns map[int]*eventConn
+}
+
+// newEventConnect 创建不带读写缓冲区的YYConnect
+func newEventConnect(conn net.Conn) *YYConnect {
+	return &YYConnect{
+		id:     atomic.AddUint64(&connIDSeq, 1),
+		conn:   conn,
+		shared: true,
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *eventLoop) add(conn net.Conn, raw syscall.RawConn, fd int, release func()) {
+	ec := &eventConn{raw: raw, fd: fd, release: release, lastActive: time.Now().UnixNano()}
+	yyconn := newEventConnect(conn)
+	l.server.setupConnect(yyconn)
+	yyconn.onClose = func() {
+		l.detach(ec)
+	}
+	ec.conn = yyconn
+	l.server.metrics.connAccepted()
+
+	// ConnectHandle中可以加入分组，需要先登记连接
+	l.server.registry.add(yyconn)
+	if l.server.connectHandle != nil && !l.server.connectHandle(yyconn) {
+		yyconn.closeWith(nil)
+		return
+	}
+
+	l.mut.Lock()
+	if ec.detached {
+		l.mut.Unlock()
+		return
+	}
+	event := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP, Fd: int32(fd)}
+	if err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, fd, &event); err != nil {
+		l.mut.Unlock()
+		yyconn.closeWith(os.NewSyscallError("epoll_ctl", err))
+		return
+	}
+	ec.added = true
+	l.conns[fd] = ec
+	l.mut.Unlock()
+}
+
+// detach 在closeWith关闭连接之前调用，从事件循环移除连接
+func (l *eventLoop) detach(ec *eventConn) {
+	l.mut.Lock()
+	if ec.detached {
+		l.mut.Unlock()
+		return
+	}
+	ec.detached = true
+	if ec.added {
+		syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, ec.fd, nil)
+		delete(l.conns, ec.fd)
+	}
+	l.mut.Unlock()
+	go l.finish(ec)
+}
+
+// finish 等待消息处理完成后调用CloseHandle
+func (l *eventLoop) finish(ec *eventConn) {
+	yyconn := ec.conn
+	yyconn.pending.Wait()
+	// CloseHandle中的广播不再发送给该连接
+	l.server.registry.remove(yyconn)
+	if l.server.closeHandle != nil {
+		_, reason := yyconn.closeReason()
+		l.server.closeHandle(yyconn, reason)
+	}
+	l.server.metrics.connClosed()
+	ec.release()
+}
+
+func (l *eventLoop) run() {
+	events := make([]syscall.EpollEvent, eventMaxEvents)
+	for {
+		n, err := syscall.EpollWait(l.epfd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			logger.Error("epoll wait error %v, stop event loop", err)
+			return
+		}
+		for i := 0; i < n; i++ {
+			l.mut.Lock()
+			ec := l.conns[int(events[i].Fd)]
+			l.mut.Unlock()
+			if ec != nil {
+				l.read(ec)
+			}
+		}
+	}
+}
+
+// read 读取可读连接的数据，处理其中完整的数据帧
+func (l *eventLoop) read(ec *eventConn) {
+	yyconn := ec.conn
+	var n int
+	var rerr error
+	err := ec.raw.Read(func(fd uintptr) bool {
+		n, rerr = syscall.Read(int(fd), l.buf)
+		return true
+	})
+	if err != nil {
+		yyconn.closeWith(err)
+		return
+	}
+	if rerr == syscall.EAGAIN || rerr == syscall.EINTR {
+		return
+	}
+	if rerr != nil {
+		yyconn.closeWith(os.NewSyscallError("read", rerr))
+		return
+	}
+	if n == 0 {
+		yyconn.closeWith(io.EOF)
+		return
+	}
+	atomic.StoreInt64(&ec.lastActive, time.Now().UnixNano())
+
+	data := l.buf[:n]
+	buffered := ec.pending.Len() > 0
+	if buffered {
+		ec.pending.write(data, l.server.maxReadBuffer())
+		data = ec.pending.Bytes()
+	}
+	consumed := 0
+	for {
+		if err := checkFrameLength(data, l.server.maxReadBuffer()); err != nil {
+			yyconn.closeWith(err)
+			return
+		}
+		length, err := packet.FrameLength(data)
+		if err == packet.ErrInputNotEnough {
+			break
+		}
+		if err != nil {
+			yyconn.closeWith(err)
+			return
+		}
+		if !l.handleFrame(yyconn, data[:length]) {
+			return
+		}
+		data = data[length:]
+		consumed += length
+	}
+	// 未完成的数据帧保存在连接中，共享缓冲区在下次读取时复用
+	if buffered {
+		ec.pending.consume(consumed)
+	} else if len(data) > 0 {
+		ec.pending.write(data, l.server.maxReadBuffer())
+	}
+}
+
+// pendingBuffer 连接中未完成的数据帧，大数据帧分多次读取时按倍数增长
+// 已处理的前缀不小于剩余数据时才移动数据，每次读取不复制整个未完成的数据帧
+type pendingBuffer struct {
+	buf   []byte
+	start int
+	end   int
+}
+
+func (p *pendingBuffer) Len() int {
+	return p.end - p.start
+}
+
+func (p *pendingBuffer) Bytes() []byte {
+	return p.buf[p.start:p.end]
+}
+
+// write 追加数据，max为缓冲区增长的上限，超过上限的数据帧由checkFrameLength关闭连接
+func (p *pendingBuffer) write(data []byte, max int) {
+	if p.end+len(data) > len(p.buf) {
+		used := p.Len()
+		need := used + len(data)
+		if p.start > 0 && p.start >= used && need <= len(p.buf) {
+			copy(p.buf, p.buf[p.start:p.end])
+		} else {
+			size := len(p.buf) * 2
+			if size < eventReadSize {
+				size = eventReadSize
+			}
+			for size < need {
+				size *= 2
+			}
+			if size > max && need <= max {
+				size = max
+			}
+			buf := make([]byte, size)
+			copy(buf, p.buf[p.start:p.end])
+			p.buf = buf
+		}
+		p.start, p.end = 0, used
+	}
+	p.end += copy(p.buf[p.end:], data)
+}
+
+// consume 设置已处理的长度，读空后释放超过eventReadSize的shrinkRatio倍的缓冲区
+func (p *pendingBuffer) consume(n int) {
+	p.start += n
+	if p.start == p.end {
+		p.start, p.end = 0, 0
+		if len(p.buf) > eventReadSize*shrinkRatio {
+			p.buf = nil
+		}
+	}
+}
+
+// handleFrame 处理一个数据帧，连接已关闭时返回false
+func (l *eventLoop) handleFrame(yyconn *YYConnect, frame []byte) bool {
+	if yyconn.handleHeartbeat(frame) {
+		yyconn.recordIn(frame, false)
+		return true
+	}
+	if yyconn.handleMux(frame) {
+		yyconn.recordIn(frame, false)
+		closed, _ := yyconn.closeReason()
+		return !closed
+	}
+	start := time.Now()
+	var msg packet.Marshallable
+	var err error
+	if yyconn.isFragment(frame) {
+		full := yyconn.reassemble(frame)
+		yyconn.recordIn(frame, full != nil)
+		if full == nil {
+			return true
+		}
+		frame = full
+		msg, err = unmarshalFrame(l.server.register, frame)
+	} else {
+		yyconn.recordIn(frame, true)
+		// 解包出的[]byte引用数据帧，复制后不受共享缓冲区复用影响
+		frame = append([]byte(nil), frame...)
+		msg, _, err = l.server.register.UnmarshalBytes(frame)
+	}
+	if err != nil {
+		yyconn.closeWith(err)
+		return false
+	}
+	// MessageHandle返回false，主动关闭连接
+	if !l.server.handleRecv(yyconn, msg, newRecvInfo(frame, start)) {
+		yyconn.closeWith(nil)
+		return false
+	}
+	closed, _ := yyconn.closeReason()
+	return !closed
+}
+
+// sweep 关闭空闲超时的连接
+func (l *eventLoop) sweep() {
+	ticker := time.NewTicker(eventSweepInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		expired := make([]*eventConn, 0)
+		l.mut.Lock()
+		for _, ec := range l.conns {
+			timeout := ec.conn.IdleTimeout()
+			last := time.Unix(0, atomic.LoadInt64(&ec.lastActive))
+			if timeout > 0 && now.Sub(last) >= timeout {
+				expired = append(expired, ec)
+			}
+		}
+		l.mut.Unlock()
+
+		for _, ec := range expired {
+			ec.conn.closeWith(ErrIdleTimeout)
+		}
+	}
+}
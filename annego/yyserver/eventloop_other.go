@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package yyserver
+
+import (
+	"net"
+)
+
+const eventLoopSupported = false
+
+type eventEngine struct{}
+
+func newEventEngine(server *YYServer, loops int) (*eventEngine, error) {
+	return nil, ErrEngineUnsupported
+}
+
+func (e *eventEngine) add(conn net.Conn, release func()) bool {
+	return false
+}
@@ -0,0 +1,234 @@
+//go:build linux
+// +build linux
+
+package yyserver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+)
+
+func newEventServer(t testing.TB) *YYServer {
+	server := NewYYServer()
+	assert.Nil(t, server.SetEngine(EngineEventLoop, 2))
+	return server
+}
+
+func TestEventLoopEcho(t *testing.T) {
+	server := newEventServer(t)
+	addr := startEchoServer(t, server)
+	assert.NotNil(t, server.events)
+
+	conns := make([]*YYConnect, 0)
+	for i := 0; i < 4; i++ {
+		conn, err := Dial("tcp", addr)
+		assert.Nil(t, err)
+		defer conn.Close()
+		conn.SetTimeout(5*time.Second, 5*time.Second)
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		assertEcho(t, conn, "eventloop")
+		// 超过共享缓冲区的数据帧分多次读取
+		assertEcho(t, conn, strings.Repeat("x", 60000))
+	}
+	assert.Equal(t, 4, server.Count())
+
+	// 一次写入多个数据帧，以及逐字节写入的数据帧
+	raw, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer raw.Close()
+	frame := packet.GetMarshalPack(&PTest{Int: 1, Str: "raw"}).Bytes()
+	raw.Write(append(append([]byte(nil), frame...), frame...))
+	for i := range frame {
+		raw.Write(frame[i : i+1])
+		time.Sleep(time.Millisecond)
+	}
+	conn := NewYYConnect(raw)
+	conn.SetTimeout(5*time.Second, 5*time.Second)
+	for i := 0; i < 3; i++ {
+		msg, err := conn.Recv(newTestRegister())
+		assert.Nil(t, err)
+		assert.Equal(t, &PTestRes{Int: 1, Str: "raw"}, msg)
+	}
+}
+
+func TestEventLoopClose(t *testing.T) {
+	server := newEventServer(t)
+	server.SetIdleTimeout(500 * time.Millisecond)
+	server.SetHeartbeat(testHeartbeat)
+	reasons := make(chan error, 4)
+	server.RegisterCloseFunc(func(c *YYConnect, reason error) {
+		reasons <- reason
+	})
+	server.RegisterHandle(new(PTest), func(c *YYConnect, msg packet.Marshallable) bool {
+		req := msg.(*PTest)
+		c.Send(&PTestRes{req.Int, req.Str})
+		return req.Str != "quit"
+	})
+	assert.Nil(t, server.Start("127.0.0.1:0"))
+	addr := server.GetListenAddr().String()
+	reg := newTestRegister()
+
+	// MessageHandle返回false
+	conn, err := Dial("tcp", addr)
+	assert.Nil(t, err)
+	conn.SetTimeout(5*time.Second, 5*time.Second)
+	assertEcho(t, conn, "hello")
+	assert.Nil(t, conn.Send(&PTest{Int: 1, Str: "quit"}))
+	_, err = conn.Recv(reg)
+	assert.Nil(t, err)
+	_, err = conn.Recv(reg)
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, <-reasons)
+
+	// 对端关闭
+	conn, err = Dial("tcp", addr)
+	assert.Nil(t, err)
+	assertEcho(t, conn, "hello")
+	conn.Close()
+	assert.Equal(t, io.EOF, <-reasons)
+
+	// Kick
+	conn, err = Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, "hello")
+	kickReason := fmt.Errorf("kick")
+	server.Range(func(c *YYConnect) bool {
+		server.Kick(c.ID(), kickReason)
+		return true
+	})
+	assert.Equal(t, kickReason, <-reasons)
+
+	// 心跳保持连接，之后空闲超时
+	conn, err = Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetHeartbeat(testHeartbeat)
+	for i := 0; i < 4; i++ {
+		time.Sleep(200 * time.Millisecond)
+		assert.Nil(t, conn.writeFrame(packet.PackFrame(testHeartbeat.PingURI, packet.ResSuccess, nil)))
+	}
+	assert.Equal(t, 1, server.Count())
+	select {
+	case reason := <-reasons:
+		assert.Equal(t, ErrIdleTimeout, reason)
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle timeout not triggered")
+	}
+	assert.Equal(t, 0, server.Count())
+}
+
+func TestEventLoopAdmission(t *testing.T) {
+	server := newEventServer(t)
+	config := AdmissionConfig{MaxConn: 1}
+	config.Refuse = func(reason RefuseReason, addr net.Addr) packet.Marshallable {
+		return &PTestRes{Int: uint32(reason), Str: reason.String()}
+	}
+	assert.Nil(t, server.SetAdmission(config))
+	addr := startEchoServer(t, server)
+
+	conn := dialEcho(t, addr)
+	expectRefuse(t, addr, RefuseMaxConn)
+	conn.Close()
+	// 连接结束后释放名额
+	assert.Eventually(t, func() bool {
+		return server.Count() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	conn = dialEcho(t, addr)
+	conn.Close()
+}
+
+func TestEventLoopPendingBuffer(t *testing.T) {
+	var p pendingBuffer
+	frame := packet.GetMarshalPack(&PBig{Data: make([]byte, 1024*1024)}).Bytes()
+	// 大数据帧分多次写入，缓冲区按倍数增长，不重新复制每次读取的未完成数据
+	allocs := 0
+	for off := 0; off < len(frame); off += eventReadSize {
+		end := off + eventReadSize
+		if end > len(frame) {
+			end = len(frame)
+		}
+		before := len(p.buf)
+		p.write(frame[off:end], packet.MaxPacketLength)
+		if len(p.buf) != before {
+			allocs++
+		}
+	}
+	assert.Equal(t, frame, p.Bytes())
+	assert.True(t, allocs <= 6, allocs)
+	p.consume(len(frame))
+	assert.Nil(t, p.buf)
+
+	// 已处理的前缀不小于剩余数据时移动到缓冲区开头
+	p.write(make([]byte, 100), packet.MaxPacketLength)
+	p.consume(60)
+	size := len(p.buf)
+	p.write(make([]byte, size-50), packet.MaxPacketLength)
+	assert.Equal(t, size, len(p.buf))
+	assert.Equal(t, 0, p.start)
+	assert.Equal(t, size-10, p.Len())
+}
+
+// BenchmarkConnMemory 比较两种Engine下每个空闲连接占用的内存，包括测试进程中客户端连接的内存
+func BenchmarkConnMemory(b *testing.B) {
+	const conns = 2000
+	for _, engine := range []Engine{EngineGoroutine, EngineEventLoop} {
+		name := map[Engine]string{EngineGoroutine: "goroutine", EngineEventLoop: "eventloop"}[engine]
+		b.Run(name, func(b *testing.B) {
+			server := NewYYServer()
+			assert.Nil(b, server.SetEngine(engine, 2))
+			// 使用同步Send，不启动异步写goroutine
+			server.RegisterHandle(new(PTest), func(c *YYConnect, msg packet.Marshallable) bool {
+				c.Send(&PTestRes{Int: 1})
+				return true
+			})
+			assert.Nil(b, server.Start("127.0.0.1:0"))
+			addr := server.GetListenAddr().String()
+			defer stopServer(server)
+
+			before := memInUse()
+			clients := make([]net.Conn, 0, conns)
+			for i := 0; i < conns; i++ {
+				c, err := net.Dial("tcp", addr)
+				if err != nil {
+					b.Fatal(err)
+				}
+				clients = append(clients, c)
+			}
+			for server.Count() < conns {
+				time.Sleep(10 * time.Millisecond)
+			}
+			// 每个连接收发一次，读缓冲区分配后保持空闲
+			frame := packet.GetMarshalPack(&PTest{Int: 1, Str: "hello"}).Bytes()
+			buf := make([]byte, 64)
+			for _, c := range clients {
+				c.Write(frame)
+				io.ReadAtLeast(c, buf, 1)
+			}
+			after := memInUse()
+			b.ReportMetric(float64(after-before)/conns, "B/conn")
+
+			for _, c := range clients {
+				c.Close()
+			}
+		})
+	}
+}
+
+func memInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse + stats.StackInuse
+}
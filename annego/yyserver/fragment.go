@@ -0,0 +1,311 @@
+package yyserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"goBase/annego/logger"
+	"goBase/annego/packet"
+)
+
+const (
+	// DefaultFragmentSize 未设置时每个分片携带的最大数据长度
+	DefaultFragmentSize = 1024 * 1024
+	// DefaultFragmentMaxMessage 未设置时重组后单个消息的最大长度
+	DefaultFragmentMaxMessage = 256 * 1024 * 1024
+	// DefaultFragmentTimeout 未设置时完成重组的期限
+	DefaultFragmentTimeout = 30 * time.Second
+	// DefaultFragmentTotalMemory 未设置时服务所有连接正在重组的消息占用内存的上限
+	DefaultFragmentTotalMemory = 1024 * 1024 * 1024
+
+	// fragmentHeaderLength 分片包体开头的消息ID、消息总长度和分片偏移
+	fragmentHeaderLength = 12
+)
+
+// FragmentConfig 大消息分片配置，两端需要使用相同的URI，UDP连接不分片
+// 超过Size的数据帧拆分为多个URI数据帧发送，接收端重组后作为一个消息处理
+// 分片之间可以穿插其他消息，多个大消息可以同时发送
+type FragmentConfig struct {
+	// URI 分片数据帧的URI，为0表示不分片，不能与业务协议的URI相同
+	URI uint32
+
+	// Size 每个分片携带的最大数据长度，为0使用DefaultFragmentSize
+	Size int
+
+	// MaxMessage 发送和重组的单个消息最大长度，为0使用DefaultFragmentMaxMessage，不能超过4GB
+	MaxMessage int
+
+	// MaxMemory 单个连接正在重组的消息已收到的数据上限，为0使用MaxMessage
+	// 内存按实际收到的分片计算，超过上限时丢弃收到该分片的消息
+	MaxMemory int
+
+	// TotalMemory 服务所有连接正在重组的消息已收到的数据上限，为0使用DefaultFragmentTotalMemory，只对YYServer生效
+	TotalMemory int64
+
+	// Timeout 收到第一个分片后完成重组的期限，超时丢弃已收到的分片，为0使用DefaultFragmentTimeout
+	Timeout time.Duration
+}
+
+// FragmentStats 分片统计
+type FragmentStats struct {
+	Sent        uint64 // 拆分发送的消息数
+	Reassembled uint64 // 重组完成的消息数
+	Dropped     uint64 // 超过长度或内存上限、超时、分片错误丢弃的消息数
+	Pending     int    // 正在重组的消息数
+	Memory      int    // 正在重组的消息占用的内存
+}
+
+// fragmentBudget 多个连接共享的重组内存上限
+type fragmentBudget struct {
+	limit int64
+	used  int64 // 原子操作
+}
+
+func (b *fragmentBudget) acquire(size int) bool {
+	if b == nil {
+		return true
+	}
+	if atomic.AddInt64(&b.used, int64(size)) > b.limit {
+		atomic.AddInt64(&b.used, -int64(size))
+		return false
+	}
+	return true
+}
+
+func (b *fragmentBudget) release(size int) {
+	if b != nil {
+		atomic.AddInt64(&b.used, -int64(size))
+	}
+}
+
+// reassembly 正在重组的消息，buf随收到的分片增长
+type reassembly struct {
+	buf   []byte
+	total int // 对端声明的消息总长度
+	timer *time.Timer
+}
+
+type fragmenter struct {
+	config FragmentConfig
+	budget *fragmentBudget
+
+	nextID      uint32
+	sent        uint64
+	reassembled uint64
+	dropped     uint64
+
+	mut     sync.Mutex
+	pending map[uint32]*reassembly
+	memory  int
+	closed  bool
+}
+
+func newFragmenter(config FragmentConfig, budget *fragmentBudget) *fragmenter {
+	if config.Size <= 0 {
+		config.Size = DefaultFragmentSize
+	}
+	if config.MaxMessage <= 0 {
+		config.MaxMessage = DefaultFragmentMaxMessage
+	}
+	if config.MaxMemory <= 0 {
+		config.MaxMemory = config.MaxMessage
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultFragmentTimeout
+	}
+	return &fragmenter{config: config, budget: budget, pending: make(map[uint32]*reassembly)}
+}
+
+// SetFragment 设置大消息分片，应该在首次收发前调用，URI为0表示不分片
+func (c *YYConnect) SetFragment(config FragmentConfig) {
+	if config.URI == 0 {
+		c.fragment = nil
+		return
+	}
+	c.fragment = newFragmenter(config, nil)
+}
+
+// FragmentStats 返回分片统计，未设置分片时返回零值
+func (c *YYConnect) FragmentStats() FragmentStats {
+	f := c.fragment
+	if f == nil {
+		return FragmentStats{}
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return FragmentStats{
+		Sent:        atomic.LoadUint64(&f.sent),
+		Reassembled: atomic.LoadUint64(&f.reassembled),
+		Dropped:     atomic.LoadUint64(&f.dropped),
+		Pending:     len(f.pending),
+		Memory:      f.memory,
+	}
+}
+
+// SetFragment 设置所有TCP连接的大消息分片，应该在程序启动时调用
+// URI为0或者已经注册时返回error
+func (self *YYServer) SetFragment(config FragmentConfig) error {
+	if self.running {
+		panic("YYServer is runing")
+	}
+	if config.URI == 0 {
+		return fmt.Errorf("yyserver: fragment uri is 0")
+	}
+	if _, ok := self.register.New(config.URI); ok {
+		return fmt.Errorf("yyserver: fragment uri %d has register", config.URI)
+	}
+	if config.TotalMemory <= 0 {
+		config.TotalMemory = DefaultFragmentTotalMemory
+	}
+	self.fragment = config
+	self.fragmentBudget = &fragmentBudget{limit: config.TotalMemory}
+	return nil
+}
+
+// isFragment 判断数据帧是否为分片
+func (c *YYConnect) isFragment(frame []byte) bool {
+	return c.fragment != nil && binary.LittleEndian.Uint32(frame[4:8]) == c.fragment.config.URI
+}
+
+// isMessage 判断发送的数据帧是否计为一个消息，心跳、流数据帧和消息最后一个分片之前的分片不计入
+func (c *YYConnect) isMessage(frame []byte) bool {
+	if c.isHeartbeat(frame) || c.isMux(frame) {
+		return false
+	}
+	if c.isFragment(frame) && len(frame) >= packet.HeaderLength+fragmentHeaderLength {
+		body := frame[packet.HeaderLength:]
+		total := binary.LittleEndian.Uint32(body[4:8])
+		offset := binary.LittleEndian.Uint32(body[8:12])
+		return int(offset)+len(body)-fragmentHeaderLength >= int(total)
+	}
+	return true
+}
+
+// sendFragments 数据帧超过分片大小时拆分，依次调用send发送，返回false表示不需要拆分
+// 分片在发送时才生成，两次send之间可以穿插其他数据帧
+func (c *YYConnect) sendFragments(data []byte, send func([]byte) error) (bool, error) {
+	f := c.fragment
+	if f == nil || len(data) <= f.config.Size || c.isFragment(data) || c.isMux(data) {
+		return false, nil
+	}
+	if len(data) > f.config.MaxMessage {
+		return true, ErrMessageTooLarge
+	}
+	id := atomic.AddUint32(&f.nextID, 1)
+	for offset := 0; offset < len(data); offset += f.config.Size {
+		end := offset + f.config.Size
+		if end > len(data) {
+			end = len(data)
+		}
+		body := make([]byte, fragmentHeaderLength+end-offset)
+		binary.LittleEndian.PutUint32(body[0:4], id)
+		binary.LittleEndian.PutUint32(body[4:8], uint32(len(data)))
+		binary.LittleEndian.PutUint32(body[8:12], uint32(offset))
+		copy(body[fragmentHeaderLength:], data[offset:end])
+		if err := send(packet.PackFrame(f.config.URI, packet.ResSuccess, body)); err != nil {
+			return true, err
+		}
+	}
+	atomic.AddUint64(&f.sent, 1)
+	return true, nil
+}
+
+// reassemble 处理收到的分片，消息的最后一个分片返回重组后的完整数据帧，其他情况返回nil
+// 超过长度或内存上限、分片顺序错误的消息被丢弃，之后收到的该消息的分片被忽略
+// 内存按已收到的数据计算，不按对端声明的总长度预先分配
+func (c *YYConnect) reassemble(frame []byte) []byte {
+	f := c.fragment
+	body := frame[packet.HeaderLength:]
+	if len(body) < fragmentHeaderLength {
+		atomic.AddUint64(&f.dropped, 1)
+		return nil
+	}
+	id := binary.LittleEndian.Uint32(body[0:4])
+	total := int(binary.LittleEndian.Uint32(body[4:8]))
+	offset := int(binary.LittleEndian.Uint32(body[8:12]))
+	data := body[fragmentHeaderLength:]
+
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	r := f.pending[id]
+	if r == nil {
+		// 已丢弃消息的后续分片
+		if offset != 0 || f.closed {
+			return nil
+		}
+		if total < packet.HeaderLength || total > f.config.MaxMessage {
+			atomic.AddUint64(&f.dropped, 1)
+			logger.Warning("conn %v drop fragment message %d length %d", c.RemoteAddr(), id, total)
+			return nil
+		}
+		r = &reassembly{total: total}
+		r.timer = time.AfterFunc(f.config.Timeout, func() {
+			f.mut.Lock()
+			defer f.mut.Unlock()
+			if f.pending[id] == r {
+				f.remove(id, r)
+				atomic.AddUint64(&f.dropped, 1)
+				logger.Warning("conn %v fragment message %d timeout, received %d/%d", c.RemoteAddr(), id, len(r.buf), r.total)
+			}
+		})
+		f.pending[id] = r
+	}
+	if offset != len(r.buf) || len(r.buf)+len(data) > r.total {
+		f.remove(id, r)
+		atomic.AddUint64(&f.dropped, 1)
+		logger.Warning("conn %v fragment message %d offset %d error, received %d/%d", c.RemoteAddr(), id, offset, len(r.buf), r.total)
+		return nil
+	}
+	if f.memory+len(data) > f.config.MaxMemory || !f.budget.acquire(len(data)) {
+		f.remove(id, r)
+		atomic.AddUint64(&f.dropped, 1)
+		logger.Warning("conn %v drop fragment message %d, received %d/%d, reassembling %d", c.RemoteAddr(), id, len(r.buf), r.total, f.memory)
+		return nil
+	}
+	f.memory += len(data)
+	r.buf = append(r.buf, data...)
+	if len(r.buf) < r.total {
+		return nil
+	}
+	f.remove(id, r)
+	if header, _ := packet.PeekHeader(r.buf); int(header.Length) != len(r.buf) {
+		atomic.AddUint64(&f.dropped, 1)
+		return nil
+	}
+	atomic.AddUint64(&f.reassembled, 1)
+	return r.buf
+}
+
+// remove 结束重组并释放内存，调用时需持有mut
+func (f *fragmenter) remove(id uint32, r *reassembly) {
+	r.timer.Stop()
+	delete(f.pending, id)
+	f.memory -= len(r.buf)
+	f.budget.release(len(r.buf))
+}
+
+// close 连接关闭时丢弃所有正在重组的消息
+func (f *fragmenter) close() {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.closed = true
+	for id, r := range f.pending {
+		f.remove(id, r)
+	}
+}
+
+// unmarshalFrame 解包重组后的完整数据帧，长度可以超过packet.MaxPacketLength
+func unmarshalFrame(register *packet.YYRegister, frame []byte) (packet.Marshallable, error) {
+	unpack := packet.NewUnpack(frame)
+	msg, err := register.Unmarshal(unpack)
+	if err != nil {
+		return nil, err
+	}
+	if unpack.Offset() != len(frame) {
+		return nil, fmt.Errorf("unmarshal error length: %d %d", unpack.Offset(), len(frame))
+	}
+	return msg, nil
+}
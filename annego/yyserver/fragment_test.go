@@ -0,0 +1,227 @@
+package yyserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+)
+
+const testFragmentURI = 100
+
+// captureFragments 返回sender发送msg时生成的所有数据帧
+func captureFragments(t *testing.T, sender *YYConnect, msg packet.Marshallable) [][]byte {
+	frames := make([][]byte, 0)
+	sender.capture = func(frame []byte) error {
+		frames = append(frames, frame)
+		return nil
+	}
+	assert.Nil(t, sender.Send(msg))
+	sender.capture = nil
+	return frames
+}
+
+func bigMessage(size int, fill byte) *PBig {
+	return &PBig{Data: bytes.Repeat([]byte{fill}, size)}
+}
+
+func TestFragmentReassemble(t *testing.T) {
+	config := FragmentConfig{URI: testFragmentURI, Size: 1000, MaxMemory: 5000}
+	sender := newPipeConnect()
+	sender.SetFragment(config)
+	receiver := newPipeConnect()
+	receiver.SetFragment(config)
+	reg := packet.NewYYRegister()
+	reg.Register(new(PBig))
+
+	// 不超过Size的数据帧不拆分
+	frames := captureFragments(t, sender, bigMessage(100, 0))
+	assert.Equal(t, 1, len(frames))
+	assert.False(t, sender.isFragment(frames[0]))
+
+	// 两个消息的分片交错到达
+	a := captureFragments(t, sender, bigMessage(2500, 'a'))
+	b := captureFragments(t, sender, bigMessage(1500, 'b'))
+	assert.Equal(t, 3, len(a))
+	assert.Equal(t, 2, len(b))
+	assert.Nil(t, receiver.reassemble(a[0]))
+	assert.Nil(t, receiver.reassemble(b[0]))
+	assert.Nil(t, receiver.reassemble(a[1]))
+	assert.Equal(t, 2, receiver.FragmentStats().Pending)
+	full := receiver.reassemble(b[1])
+	msg, err := unmarshalFrame(reg, full)
+	assert.Nil(t, err)
+	assert.Equal(t, bigMessage(1500, 'b'), msg)
+	msg, err = unmarshalFrame(reg, receiver.reassemble(a[2]))
+	assert.Nil(t, err)
+	assert.Equal(t, bigMessage(2500, 'a'), msg)
+	assert.Equal(t, FragmentStats{Sent: 0, Reassembled: 2}, receiver.FragmentStats())
+	assert.Equal(t, uint64(2), sender.FragmentStats().Sent)
+
+	// 超过MaxMemory时丢弃收到分片的消息，后续分片被忽略
+	a = captureFragments(t, sender, bigMessage(3000, 'a'))
+	b = captureFragments(t, sender, bigMessage(3000, 'b'))
+	for _, frame := range [][]byte{a[0], b[0], a[1], b[1], a[2], b[2], b[3]} {
+		assert.Nil(t, receiver.reassemble(frame))
+	}
+	assert.Equal(t, 3000, receiver.FragmentStats().Memory)
+	assert.NotNil(t, receiver.reassemble(a[3]))
+	stats := receiver.FragmentStats()
+	assert.Equal(t, uint64(3), stats.Reassembled)
+	assert.Equal(t, uint64(1), stats.Dropped)
+	assert.Equal(t, 0, stats.Memory)
+
+	// 分片顺序错误丢弃整个消息
+	a = captureFragments(t, sender, bigMessage(2500, 'a'))
+	assert.Nil(t, receiver.reassemble(a[0]))
+	assert.Nil(t, receiver.reassemble(a[2]))
+	assert.Nil(t, receiver.reassemble(a[1]))
+	assert.Equal(t, uint64(2), receiver.FragmentStats().Dropped)
+	assert.Equal(t, 0, receiver.FragmentStats().Pending)
+
+	// 超过MaxMessage的消息不能发送
+	sender.SetFragment(FragmentConfig{URI: testFragmentURI, Size: 1000, MaxMessage: 2000})
+	assert.Equal(t, ErrMessageTooLarge, sender.Send(bigMessage(3000, 'a')))
+}
+
+func TestFragmentTimeout(t *testing.T) {
+	config := FragmentConfig{URI: testFragmentURI, Size: 1000, Timeout: 50 * time.Millisecond}
+	sender := newPipeConnect()
+	sender.SetFragment(config)
+	receiver := newPipeConnect()
+	receiver.SetFragment(config)
+
+	frames := captureFragments(t, sender, bigMessage(2500, 'a'))
+	assert.Nil(t, receiver.reassemble(frames[0]))
+	assert.Equal(t, 1, receiver.FragmentStats().Pending)
+	assert.Eventually(t, func() bool {
+		return receiver.FragmentStats().Pending == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint64(1), receiver.FragmentStats().Dropped)
+	assert.Nil(t, receiver.reassemble(frames[1]))
+	assert.Nil(t, receiver.reassemble(frames[2]))
+
+	// 连接关闭时释放正在重组的消息
+	assert.Nil(t, receiver.reassemble(frames[0]))
+	receiver.Close()
+	assert.Equal(t, FragmentStats{Dropped: 1}, receiver.FragmentStats())
+}
+
+func TestFragmentTotalMemory(t *testing.T) {
+	config := FragmentConfig{URI: testFragmentURI, Size: 1000, TotalMemory: 5000}
+	server := NewYYServer()
+	assert.Nil(t, server.SetFragment(config))
+	assert.NotNil(t, server.SetFragment(FragmentConfig{}))
+	server.RegisterHandle(new(PBig), func(*YYConnect, packet.Marshallable) bool { return true })
+	assert.NotNil(t, server.SetFragment(FragmentConfig{URI: 3}))
+
+	sender := newPipeConnect()
+	sender.SetFragment(config)
+	conns := []*YYConnect{newPipeConnect(), newPipeConnect()}
+	for _, c := range conns {
+		server.setupConnect(c)
+	}
+	// 两个连接共享TotalMemory
+	a := captureFragments(t, sender, bigMessage(3000, 'a'))
+	b := captureFragments(t, sender, bigMessage(3000, 'b'))
+	for _, frame := range a[:3] {
+		assert.Nil(t, conns[0].reassemble(frame))
+	}
+	assert.Nil(t, conns[1].reassemble(b[0]))
+	assert.Nil(t, conns[1].reassemble(b[1]))
+	assert.Nil(t, conns[1].reassemble(b[2]))
+	assert.Equal(t, uint64(1), conns[1].FragmentStats().Dropped)
+
+	// 连接关闭后释放的内存可以被其他连接使用
+	conns[0].Close()
+	assert.Nil(t, conns[1].reassemble(a[0]))
+	assert.Equal(t, 1, conns[1].FragmentStats().Pending)
+}
+
+func TestFragmentClaimedTotal(t *testing.T) {
+	server := NewYYServer()
+	assert.Nil(t, server.SetFragment(FragmentConfig{URI: testFragmentURI}))
+	assert.Equal(t, int64(DefaultFragmentTotalMemory), server.fragmentBudget.limit)
+	conn := newPipeConnect()
+	server.setupConnect(conn)
+	defer conn.Close()
+
+	// 单个分片声明接近MaxMessage的总长度，只按收到的数据计算内存
+	body := make([]byte, fragmentHeaderLength+10)
+	binary.LittleEndian.PutUint32(body[0:4], 1)
+	binary.LittleEndian.PutUint32(body[4:8], DefaultFragmentMaxMessage)
+	assert.Nil(t, conn.reassemble(packet.PackFrame(testFragmentURI, 0, body)))
+	stats := conn.FragmentStats()
+	assert.Equal(t, 1, stats.Pending)
+	assert.Equal(t, 10, stats.Memory)
+	assert.Equal(t, int64(10), server.fragmentBudget.used)
+	assert.True(t, cap(conn.fragment.pending[1].buf) < 1024)
+}
+
+func TestServerFragment(t *testing.T) {
+	for _, engine := range []Engine{EngineGoroutine, EngineEventLoop} {
+		config := FragmentConfig{URI: testFragmentURI, Size: 4096}
+		readBuffer := ReadBufferConfig{ReadSize: 1024, MaxSize: 8192}
+		server := NewYYServer()
+		assert.Nil(t, server.SetEngine(engine, 1))
+		assert.Nil(t, server.SetFragment(config))
+		server.SetReadBuffer(readBuffer)
+		server.RegisterHandle(new(PBig), func(c *YYConnect, msg packet.Marshallable) bool {
+			c.SendAsync(msg)
+			return true
+		})
+		addr := startEchoServer(t, server)
+
+		d := Dialer{Fragment: config, ReadBuffer: readBuffer}
+		conn, err := d.Dial("tcp", addr)
+		assert.Nil(t, err)
+		conn.SetTimeout(5*time.Second, 5*time.Second)
+
+		// 大消息超过读缓冲区上限，与普通消息穿插发送
+		const count = 4
+		var wg sync.WaitGroup
+		for i := 0; i < count; i++ {
+			wg.Add(2)
+			go func(i int) {
+				defer wg.Done()
+				assert.Nil(t, conn.Send(bigMessage(100*1024, byte(i))))
+			}(i)
+			go func(i int) {
+				defer wg.Done()
+				assert.Nil(t, conn.Send(&PTest{Int: uint32(i)}))
+			}(i)
+		}
+		wg.Wait()
+
+		reg := newTestRegister()
+		reg.Register(new(PBig))
+		bigs, tests := 0, 0
+		for bigs+tests < 2*count {
+			msg, err := conn.Recv(reg)
+			if !assert.Nil(t, err) {
+				break
+			}
+			switch m := msg.(type) {
+			case *PBig:
+				assert.Equal(t, 100*1024, len(m.Data))
+				assert.Equal(t, bytes.Repeat(m.Data[:1], len(m.Data)), m.Data)
+				bigs++
+			case *PTestRes:
+				tests++
+			}
+		}
+		assert.Equal(t, count, bigs)
+		assert.Equal(t, count, tests)
+		assert.Equal(t, uint64(count), conn.FragmentStats().Sent)
+		assert.Equal(t, uint64(count), conn.FragmentStats().Reassembled)
+		assert.Equal(t, uint64(2*count), conn.Stats().MessagesOut)
+
+		conn.Close()
+		stopServer(server)
+	}
+}
@@ -0,0 +1,38 @@
+package yyserver
+
+import (
+	"goBase/annego/packet"
+)
+
+// frameWriter 将写入的字节流按YY包拆分，每个完整的包调用一次writeFrame
+// 用于每个包需要单独发送的传输，例如UDP数据报、WebSocket消息
+type frameWriter struct {
+	buf        []byte
+	writeFrame func([]byte) error
+}
+
+// Write 缓存不完整的包，直到收到完整的包才写出
+func (w *frameWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	start := 0
+	var err error
+	for {
+		var length int
+		length, err = packet.FrameLength(w.buf[start:])
+		if err != nil {
+			break
+		}
+		if err = w.writeFrame(w.buf[start : start+length]); err != nil {
+			break
+		}
+		start += length
+	}
+
+	if err == packet.ErrInputNotEnough {
+		w.buf = w.buf[:copy(w.buf, w.buf[start:])]
+		return len(p), nil
+	}
+	// 包格式错误或写出失败，丢弃缓存数据
+	w.buf = w.buf[:0]
+	return 0, err
+}
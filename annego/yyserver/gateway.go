@@ -0,0 +1,172 @@
+package yyserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"goBase/annego/packet"
+)
+
+// HTTPReply HTTP网关返回的一个回复包
+type HTTPReply struct {
+	URI     uint32      `json:"uri"`
+	ResCode uint16      `json:"res_code"`
+	Msg     interface{} `json:"msg,omitempty"`  // 回复类型已注册时为解码后的消息
+	Data    []byte      `json:"data,omitempty"` // 回复类型未注册时为原始包体
+}
+
+// HTTPResponse HTTP网关的回复
+type HTTPResponse struct {
+	Replies []HTTPReply `json:"replies"`
+	Closed  bool        `json:"closed"` // handle返回false，TCP连接上会被关闭
+}
+
+type httpError struct {
+	Error string `json:"error"`
+}
+
+// httpConn HTTP请求对应的伪连接，只提供地址
+type httpConn struct {
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *httpConn) Read(b []byte) (int, error)         { return 0, ErrConnClosed }
+func (c *httpConn) Write(b []byte) (int, error)        { return 0, ErrConnClosed }
+func (c *httpConn) Close() error                       { return nil }
+func (c *httpConn) LocalAddr() net.Addr                { return c.local }
+func (c *httpConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *httpConn) SetDeadline(t time.Time) error      { return nil }
+func (c *httpConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *httpConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func newHTTPConn(r *http.Request) *httpConn {
+	c := &httpConn{local: pipeAddr{}, remote: pipeAddr{}}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		c.local = addr
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		c.remote = addr
+	}
+	return c
+}
+
+// HTTPHandler 返回HTTP/JSON网关，用于调试或不支持YY协议的调用方
+// 请求为 POST .../{uri}，JSON包体按uri注册的类型解码后调用对应的handle，
+// handle中通过YYConnect发送的消息作为回复以JSON返回，回复类型在replies中注册时解码为消息，否则返回原始包体
+// 每个请求使用独立的YYConnect，不加入连接管理，不调用ConnectHandle和CloseHandle，
+// handle返回后YYConnect即关闭，之后发送的消息不会返回
+// 设置了SetAuth时每个请求的YYConnect都未认证，只接受Login和AuthConfig.Allow内的URI，其他URI返回401
+func (self *YYServer) HTTPHandler(replies *packet.YYRegister) http.Handler {
+	self.prepare()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeHTTPJSON(w, http.StatusMethodNotAllowed, httpError{"method not allowed"})
+			return
+		}
+		uri, err := strconv.ParseUint(path.Base(r.URL.Path), 10, 32)
+		if err != nil {
+			writeHTTPJSON(w, http.StatusNotFound, httpError{fmt.Sprintf("invalid uri %s", path.Base(r.URL.Path))})
+			return
+		}
+		msg, ok := self.register.New(uint32(uri))
+		if !ok {
+			writeHTTPJSON(w, http.StatusNotFound, httpError{fmt.Sprintf("uri %d not register", uri)})
+			return
+		}
+		if a := self.auth; a != nil && uint32(uri) != a.uri && !a.allow[uint32(uri)] {
+			writeHTTPJSON(w, http.StatusUnauthorized, httpError{ErrUnauthenticated.Error()})
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, packet.MaxPacketLength))
+		if err != nil {
+			writeHTTPJSON(w, http.StatusBadRequest, httpError{err.Error()})
+			return
+		}
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, msg); err != nil {
+				writeHTTPJSON(w, http.StatusBadRequest, httpError{err.Error()})
+				return
+			}
+		}
+
+		resp, err := self.callHTTP(newHTTPConn(r), msg, replies)
+		if err != nil {
+			writeHTTPJSON(w, http.StatusInternalServerError, httpError{err.Error()})
+			return
+		}
+		writeHTTPJSON(w, http.StatusOK, resp)
+	})
+}
+
+// callHTTP 在进程内调用handle，收集handle发送的数据帧
+func (self *YYServer) callHTTP(conn net.Conn, msg packet.Marshallable, replies *packet.YYRegister) (*HTTPResponse, error) {
+	var mut sync.Mutex
+	var frames [][]byte
+	done := false
+
+	yyconn := NewYYConnect(conn)
+	yyconn.capture = func(data []byte) error {
+		mut.Lock()
+		defer mut.Unlock()
+		if done {
+			return ErrConnClosed
+		}
+		frame := make([]byte, len(data))
+		copy(frame, data)
+		frames = append(frames, frame)
+		return nil
+	}
+	resp := &HTTPResponse{Replies: []HTTPReply{}}
+	if self.limit(yyconn, msg.GetURI()) && !self.authenticate(yyconn, msg) {
+		resp.Closed = !self.handleMessage(yyconn, msg)
+	} else {
+		resp.Closed, _ = yyconn.closeReason()
+	}
+	yyconn.closeWith(nil)
+
+	mut.Lock()
+	done = true
+	mut.Unlock()
+	for _, frame := range frames {
+		reply, err := decodeHTTPReply(frame, replies)
+		if err != nil {
+			return nil, err
+		}
+		resp.Replies = append(resp.Replies, reply)
+	}
+	return resp, nil
+}
+
+func decodeHTTPReply(frame []byte, replies *packet.YYRegister) (HTTPReply, error) {
+	header, err := packet.PeekHeader(frame)
+	if err != nil {
+		return HTTPReply{}, err
+	}
+	reply := HTTPReply{URI: header.URI, ResCode: header.ResCode}
+	if replies != nil {
+		if _, ok := replies.New(header.URI); ok {
+			msg, _, err := replies.UnmarshalBytes(frame)
+			if err != nil {
+				return HTTPReply{}, err
+			}
+			reply.Msg = msg
+			return reply, nil
+		}
+	}
+	reply.Data = frame[packet.HeaderLength:]
+	return reply, nil
+}
+
+func writeHTTPJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
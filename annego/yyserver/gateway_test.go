@@ -0,0 +1,102 @@
+package yyserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+)
+
+func postJSON(t *testing.T, url, body string) (int, map[string]interface{}) {
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	var result map[string]interface{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&result))
+	return resp.StatusCode, result
+}
+
+func TestHTTPGateway(t *testing.T) {
+	server := NewYYServer()
+	server.RegisterHandle(new(PTest), func(c *YYConnect, msg packet.Marshallable) bool {
+		req := msg.(*PTest)
+		c.Send(&PTestRes{req.Int, req.Str})
+		c.SendAsync(&PTestRes{req.Int + 1, req.Str})
+		c.Send(&PBig{Data: []byte("raw")})
+		return req.Int != 0
+	})
+	replies := packet.NewYYRegister()
+	replies.Register(new(PTestRes))
+	hs := httptest.NewServer(server.HTTPHandler(replies))
+	defer hs.Close()
+
+	status, result := postJSON(t, hs.URL+"/yy/1", `{"Int": 7, "Str": "abc"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, false, result["closed"])
+	list := result["replies"].([]interface{})
+	assert.Len(t, list, 3)
+	assert.Equal(t, map[string]interface{}{
+		"uri": 2.0, "res_code": 200.0, "msg": map[string]interface{}{"Int": 7.0, "Str": "abc"},
+	}, list[0])
+	assert.Equal(t, map[string]interface{}{"Int": 8.0, "Str": "abc"}, list[1].(map[string]interface{})["msg"])
+	raw := list[2].(map[string]interface{})
+	assert.Equal(t, 3.0, raw["uri"])
+	assert.Nil(t, raw["msg"])
+	assert.Equal(t, packet.MarshalBody(&PBig{Data: []byte("raw")}), mustBase64(t, raw["data"]))
+
+	status, result = postJSON(t, hs.URL+"/yy/1", `{}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, true, result["closed"])
+	// HTTP网关的连接不加入连接管理
+	assert.Equal(t, 0, server.Count())
+
+	status, _ = postJSON(t, hs.URL+"/yy/2", `{}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = postJSON(t, hs.URL+"/yy/abc", `{}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = postJSON(t, hs.URL+"/yy/1", `{"Int": "x"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	resp, err := http.Get(hs.URL + "/yy/1")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestHTTPGatewayAuth(t *testing.T) {
+	server := NewYYServer()
+	assert.Nil(t, server.SetAuth(AuthConfig{Login: new(PLogin), Authenticator: testAuthenticator, Allow: []uint32{3}}))
+	server.RegisterHandle(new(PTest), func(c *YYConnect, msg packet.Marshallable) bool {
+		c.Send(&PTestRes{})
+		return true
+	})
+	server.RegisterHandle(new(PBig), func(c *YYConnect, msg packet.Marshallable) bool {
+		c.Send(&PTestRes{Int: 3})
+		return true
+	})
+	hs := httptest.NewServer(server.HTTPHandler(nil))
+	defer hs.Close()
+
+	// 不在Allow内的URI明确返回401，而不是没有回复
+	status, result := postJSON(t, hs.URL+"/yy/1", `{}`)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, ErrUnauthenticated.Error(), result["error"])
+	status, result = postJSON(t, hs.URL+"/yy/3", `{}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, result["replies"], 1)
+	status, result = postJSON(t, hs.URL+"/yy/10", `{"Token": "secret"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, result["replies"], 1)
+}
+
+func mustBase64(t *testing.T, v interface{}) []byte {
+	data, err := base64.StdEncoding.DecodeString(v.(string))
+	assert.Nil(t, err)
+	return data
+}
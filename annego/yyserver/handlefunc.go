@@ -0,0 +1,121 @@
+package yyserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"goBase/annego/packet"
+)
+
+// ResCoder 处理函数返回的错误实现ResCoder时，回复只有包头的数据帧，不关闭连接
+type ResCoder interface {
+	ResCode() uint16
+}
+
+// CodeError 带ResCode的错误
+type CodeError struct {
+	Code uint16
+	Msg  string
+}
+
+func (e *CodeError) Error() string {
+	return fmt.Sprintf("rescode %d: %s", e.Code, e.Msg)
+}
+
+// ResCode 实现ResCoder
+func (e *CodeError) ResCode() uint16 {
+	return e.Code
+}
+
+var (
+	typeConnect      = reflect.TypeOf((*YYConnect)(nil))
+	typeContext      = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeMarshallable = reflect.TypeOf((*packet.Marshallable)(nil)).Elem()
+	typeError        = reflect.TypeOf((*error)(nil)).Elem()
+	typeBool         = reflect.TypeOf(true)
+)
+
+const errorHandleReturn = "must return bool or (response, error)"
+
+// RegisterFunc 通过函数签名注册消息处理函数，URI和消息类型由参数类型决定，应该在程序启动时调用
+// 支持两种签名，T为实现packet.Marshallable的结构体：
+//
+//	func(*YYConnect, *T) bool 与MessageHandle相同，返回false终止连接
+//	func(context.Context, *YYConnect, *T) (R, error) R实现packet.Marshallable
+//
+// 第二种签名的context在连接关闭时取消，返回的R不为nil时自动发送
+// error实现ResCoder时回复R的URI(R为接口时使用请求的URI)和该ResCode，只有包头，其他error以该error关闭连接
+// 签名不符合或URI已经注册时引起panic
+func (self *YYServer) RegisterFunc(fn interface{}) {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func || v.IsNil() {
+		panic(fmt.Sprintf("YYServer RegisterFunc %v is not a func", t))
+	}
+
+	var proto packet.Marshallable
+	var handle MessageHandle
+	switch t.NumIn() {
+	case 2:
+		if t.In(0) != typeConnect {
+			panic(fmt.Sprintf("YYServer RegisterFunc %v first argument must be *YYConnect", t))
+		}
+		proto = protoOf(t, t.In(1))
+		if t.NumOut() != 1 || t.Out(0) != typeBool {
+			panic(fmt.Sprintf("YYServer RegisterFunc %v %s", t, errorHandleReturn))
+		}
+		handle = func(c *YYConnect, msg packet.Marshallable) bool {
+			out := v.Call([]reflect.Value{reflect.ValueOf(c), reflect.ValueOf(msg)})
+			return out[0].Bool()
+		}
+	case 3:
+		if t.In(0) != typeContext || t.In(1) != typeConnect {
+			panic(fmt.Sprintf("YYServer RegisterFunc %v arguments must be (context.Context, *YYConnect, *T)", t))
+		}
+		proto = protoOf(t, t.In(2))
+		if t.NumOut() != 2 || !t.Out(0).Implements(typeMarshallable) || t.Out(1) != typeError {
+			panic(fmt.Sprintf("YYServer RegisterFunc %v %s", t, errorHandleReturn))
+		}
+		resURI := proto.GetURI()
+		if res := t.Out(0); res.Kind() == reflect.Ptr && res.Elem().Kind() == reflect.Struct {
+			resURI = reflect.New(res.Elem()).Interface().(packet.Marshallable).GetURI()
+		}
+		handle = func(c *YYConnect, msg packet.Marshallable) bool {
+			out := v.Call([]reflect.Value{reflect.ValueOf(c.Context()), reflect.ValueOf(c), reflect.ValueOf(msg)})
+			return c.sendResult(out[0], out[1], resURI)
+		}
+	default:
+		panic(fmt.Sprintf("YYServer RegisterFunc %v unsupported signature", t))
+	}
+	self.RegisterHandle(proto, handle)
+}
+
+// protoOf 检查消息参数类型，返回该类型的实例
+func protoOf(fn reflect.Type, arg reflect.Type) packet.Marshallable {
+	if arg.Kind() != reflect.Ptr || arg.Elem().Kind() != reflect.Struct || !arg.Implements(typeMarshallable) {
+		panic(fmt.Sprintf("YYServer RegisterFunc %v message %v must be a pointer to struct implementing packet.Marshallable", fn, arg))
+	}
+	return reflect.New(arg.Elem()).Interface().(packet.Marshallable)
+}
+
+// sendResult 发送处理函数的返回值
+func (c *YYConnect) sendResult(res reflect.Value, errv reflect.Value, resURI uint32) bool {
+	if !errv.IsNil() {
+		err := errv.Interface().(error)
+		var coder ResCoder
+		if errors.As(err, &coder) {
+			c.sendFrame(packet.PackFrame(resURI, coder.ResCode(), nil))
+			return true
+		}
+		// 由读取错误结束连接，CloseHandle收到记录的关闭原因
+		c.closeWith(err)
+		return true
+	}
+	if (res.Kind() == reflect.Ptr || res.Kind() == reflect.Interface) && res.IsNil() {
+		return true
+	}
+	c.sendFrame(packet.GetMarshalPack(res.Interface().(packet.Marshallable)).Bytes())
+	return true
+}
@@ -0,0 +1,90 @@
+package yyserver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+)
+
+func TestRegisterFuncSignature(t *testing.T) {
+	server := NewYYServer()
+	invalid := []interface{}{
+		nil,
+		1,
+		func(c *YYConnect, msg PTest) bool { return true },
+		func(c *YYConnect, msg *PTest) {},
+		func(msg *PTest, c *YYConnect) bool { return true },
+		func(c *YYConnect, msg *PTest) (*PTestRes, error) { return nil, nil },
+		func(ctx context.Context, c *YYConnect, msg *PTest) *PTestRes { return nil },
+		func(ctx context.Context, c *YYConnect, msg *PTest) (string, error) { return "", nil },
+	}
+	for _, fn := range invalid {
+		assert.Panics(t, func() { server.RegisterFunc(fn) }, "%T", fn)
+	}
+
+	server.RegisterFunc(func(c *YYConnect, msg *PTest) bool { return true })
+	// URI重复
+	assert.Panics(t, func() {
+		server.RegisterFunc(func(ctx context.Context, c *YYConnect, msg *PTest) (*PTestRes, error) { return nil, nil })
+	})
+}
+
+func TestRegisterFunc(t *testing.T) {
+	server := NewYYServer()
+	closed := make(chan error, 1)
+	server.RegisterCloseFunc(func(c *YYConnect, err error) {
+		closed <- err
+	})
+	ctxDone := make(chan struct{})
+	server.RegisterFunc(func(ctx context.Context, c *YYConnect, req *PTest) (*PTestRes, error) {
+		switch req.Str {
+		case "code":
+			return nil, &CodeError{Code: 404, Msg: "not found"}
+		case "close":
+			go func() {
+				<-ctx.Done()
+				close(ctxDone)
+			}()
+			return nil, errors.New("close")
+		case "none":
+			return nil, nil
+		}
+		return &PTestRes{req.Int, req.Str}, nil
+	})
+	server.RegisterFunc(func(c *YYConnect, msg *PBig) bool {
+		return len(msg.Data) > 0
+	})
+	assert.Nil(t, server.Start("127.0.0.1:0"))
+	defer stopServer(server)
+
+	conn, err := Dial("tcp", server.GetListenAddr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetTimeout(5*time.Second, 5*time.Second)
+	assertEcho(t, conn, "hello")
+
+	assert.Nil(t, conn.Send(&PTest{Str: "none"}))
+	assert.Nil(t, conn.Send(&PTest{Str: "code"}))
+	frame, err := conn.recvFrame()
+	assert.Nil(t, err)
+	assert.Equal(t, packet.PackFrame(2, 404, nil), frame)
+	assert.Equal(t, uint32(packet.HeaderLength), binary.LittleEndian.Uint32(frame))
+
+	assert.Nil(t, conn.Send(&PBig{Data: []byte("x")}))
+	assertEcho(t, conn, "after")
+
+	assert.Nil(t, conn.Send(&PTest{Str: "close"}))
+	select {
+	case err := <-closed:
+		assert.EqualError(t, err, "close")
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+	<-ctxDone
+}
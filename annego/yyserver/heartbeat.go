@@ -0,0 +1,78 @@
+package yyserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"goBase/annego/packet"
+)
+
+// ErrIdleTimeout 连接空闲超时，超过IdleTimeout未收到任何数据
+var ErrIdleTimeout = errors.New("yyserver: idle timeout")
+
+// Heartbeat 心跳协议的URI，为0表示不使用
+// 收到PingURI时自动回复相同包体的PongURI，PingURI和PongURI都不会交给Recv的调用者
+type Heartbeat struct {
+	PingURI uint32
+	PongURI uint32
+}
+
+// SetIdleTimeout 设置空闲超时时间，超过该时间未收到任何数据Recv返回ErrIdleTimeout
+// 每次从连接读取数据前都会刷新，可以随时调用，为0表示不检测
+func (c *YYConnect) SetIdleTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&c.idleTimeout, int64(timeout))
+}
+
+// IdleTimeout 返回空闲超时时间
+func (c *YYConnect) IdleTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.idleTimeout))
+}
+
+// SetHeartbeat 设置心跳协议，应该在首次Recv前调用
+func (c *YYConnect) SetHeartbeat(heartbeat Heartbeat) {
+	c.heartbeat = heartbeat
+}
+
+// handleHeartbeat 处理心跳数据帧，返回true表示frame已被处理
+func (c *YYConnect) handleHeartbeat(frame []byte) bool {
+	if !c.isHeartbeat(frame) {
+		return false
+	}
+	if uri := binary.LittleEndian.Uint32(frame[4:8]); uri == c.heartbeat.PingURI && c.heartbeat.PongURI != 0 {
+		pong := packet.PackFrame(c.heartbeat.PongURI, packet.ResSuccess, frame[packet.HeaderLength:])
+		c.sendFrame(pong)
+	}
+	return true
+}
+
+// isHeartbeat 判断数据帧是否为心跳协议
+func (c *YYConnect) isHeartbeat(frame []byte) bool {
+	if c.heartbeat.PingURI == 0 && c.heartbeat.PongURI == 0 {
+		return false
+	}
+	uri := binary.LittleEndian.Uint32(frame[4:8])
+	return uri != 0 && (uri == c.heartbeat.PingURI || uri == c.heartbeat.PongURI)
+}
+
+// keepAlive 定期发送PingURI直到连接关闭，PongURI需要调用者持续Recv才能被读取
+func (c *YYConnect) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	body := make([]byte, 8)
+	for {
+		select {
+		case now := <-ticker.C:
+			binary.LittleEndian.PutUint64(body, uint64(now.UnixNano()))
+			ping := packet.PackFrame(c.heartbeat.PingURI, packet.ResSuccess, body)
+			if err := c.sendFrame(ping); err != nil {
+				c.closeWith(err)
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package yyserver
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+)
+
+var testHeartbeat = Heartbeat{PingURI: 100, PongURI: 101}
+
+func TestServerIdleTimeout(t *testing.T) {
+	closed := make(chan error, 1)
+	server := NewYYServer()
+	server.SetIdleTimeout(100 * time.Millisecond)
+	server.RegisterCloseFunc(func(c *YYConnect, err error) {
+		closed <- err
+	})
+	addr := startEchoServer(t, server)
+
+	conn, err := Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	select {
+	case err := <-closed:
+		assert.Equal(t, ErrIdleTimeout, err)
+	case <-time.After(time.Second):
+		t.Fatal("idle connection not closed")
+	}
+}
+
+func TestHeartbeatKeepAlive(t *testing.T) {
+	closed := make(chan error, 1)
+	server := NewYYServer()
+	server.SetIdleTimeout(150 * time.Millisecond)
+	server.SetHeartbeat(testHeartbeat)
+	server.RegisterCloseFunc(func(c *YYConnect, err error) {
+		closed <- err
+	})
+	addr := startEchoServer(t, server)
+
+	dialer := Dialer{Heartbeat: testHeartbeat, KeepAlive: 30 * time.Millisecond}
+	conn, err := dialer.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	assert.Equal(t, 90*time.Millisecond, conn.IdleTimeout())
+
+	received := make(chan packet.Marshallable)
+	go func() {
+		reg := newTestRegister()
+		for {
+			msg, err := conn.Recv(reg)
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}()
+
+	// 心跳使连接保持，心跳回复不会被Recv返回
+	select {
+	case err := <-closed:
+		t.Fatalf("connection closed by %v", err)
+	case msg := <-received:
+		t.Fatalf("recv unexpected %v", msg)
+	case <-time.After(400 * time.Millisecond):
+	}
+
+	conn.Send(&PTest{Int: 1, Str: "alive"})
+	msg := <-received
+	assert.Equal(t, &PTestRes{Int: 1, Str: "alive"}, msg)
+}
+
+func TestDialIdleTimeout(t *testing.T) {
+	// 只读取不回复的对端
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		c, err := listener.Accept()
+		if err == nil {
+			ioutil.ReadAll(c)
+			c.Close()
+		}
+	}()
+
+	dialer := Dialer{Heartbeat: testHeartbeat, KeepAlive: 20 * time.Millisecond}
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+	start := time.Now()
+	_, err = conn.Recv(newTestRegister())
+	assert.Equal(t, ErrIdleTimeout, err)
+	assert.True(t, time.Since(start) >= 60*time.Millisecond)
+
+	closed, reason := conn.closeReason()
+	assert.True(t, closed)
+	assert.Equal(t, ErrIdleTimeout, reason)
+}
+
+func TestHeartbeatPong(t *testing.T) {
+	client, server := net.Pipe()
+	conn := NewYYConnect(server)
+	defer conn.Close()
+	conn.SetHeartbeat(testHeartbeat)
+	go conn.Recv(newTestRegister())
+
+	ping := packet.PackFrame(testHeartbeat.PingURI, packet.ResSuccess, []byte("12345678"))
+	client.Write(ping)
+
+	peer := NewYYConnect(client)
+	peer.readMut.Lock()
+	frame, _, err := peer.readFrame()
+	peer.readMut.Unlock()
+	assert.Nil(t, err)
+	assert.Equal(t, packet.PackFrame(testHeartbeat.PongURI, packet.ResSuccess, []byte("12345678")), frame)
+}
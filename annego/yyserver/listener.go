@@ -0,0 +1,103 @@
+package yyserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"goBase/annego/logger"
+)
+
+// acceptLoop 接受listener上的连接直到listener关闭，临时错误时等待后重试
+func acceptLoop(listener net.Listener, handle func(net.Conn)) {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err == nil {
+			delay = 0
+			handle(conn)
+			continue
+		}
+
+		if neterr, ok := err.(net.Error); ok && neterr.Temporary() {
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			logger.Warning("accept %v error %v, retry in %v", listener.Addr(), err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		logger.Warning("accept %v error %v, stop accept", listener.Addr(), err)
+		return
+	}
+}
+
+// ListenFD 使用继承的文件描述符创建listener，例如由supervisor传入的fd
+// fd会被复制，调用后原fd可以关闭
+func ListenFD(fd uintptr, name string) (net.Listener, error) {
+	file := os.NewFile(fd, name)
+	if file == nil {
+		return nil, errors.New("yyserver: invalid listen fd")
+	}
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// ErrListenerClosed PipeListener已经关闭
+var ErrListenerClosed = errors.New("yyserver: listener closed")
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// PipeListener 基于net.Pipe的内存listener，用于测试或进程内通信
+type PipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Accept 等待DialContext建立的连接
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *PipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// DialContext 建立到该listener的连接，可以用作Dialer.DialContextFunc，忽略network和address
+func (l *PipeListener) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
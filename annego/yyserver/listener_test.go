@@ -0,0 +1,128 @@
+package yyserver
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+)
+
+func serveEcho(server *YYServer, listener net.Listener) {
+	server.RegisterHandle(new(PTest), func(c *YYConnect, msg packet.Marshallable) bool {
+		req := msg.(*PTest)
+		c.Send(&PTestRes{req.Int, req.Str})
+		return true
+	})
+	server.Serve(listener)
+}
+
+func assertEcho(t *testing.T, conn *YYConnect, str string) {
+	assert.Nil(t, conn.Send(&PTest{Int: 1, Str: str}))
+	msg, err := conn.Recv(newTestRegister())
+	assert.Nil(t, err)
+	assert.Equal(t, &PTestRes{Int: 1, Str: str}, msg)
+}
+
+func TestServeUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yyunix")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "yy.sock")
+
+	listener, err := net.Listen("unix", path)
+	assert.Nil(t, err)
+	defer listener.Close()
+	server := NewYYServer()
+	// Unix域套接字没有IP，不受IP相关准入限制
+	assert.Nil(t, server.SetAdmission(AdmissionConfig{MaxConnPerIP: 1, Allow: []string{"10.0.0.0/8"}}))
+	serveEcho(server, listener)
+	assert.Equal(t, path, server.GetListenAddr().String())
+
+	for i := 0; i < 2; i++ {
+		conn, err := Dial("unix", path)
+		assert.Nil(t, err)
+		defer conn.Close()
+		assertEcho(t, conn, "unix")
+	}
+}
+
+func TestServePipe(t *testing.T) {
+	listener := NewPipeListener()
+	server := NewYYServer()
+	serveEcho(server, listener)
+
+	dialer := Dialer{DialContextFunc: listener.DialContext}
+	conn, err := dialer.Dial("pipe", "")
+	assert.Nil(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, "pipe")
+
+	// 关闭后不再接受连接
+	listener.Close()
+	_, err = dialer.Dial("pipe", "")
+	assert.Equal(t, ErrListenerClosed, err)
+}
+
+func TestDialContextCancel(t *testing.T) {
+	listener := NewPipeListener()
+	defer listener.Close()
+
+	// 没有Accept，建立连接会一直等待
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	dialer := Dialer{DialContextFunc: listener.DialContext}
+	_, err := dialer.DialContext(ctx, "pipe", "")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	dialer.Timeout = 20 * time.Millisecond
+	_, err = dialer.Dial("pipe", "")
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestServeListenFD(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	file, err := tcpListener.(*net.TCPListener).File()
+	assert.Nil(t, err)
+	tcpListener.Close()
+
+	listener, err := ListenFD(file.Fd(), "inherit")
+	assert.Nil(t, err)
+	file.Close()
+	defer listener.Close()
+
+	server := NewYYServer()
+	serveEcho(server, listener)
+	conn, err := Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, "fd")
+}
+
+func TestConsoleServe(t *testing.T) {
+	listener := NewPipeListener()
+	defer listener.Close()
+	console := NewConsole()
+	console.AddCommand("echo", "echo param", func(params []string) string {
+		return strings.Join(params[1:], " ")
+	})
+	console.Serve(listener)
+	assert.Equal(t, 0, console.GetListenPort())
+
+	conn, err := listener.DialContext(context.Background(), "", "")
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.Write([]byte("echo hello console\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "hello console\n", line)
+}
@@ -0,0 +1,369 @@
+package yyserver
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets 延迟直方图的桶上界，单位秒
+var LatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram 固定桶的延迟直方图，并发安全
+type Histogram struct {
+	counts []uint64 // 每个桶的计数，最后一个为+Inf
+	count  uint64
+	sum    int64 // 纳秒
+}
+
+func newHistogram() *Histogram {
+	return &Histogram{counts: make([]uint64, len(LatencyBuckets)+1)}
+}
+
+// Observe 记录一次耗时
+func (h *Histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(LatencyBuckets, seconds)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// HistogramSnapshot 直方图快照，Buckets为每个桶上界对应的累计计数
+type HistogramSnapshot struct {
+	Buckets []uint64 `json:"buckets"`
+	Count   uint64   `json:"count"`
+	Sum     float64  `json:"sum"` // 秒
+}
+
+func (h *Histogram) snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{Buckets: make([]uint64, len(LatencyBuckets))}
+	var total uint64
+	for i := range LatencyBuckets {
+		total += atomic.LoadUint64(&h.counts[i])
+		s.Buckets[i] = total
+	}
+	s.Count = atomic.LoadUint64(&h.count)
+	s.Sum = time.Duration(atomic.LoadInt64(&h.sum)).Seconds()
+	return s
+}
+
+// ConnStats 单个连接的流量统计
+type ConnStats struct {
+	BytesIn     uint64
+	BytesOut    uint64
+	MessagesIn  uint64
+	MessagesOut uint64
+}
+
+// connCounters YYConnect内的原子计数器
+type connCounters struct {
+	bytesIn     uint64
+	bytesOut    uint64
+	messagesIn  uint64
+	messagesOut uint64
+}
+
+// Stats 返回连接收发的字节数和消息数，心跳包含在字节数中但不计入消息数
+func (c *YYConnect) Stats() ConnStats {
+	return ConnStats{
+		BytesIn:     atomic.LoadUint64(&c.counters.bytesIn),
+		BytesOut:    atomic.LoadUint64(&c.counters.bytesOut),
+		MessagesIn:  atomic.LoadUint64(&c.counters.messagesIn),
+		MessagesOut: atomic.LoadUint64(&c.counters.messagesOut),
+	}
+}
+
+// recordIn 记录接收的数据帧，message为false时为心跳
+func (c *YYConnect) recordIn(frame []byte, message bool) {
+	c.record(CaptureIn, frame)
+	bytes := len(frame)
+	atomic.AddUint64(&c.counters.bytesIn, uint64(bytes))
+	if message {
+		atomic.AddUint64(&c.counters.messagesIn, 1)
+	}
+	if c.metrics != nil {
+		atomic.AddUint64(&c.metrics.counters.bytesIn, uint64(bytes))
+		if message {
+			atomic.AddUint64(&c.metrics.counters.messagesIn, 1)
+		}
+	}
+}
+
+// recordOut 记录写入连接的数据帧
+func (c *YYConnect) recordOut(frame []byte) {
+	c.record(CaptureOut, frame)
+	messages := 1
+	if !c.isMessage(frame) {
+		messages = 0
+	}
+	c.recordOutBatch(len(frame), messages)
+}
+
+// recordOutBatch 记录一次写入的字节数和其中的消息数
+func (c *YYConnect) recordOutBatch(bytes int, messages int) {
+	atomic.AddUint64(&c.counters.bytesOut, uint64(bytes))
+	atomic.AddUint64(&c.counters.messagesOut, uint64(messages))
+	if c.metrics != nil {
+		atomic.AddUint64(&c.metrics.counters.bytesOut, uint64(bytes))
+		atomic.AddUint64(&c.metrics.counters.messagesOut, uint64(messages))
+	}
+}
+
+// Metrics YYServer的运行统计，包括所有传输方式上的连接
+// 消息延迟为收到消息到MessageHandle返回的时间，使用工作goroutine时包含排队时间
+type Metrics struct {
+	accepted uint64
+	closed   uint64
+	counters connCounters
+
+	mut     sync.RWMutex
+	uris    map[uint32]*Histogram
+	resCode map[uint16]*Histogram
+
+	limiter *rateLimiter
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		uris:    make(map[uint32]*Histogram),
+		resCode: make(map[uint16]*Histogram),
+	}
+}
+
+func (m *Metrics) connAccepted() {
+	atomic.AddUint64(&m.accepted, 1)
+}
+
+func (m *Metrics) connClosed() {
+	atomic.AddUint64(&m.closed, 1)
+}
+
+// observe 记录消息处理耗时，按请求URI和请求包头的ResCode分别统计
+func (m *Metrics) observe(uri uint32, resCode uint16, d time.Duration) {
+	m.mut.RLock()
+	uh, uok := m.uris[uri]
+	rh, rok := m.resCode[resCode]
+	m.mut.RUnlock()
+	if !uok || !rok {
+		m.mut.Lock()
+		if uh, uok = m.uris[uri]; !uok {
+			uh = newHistogram()
+			m.uris[uri] = uh
+		}
+		if rh, rok = m.resCode[resCode]; !rok {
+			rh = newHistogram()
+			m.resCode[resCode] = rh
+		}
+		m.mut.Unlock()
+	}
+	uh.Observe(d)
+	rh.Observe(d)
+}
+
+// MetricsSnapshot Metrics的快照
+type MetricsSnapshot struct {
+	Accepted    uint64                       `json:"accepted"`
+	Active      uint64                       `json:"active"`
+	Closed      uint64                       `json:"closed"`
+	BytesIn     uint64                       `json:"bytes_in"`
+	BytesOut    uint64                       `json:"bytes_out"`
+	MessagesIn  uint64                       `json:"messages_in"`
+	MessagesOut uint64                       `json:"messages_out"`
+	URILatency  map[uint32]HistogramSnapshot `json:"uri_latency"`
+	CodeLatency map[uint16]HistogramSnapshot `json:"rescode_latency"`
+	RateLimits  map[string]RateLimitStats    `json:"rate_limits,omitempty"`
+}
+
+// Snapshot 返回当前统计
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	closed := atomic.LoadUint64(&m.closed)
+	s := MetricsSnapshot{
+		Accepted:    atomic.LoadUint64(&m.accepted),
+		Closed:      closed,
+		BytesIn:     atomic.LoadUint64(&m.counters.bytesIn),
+		BytesOut:    atomic.LoadUint64(&m.counters.bytesOut),
+		MessagesIn:  atomic.LoadUint64(&m.counters.messagesIn),
+		MessagesOut: atomic.LoadUint64(&m.counters.messagesOut),
+		URILatency:  make(map[uint32]HistogramSnapshot),
+		CodeLatency: make(map[uint16]HistogramSnapshot),
+	}
+	s.Active = s.Accepted - closed
+	if m.limiter != nil {
+		s.RateLimits = m.limiter.stats()
+	}
+
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	for uri, h := range m.uris {
+		s.URILatency[uri] = h.snapshot()
+	}
+	for code, h := range m.resCode {
+		s.CodeLatency[code] = h.snapshot()
+	}
+	return s
+}
+
+// WritePrometheus 以Prometheus文本格式输出统计，name为指标名前缀
+func (m *Metrics) WritePrometheus(w io.Writer, name string) error {
+	s := m.Snapshot()
+	var b strings.Builder
+	counter := func(metric, help string, value uint64) {
+		fmt.Fprintf(&b, "# HELP %s_%s %s\n# TYPE %s_%s counter\n%s_%s %d\n",
+			name, metric, help, name, metric, name, metric, value)
+	}
+	counter("connections_accepted_total", "Accepted connections.", s.Accepted)
+	counter("connections_closed_total", "Closed connections.", s.Closed)
+	fmt.Fprintf(&b, "# HELP %s_connections_active Active connections.\n# TYPE %s_connections_active gauge\n%s_connections_active %d\n",
+		name, name, name, s.Active)
+	counter("received_bytes_total", "Bytes received.", s.BytesIn)
+	counter("sent_bytes_total", "Bytes sent.", s.BytesOut)
+	counter("received_messages_total", "Messages received.", s.MessagesIn)
+	counter("sent_messages_total", "Messages sent.", s.MessagesOut)
+
+	uris := make([]uint32, 0, len(s.URILatency))
+	for uri := range s.URILatency {
+		uris = append(uris, uri)
+	}
+	sort.Slice(uris, func(i, j int) bool { return uris[i] < uris[j] })
+	metric := name + "_handle_duration_seconds"
+	fmt.Fprintf(&b, "# HELP %s Message handle latency by uri.\n# TYPE %s histogram\n", metric, metric)
+	for _, uri := range uris {
+		writeHistogram(&b, metric, fmt.Sprintf("uri=\"%d\"", uri), s.URILatency[uri])
+	}
+
+	codes := make([]uint16, 0, len(s.CodeLatency))
+	for code := range s.CodeLatency {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	metric = name + "_handle_duration_by_rescode_seconds"
+	fmt.Fprintf(&b, "# HELP %s Message handle latency by rescode.\n# TYPE %s histogram\n", metric, metric)
+	for _, code := range codes {
+		writeHistogram(&b, metric, fmt.Sprintf("rescode=\"%d\"", code), s.CodeLatency[code])
+	}
+	writeRateLimits(&b, name, s.RateLimits)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeRateLimits(b *strings.Builder, name string, stats map[string]RateLimitStats) {
+	if len(stats) == 0 {
+		return
+	}
+	rules := make([]string, 0, len(stats))
+	for rule := range stats {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	metrics := []struct {
+		metric, help, kind string
+		value              func(RateLimitStats) float64
+	}{
+		{"ratelimit_allowed_total", "Messages allowed by rate limit rule.", "counter", func(s RateLimitStats) float64 { return float64(s.Allowed) }},
+		{"ratelimit_limited_total", "Messages limited by rate limit rule.", "counter", func(s RateLimitStats) float64 { return float64(s.Limited) }},
+		{"ratelimit_rate", "Tokens per second of rate limit rule.", "gauge", func(s RateLimitStats) float64 { return s.Rate }},
+		{"ratelimit_buckets", "Shared token buckets of rate limit rule.", "gauge", func(s RateLimitStats) float64 { return float64(s.Buckets) }},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(b, "# HELP %s_%s %s\n# TYPE %s_%s %s\n", name, m.metric, m.help, name, m.metric, m.kind)
+		for _, rule := range rules {
+			fmt.Fprintf(b, "%s_%s{rule=\"%s\"} %g\n", name, m.metric, rule, m.value(stats[rule]))
+		}
+	}
+	metric := name + "_ratelimit_tokens"
+	fmt.Fprintf(b, "# HELP %s Available tokens of uri rate limit rule.\n# TYPE %s gauge\n", metric, metric)
+	for _, rule := range rules {
+		tokens := stats[rule].Tokens
+		uris := make([]uint32, 0, len(tokens))
+		for uri := range tokens {
+			uris = append(uris, uri)
+		}
+		sort.Slice(uris, func(i, j int) bool { return uris[i] < uris[j] })
+		for _, uri := range uris {
+			fmt.Fprintf(b, "%s{rule=\"%s\",uri=\"%d\"} %g\n", metric, rule, uri, tokens[uri])
+		}
+	}
+}
+
+func writeHistogram(b *strings.Builder, metric, label string, h HistogramSnapshot) {
+	for i, le := range LatencyBuckets {
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"%g\"} %d\n", metric, label, le, h.Buckets[i])
+	}
+	fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", metric, label, h.Count)
+	fmt.Fprintf(b, "%s_sum{%s} %g\n", metric, label, h.Sum)
+	fmt.Fprintf(b, "%s_count{%s} %d\n", metric, label, h.Count)
+}
+
+// Metrics 返回服务的运行统计
+func (self *YYServer) Metrics() *Metrics {
+	return self.metrics
+}
+
+// PublishExpvar 将统计发布到expvar，name重复时expvar引起panic
+func (self *YYServer) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return self.metrics.Snapshot()
+	}))
+}
+
+// MetricsHandler 返回Prometheus文本格式的统计，name为指标名前缀，为空时使用yyserver
+func (self *YYServer) MetricsHandler(name string) http.Handler {
+	if name == "" {
+		name = "yyserver"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		self.metrics.WritePrometheus(w, name)
+	})
+}
+
+// statsText Console stats命令的输出
+func (self *YYServer) statsText() string {
+	s := self.metrics.Snapshot()
+	var b strings.Builder
+	fmt.Fprintf(&b, "connections accepted %d active %d closed %d\n", s.Accepted, s.Active, s.Closed)
+	fmt.Fprintf(&b, "bytes in %d out %d\n", s.BytesIn, s.BytesOut)
+	fmt.Fprintf(&b, "messages in %d out %d\n", s.MessagesIn, s.MessagesOut)
+
+	uris := make([]uint32, 0, len(s.URILatency))
+	for uri := range s.URILatency {
+		uris = append(uris, uri)
+	}
+	sort.Slice(uris, func(i, j int) bool { return uris[i] < uris[j] })
+	for _, uri := range uris {
+		h := s.URILatency[uri]
+		fmt.Fprintf(&b, "uri %d count %d avg %v\n", uri, h.Count, averageLatency(h))
+	}
+	codes := make([]uint16, 0, len(s.CodeLatency))
+	for code := range s.CodeLatency {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	for _, code := range codes {
+		h := s.CodeLatency[code]
+		fmt.Fprintf(&b, "rescode %d count %d avg %v\n", code, h.Count, averageLatency(h))
+	}
+	return b.String()
+}
+
+func averageLatency(h HistogramSnapshot) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return time.Duration(h.Sum / float64(h.Count) * float64(time.Second))
+}
+
+// AddStatsCommand 添加stats命令，输出server的运行统计
+func (self *Console) AddStatsCommand(server *YYServer) {
+	self.AddCommand("stats", "print server stats, usage: stats", func([]string) string {
+		return server.statsText()
+	})
+}
@@ -0,0 +1,134 @@
+package yyserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram()
+	h.Observe(50 * time.Microsecond)
+	h.Observe(time.Millisecond)
+	h.Observe(time.Minute)
+	s := h.snapshot()
+	assert.Equal(t, uint64(3), s.Count)
+	assert.Equal(t, uint64(1), s.Buckets[0])
+	// 上界包含等于的值
+	assert.Equal(t, uint64(2), s.Buckets[2])
+	assert.Equal(t, uint64(2), s.Buckets[len(LatencyBuckets)-1])
+	assert.InDelta(t, 60.00105, s.Sum, 1e-9)
+}
+
+func TestServerMetrics(t *testing.T) {
+	server := NewYYServer()
+	server.SetHeartbeat(testHeartbeat)
+	addr := startEchoServer(t, server)
+
+	conn, err := Dial("tcp", addr)
+	assert.Nil(t, err)
+	conn.SetTimeout(5*time.Second, 5*time.Second)
+	conn.SetHeartbeat(testHeartbeat)
+	reg := newTestRegister()
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, conn.Send(&PTest{uint32(i), "abc"}))
+		_, err := conn.Recv(reg)
+		assert.Nil(t, err)
+	}
+	// 心跳只计入字节数
+	assert.Nil(t, conn.writeFrame(packet.PackFrame(testHeartbeat.PingURI, 201, nil)))
+	assert.Nil(t, conn.writeFrame(packet.PackFrame(1, 500, packet.MarshalBody(&PTest{9, "x"}))))
+	_, err = conn.Recv(reg)
+	assert.Nil(t, err)
+
+	stats := conn.Stats()
+	assert.Equal(t, uint64(4), stats.MessagesOut)
+	assert.Equal(t, uint64(4), stats.MessagesIn)
+
+	assert.Eventually(t, func() bool {
+		s := server.Metrics().Snapshot()
+		return s.BytesOut == stats.BytesIn && s.BytesIn == stats.BytesOut
+	}, 5*time.Second, 10*time.Millisecond)
+	s := server.Metrics().Snapshot()
+	assert.Equal(t, uint64(1), s.Accepted)
+	assert.Equal(t, uint64(1), s.Active)
+	assert.Equal(t, uint64(4), s.MessagesIn)
+	assert.Equal(t, uint64(4), s.MessagesOut)
+	assert.Equal(t, uint64(4), s.URILatency[1].Count)
+	assert.Equal(t, uint64(3), s.CodeLatency[packet.ResSuccess].Count)
+	assert.Equal(t, uint64(1), s.CodeLatency[500].Count)
+
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		s := server.Metrics().Snapshot()
+		return s.Closed == 1 && s.Active == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMetricsExport(t *testing.T) {
+	server := NewYYServer()
+	server.SetDispatch(DispatchConfig{Mode: DispatchPool, Workers: 2})
+	addr := startEchoServer(t, server)
+	conn, err := Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, "metrics")
+	assert.Eventually(t, func() bool {
+		return server.Metrics().Snapshot().URILatency[1].Count == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// expvar名字不能重复发布
+	name := fmt.Sprintf("yyserver_metrics_test_%d", time.Now().UnixNano())
+	server.PublishExpvar(name)
+	var exported MetricsSnapshot
+	assert.Nil(t, json.Unmarshal([]byte(expvar.Get(name).String()), &exported))
+	assert.Equal(t, uint64(1), exported.Accepted)
+	assert.Equal(t, uint64(1), exported.URILatency[1].Count)
+
+	hs := httptest.NewServer(server.MetricsHandler(""))
+	defer hs.Close()
+	resp, err := hs.Client().Get(hs.URL)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	text := string(body)
+	assert.Contains(t, text, "yyserver_connections_accepted_total 1\n")
+	assert.Contains(t, text, "yyserver_connections_active 1\n")
+	assert.Contains(t, text, "yyserver_received_messages_total 1\n")
+	assert.Contains(t, text, "yyserver_handle_duration_seconds_bucket{uri=\"1\",le=\"+Inf\"} 1\n")
+	assert.Contains(t, text, "yyserver_handle_duration_seconds_count{uri=\"1\"} 1\n")
+	assert.Contains(t, text, "yyserver_handle_duration_by_rescode_seconds_count{rescode=\"200\"} 1\n")
+}
+
+func TestConsoleStats(t *testing.T) {
+	server := NewYYServer()
+	addr := startEchoServer(t, server)
+	conn, err := Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	assertEcho(t, conn, "stats")
+
+	console := NewConsole()
+	console.AddStatsCommand(server)
+	assert.Nil(t, console.Start("127.0.0.1:0"))
+	c, err := net.Dial("tcp", console.listener.Addr().String())
+	assert.Nil(t, err)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("stats\n"))
+	reader := bufio.NewReader(c)
+	line, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(line, "connections accepted 1 active 1 closed 0"), line)
+}
@@ -0,0 +1,655 @@
+package yyserver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"goBase/annego/logger"
+	"goBase/annego/packet"
+)
+
+const (
+	// DefaultMuxWindow 未设置时每个流的接收窗口
+	DefaultMuxWindow = 256 * 1024
+	// DefaultMuxMaxStreams 未设置时单个连接同时打开的流的上限
+	DefaultMuxMaxStreams = 256
+	// DefaultMuxTimeout 未设置时Dialer等待协商回复的时间
+	DefaultMuxTimeout = 5 * time.Second
+
+	// muxHeaderLength 流数据帧包体开头的流ID和类型
+	muxHeaderLength = 5
+	// muxFrameSize 单个流数据帧携带的最大数据长度
+	muxFrameSize = 16 * 1024
+)
+
+// 流数据帧的类型
+const (
+	muxHello  byte = iota // 协商，携带接收窗口和流的上限
+	muxOpen               // 打开流
+	muxData               // 流上的数据
+	muxWindow             // 增加对端的发送窗口
+	muxClose              // 关闭流，之后不再收发数据
+	muxReset              // 拒绝打开流
+)
+
+var (
+	// ErrMuxUnsupported 连接没有协商流多路复用，或者对端不支持
+	ErrMuxUnsupported = errors.New("yyserver: stream multiplexing not negotiated")
+	// ErrMuxProtocol 对端发送的流数据帧不符合协议，关闭连接
+	ErrMuxProtocol = errors.New("yyserver: stream multiplexing protocol error")
+	// ErrTooManyStreams 打开的流超过MuxConfig.MaxStreams
+	ErrTooManyStreams = errors.New("yyserver: too many streams")
+	// ErrStreamReset 对端拒绝打开流
+	ErrStreamReset = errors.New("yyserver: stream reset by peer")
+	// ErrStreamClosed 对端已经关闭流
+	ErrStreamClosed = errors.New("yyserver: stream closed by peer")
+)
+
+// MuxConfig 流多路复用配置，两端需要使用相同的URI，UDP连接不生效
+// 一个连接上可以打开多个流，每个流有单独的消息顺序、流量控制和关闭
+// 客户端建立连接时协商，没有协商的连接与未设置时相同
+type MuxConfig struct {
+	// URI 流数据帧的URI，为0表示不使用，不能与业务协议的URI相同
+	URI uint32
+
+	// Window 每个流的接收窗口，对端最多发送Window字节未被读取的数据，为0使用DefaultMuxWindow
+	Window int
+
+	// MaxStreams 单个连接同时打开的流的上限，为0使用DefaultMuxMaxStreams
+	// 客户端使用两端中较小的值
+	MaxStreams int
+
+	// Timeout Dialer等待协商回复的时间，DialContext的ctx有期限时使用ctx的期限，为0使用DefaultMuxTimeout
+	Timeout time.Duration
+}
+
+// streamTimeout 流的读写超过期限，实现net.Error
+type streamTimeout struct{}
+
+func (streamTimeout) Error() string   { return "yyserver: stream i/o timeout" }
+func (streamTimeout) Timeout() bool   { return true }
+func (streamTimeout) Temporary() bool { return true }
+
+// muxSession 连接上的流，流ID为奇数，由客户端打开
+type muxSession struct {
+	conn   *YYConnect
+	config MuxConfig
+	client bool
+	accept func(*YYConnect) // 服务端处理对端打开的流
+
+	mut        sync.Mutex
+	ready      bool
+	peerWindow int
+	maxStreams int
+	streams    map[uint32]*muxStream
+	lastID     uint32 // 最后打开的流ID
+	closed     bool
+}
+
+func newMuxSession(conn *YYConnect, config MuxConfig, client bool) *muxSession {
+	if config.Window <= 0 {
+		config.Window = DefaultMuxWindow
+	}
+	if config.MaxStreams <= 0 {
+		config.MaxStreams = DefaultMuxMaxStreams
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultMuxTimeout
+	}
+	return &muxSession{conn: conn, config: config, client: client,
+		maxStreams: config.MaxStreams, streams: make(map[uint32]*muxStream)}
+}
+
+// SetMux 设置流多路复用，应该在程序启动时调用，URI为0或者已经注册时返回error
+// 客户端通过Dialer.Mux协商后可以打开流，没有协商的连接不受影响
+// 每个流在单独的goroutine中按顺序处理，MessageHandle收到的YYConnect为该流，通过它发送的消息回复在同一个流上
+func (self *YYServer) SetMux(config MuxConfig) error {
+	if self.running {
+		panic("YYServer is runing")
+	}
+	if config.URI == 0 {
+		return fmt.Errorf("yyserver: mux uri is 0")
+	}
+	if _, ok := self.register.New(config.URI); ok {
+		return fmt.Errorf("yyserver: mux uri %d has register", config.URI)
+	}
+	self.mux = config
+	return nil
+}
+
+// acceptStream 按服务的配置设置对端打开的流，并开始处理流上的消息
+func (self *YYServer) acceptStream(stream *YYConnect) {
+	if self.sendQueueSize > 0 {
+		stream.SetSendQueue(self.sendQueueSize, self.sendQueuePolicy)
+	}
+	stream.SetReadBuffer(self.readBuffer)
+	go self.serveStream(stream)
+}
+
+// serveStream 按顺序处理流上的消息，对端关闭流或MessageHandle返回false时关闭流
+// 流不调用ConnectHandle和CloseHandle，认证和按连接的限流使用所在的连接
+func (self *YYServer) serveStream(stream *YYConnect) {
+	for {
+		msg, info, err := stream.recv(self.register)
+		if err != nil {
+			break
+		}
+		if !self.handleRecv(stream, msg, info) {
+			break
+		}
+	}
+	stream.pending.Wait()
+	stream.closeWith(nil)
+}
+
+// negotiateMux 发送协商并等待对端的回复，应该在连接建立后、首次收发前调用
+// 对端在回复之前发送的消息（如ConnectHandle中发送的）保存下来，由之后的Recv返回
+// 对端未设置Mux时会关闭连接，返回ErrMuxUnsupported
+func (c *YYConnect) negotiateMux(ctx context.Context, config MuxConfig) error {
+	m := newMuxSession(c, config, true)
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(m.config.Timeout)
+	}
+	if err := m.send(0, muxHello, m.hello()); err != nil {
+		return err
+	}
+
+	c.readMut.Lock()
+	defer c.readMut.Unlock()
+	var body []byte
+	var early [][]byte
+	for {
+		frame, whole, err := c.readFrameBefore(deadline)
+		if err != nil {
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				return err
+			}
+			return ErrMuxUnsupported
+		}
+		if binary.LittleEndian.Uint32(frame[4:8]) == m.config.URI {
+			body = frame[packet.HeaderLength:]
+			break
+		}
+		if !whole {
+			frame = append([]byte(nil), frame...)
+		}
+		early = append(early, frame)
+	}
+	c.early = early
+	if len(body) != muxHeaderLength+8 || body[4] != muxHello {
+		return ErrMuxUnsupported
+	}
+	window := int(binary.LittleEndian.Uint32(body[5:9]))
+	streams := int(binary.LittleEndian.Uint32(body[9:13]))
+	if window <= 0 {
+		return ErrMuxProtocol
+	}
+	m.ready = true
+	m.peerWindow = window
+	if streams > 0 && streams < m.maxStreams {
+		m.maxStreams = streams
+	}
+	c.mux = m
+	return nil
+}
+
+// OpenStream 在连接上打开一个新的流，返回的YYConnect用于在该流上收发消息，关闭时只关闭该流
+// 需要Dialer.Mux协商成功，只有客户端可以打开流
+// 流上的数据由连接的读取分发，需要有goroutine持续调用连接的Recv
+func (c *YYConnect) OpenStream() (*YYConnect, error) {
+	m := c.mux
+	if m == nil || !m.client {
+		return nil, ErrMuxUnsupported
+	}
+	m.mut.Lock()
+	if m.closed {
+		m.mut.Unlock()
+		return nil, ErrConnClosed
+	}
+	if len(m.streams) >= m.maxStreams {
+		m.mut.Unlock()
+		return nil, ErrTooManyStreams
+	}
+	id := m.lastID + 2
+	if m.lastID == 0 {
+		id = 1
+	}
+	m.lastID = id
+	st := m.newStream(id)
+	m.mut.Unlock()
+	if err := m.send(st.id, muxOpen, nil); err != nil {
+		m.remove(st)
+		return nil, err
+	}
+	return newStreamConnect(st), nil
+}
+
+// StreamID 返回流ID，不是流时返回0
+func (c *YYConnect) StreamID() uint32 {
+	if c.stream == nil {
+		return 0
+	}
+	return c.stream.id
+}
+
+// Parent 返回流所在的连接，不是流时返回nil
+func (c *YYConnect) Parent() *YYConnect {
+	if c.stream == nil {
+		return nil
+	}
+	return c.stream.session.conn
+}
+
+// root 返回流所在的连接，不是流时返回自身
+func (c *YYConnect) root() *YYConnect {
+	if c.stream == nil {
+		return c
+	}
+	return c.stream.session.conn
+}
+
+// isMux 判断数据帧是否为流数据帧
+func (c *YYConnect) isMux(frame []byte) bool {
+	return c.mux != nil && binary.LittleEndian.Uint32(frame[4:8]) == c.mux.config.URI
+}
+
+// handleMux 处理流数据帧，返回true表示frame已被处理，不符合协议时以ErrMuxProtocol关闭连接
+func (c *YYConnect) handleMux(frame []byte) bool {
+	if !c.isMux(frame) {
+		return false
+	}
+	if err := c.mux.handle(frame[packet.HeaderLength:]); err != nil {
+		logger.Warning("conn %v mux error %v", c.RemoteAddr(), err)
+		c.closeWith(err)
+	}
+	return true
+}
+
+func (m *muxSession) hello() []byte {
+	payload := make([]byte, 8)
+	binary.LittleEndian.PutUint32(payload[0:4], uint32(m.config.Window))
+	binary.LittleEndian.PutUint32(payload[4:8], uint32(m.config.MaxStreams))
+	return payload
+}
+
+// send 发送流数据帧
+func (m *muxSession) send(id uint32, kind byte, payload []byte) error {
+	body := make([]byte, muxHeaderLength+len(payload))
+	binary.LittleEndian.PutUint32(body[0:4], id)
+	body[4] = kind
+	copy(body[muxHeaderLength:], payload)
+	return m.conn.writeFrame(packet.PackFrame(m.config.URI, packet.ResSuccess, body))
+}
+
+// handle 处理收到的流数据帧，在连接的读goroutine中执行，不能等待
+func (m *muxSession) handle(body []byte) error {
+	if len(body) < muxHeaderLength {
+		return ErrMuxProtocol
+	}
+	id := binary.LittleEndian.Uint32(body[0:4])
+	kind := body[4]
+	payload := body[muxHeaderLength:]
+	if kind == muxHello {
+		return m.handleHello(payload)
+	}
+
+	m.mut.Lock()
+	ready := m.ready
+	st := m.streams[id]
+	m.mut.Unlock()
+	if !ready {
+		return ErrMuxProtocol
+	}
+	// 已经关闭的流上的数据帧被忽略
+	switch kind {
+	case muxOpen:
+		return m.handleOpen(id)
+	case muxData:
+		if st != nil {
+			return st.receive(payload)
+		}
+	case muxWindow:
+		if len(payload) != 4 {
+			return ErrMuxProtocol
+		}
+		if st != nil {
+			st.grant(int(binary.LittleEndian.Uint32(payload)))
+		}
+	case muxClose:
+		if st != nil {
+			m.remove(st)
+			st.remoteClose()
+		}
+	case muxReset:
+		if st != nil {
+			m.remove(st)
+			st.fail(ErrStreamReset)
+		}
+	default:
+		return ErrMuxProtocol
+	}
+	return nil
+}
+
+// handleHello 服务端收到协商，回复自己的配置
+func (m *muxSession) handleHello(payload []byte) error {
+	if m.client || len(payload) != 8 {
+		return ErrMuxProtocol
+	}
+	window := int(binary.LittleEndian.Uint32(payload[0:4]))
+	if window <= 0 {
+		return ErrMuxProtocol
+	}
+	m.mut.Lock()
+	if m.ready {
+		m.mut.Unlock()
+		return ErrMuxProtocol
+	}
+	m.ready = true
+	m.peerWindow = window
+	m.mut.Unlock()
+	return m.send(0, muxHello, m.hello())
+}
+
+// handleOpen 服务端收到打开流，超过MaxStreams时拒绝
+func (m *muxSession) handleOpen(id uint32) error {
+	if m.client || id%2 == 0 {
+		return ErrMuxProtocol
+	}
+	m.mut.Lock()
+	if id <= m.lastID {
+		m.mut.Unlock()
+		return ErrMuxProtocol
+	}
+	m.lastID = id
+	if m.closed {
+		m.mut.Unlock()
+		return nil
+	}
+	if len(m.streams) >= m.maxStreams {
+		m.mut.Unlock()
+		m.send(id, muxReset, nil)
+		return nil
+	}
+	st := m.newStream(id)
+	m.mut.Unlock()
+	m.accept(newStreamConnect(st))
+	return nil
+}
+
+// newStream 调用时需持有mut
+func (m *muxSession) newStream(id uint32) *muxStream {
+	st := &muxStream{
+		id:         id,
+		session:    m,
+		window:     m.config.Window,
+		recvWindow: m.config.Window,
+		sendWindow: m.peerWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+	m.streams[id] = st
+	return st
+}
+
+func (m *muxSession) remove(st *muxStream) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.streams[st.id] == st {
+		delete(m.streams, st.id)
+	}
+}
+
+// close 连接关闭时结束所有的流
+func (m *muxSession) close() {
+	m.mut.Lock()
+	m.closed = true
+	streams := m.streams
+	m.streams = make(map[uint32]*muxStream)
+	m.mut.Unlock()
+	for _, st := range streams {
+		st.fail(ErrConnClosed)
+	}
+}
+
+// muxStream 流的伪连接，作为流上YYConnect的net.Conn
+// 写入的数据在发送窗口内拆分为流数据帧发送，读取的数据由连接的读取分发
+type muxStream struct {
+	id      uint32
+	session *muxSession
+	window  int
+
+	mut           sync.Mutex
+	buf           []byte // 收到未读取的数据
+	recvWindow    int    // 对端还可以发送的数据长度
+	consumed      int    // 已读取但未增加对端发送窗口的数据长度
+	sendWindow    int    // 还可以发送的数据长度
+	localClosed   bool
+	remoteClosed  bool
+	err           error // 连接关闭或对端拒绝
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readable      chan struct{}
+	writable      chan struct{}
+}
+
+func newStreamConnect(st *muxStream) *YYConnect {
+	c := NewYYConnect(st)
+	c.stream = st
+	return c
+}
+
+// Read 调用者持有YYConnect.readMut，不会并发调用
+// 读取的数据超过接收窗口的一半时增加对端的发送窗口
+func (s *muxStream) Read(b []byte) (int, error) {
+	for {
+		s.mut.Lock()
+		if s.localClosed {
+			s.mut.Unlock()
+			return 0, ErrConnClosed
+		}
+		if len(s.buf) > 0 {
+			n := copy(b, s.buf)
+			s.buf = s.buf[n:]
+			if len(s.buf) == 0 {
+				s.buf = nil
+			}
+			s.consumed += n
+			grant := 0
+			if s.consumed >= s.window/2 && !s.remoteClosed {
+				grant = s.consumed
+				s.recvWindow += grant
+				s.consumed = 0
+			}
+			s.mut.Unlock()
+			if grant > 0 {
+				payload := make([]byte, 4)
+				binary.LittleEndian.PutUint32(payload, uint32(grant))
+				s.session.send(s.id, muxWindow, payload)
+			}
+			return n, nil
+		}
+		if s.err != nil {
+			s.mut.Unlock()
+			return 0, s.err
+		}
+		if s.remoteClosed {
+			s.mut.Unlock()
+			return 0, io.EOF
+		}
+		deadline := s.readDeadline
+		s.mut.Unlock()
+		if err := waitStream(s.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write 调用者持有YYConnect.writeMut，不会并发调用
+// 发送窗口用完时等待对端读取
+func (s *muxStream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		s.mut.Lock()
+		var err error
+		switch {
+		case s.localClosed:
+			err = ErrConnClosed
+		case s.err != nil:
+			err = s.err
+		case s.remoteClosed:
+			err = ErrStreamClosed
+		}
+		if err != nil {
+			s.mut.Unlock()
+			return written, err
+		}
+		if s.sendWindow <= 0 {
+			deadline := s.writeDeadline
+			s.mut.Unlock()
+			if err := waitStream(s.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := len(b)
+		if n > s.sendWindow {
+			n = s.sendWindow
+		}
+		if n > muxFrameSize {
+			n = muxFrameSize
+		}
+		s.sendWindow -= n
+		s.mut.Unlock()
+		if err := s.session.send(s.id, muxData, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close 关闭流，对端之后的读取返回io.EOF
+func (s *muxStream) Close() error {
+	s.mut.Lock()
+	if s.localClosed {
+		s.mut.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	s.buf = nil
+	notify := s.err == nil && !s.remoteClosed
+	s.mut.Unlock()
+	s.wake()
+	s.session.remove(s)
+	if notify {
+		return s.session.send(s.id, muxClose, nil)
+	}
+	return nil
+}
+
+// receive 收到流上的数据，超过接收窗口时返回ErrMuxProtocol
+func (s *muxStream) receive(data []byte) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.localClosed || s.err != nil {
+		return nil
+	}
+	if len(data) > s.recvWindow {
+		return ErrMuxProtocol
+	}
+	s.recvWindow -= len(data)
+	s.buf = append(s.buf, data...)
+	signalStream(s.readable)
+	return nil
+}
+
+func (s *muxStream) grant(n int) {
+	s.mut.Lock()
+	s.sendWindow += n
+	s.mut.Unlock()
+	signalStream(s.writable)
+}
+
+func (s *muxStream) remoteClose() {
+	s.mut.Lock()
+	s.remoteClosed = true
+	s.mut.Unlock()
+	s.wake()
+}
+
+// fail 结束流，未读取的数据被丢弃
+func (s *muxStream) fail(err error) {
+	s.mut.Lock()
+	if s.err == nil {
+		s.err = err
+		s.buf = nil
+	}
+	s.mut.Unlock()
+	s.wake()
+}
+
+func (s *muxStream) wake() {
+	signalStream(s.readable)
+	signalStream(s.writable)
+}
+
+func (s *muxStream) LocalAddr() net.Addr  { return s.session.conn.LocalAddr() }
+func (s *muxStream) RemoteAddr() net.Addr { return s.session.conn.RemoteAddr() }
+
+func (s *muxStream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *muxStream) SetReadDeadline(t time.Time) error {
+	s.mut.Lock()
+	s.readDeadline = t
+	s.mut.Unlock()
+	signalStream(s.readable)
+	return nil
+}
+
+func (s *muxStream) SetWriteDeadline(t time.Time) error {
+	s.mut.Lock()
+	s.writeDeadline = t
+	s.mut.Unlock()
+	signalStream(s.writable)
+	return nil
+}
+
+// signalStream 唤醒等待ch的goroutine，没有等待时保留一次
+func signalStream(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// waitStream 等待ch被唤醒，超过deadline时返回streamTimeout
+func waitStream(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return streamTimeout{}
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return streamTimeout{}
+	}
+}
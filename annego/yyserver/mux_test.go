@@ -0,0 +1,220 @@
+package yyserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+)
+
+const testMuxURI = 101
+
+// startMuxServer 启动设置了Mux的回显服务，PBig回复收到的流ID，Data为空时关闭流
+func startMuxServer(t *testing.T, engine Engine, config MuxConfig) (*YYServer, string) {
+	server := NewYYServer()
+	assert.Nil(t, server.SetEngine(engine, 1))
+	assert.Nil(t, server.SetMux(config))
+	server.RegisterHandle(new(PBig), func(c *YYConnect, msg packet.Marshallable) bool {
+		if len(msg.(*PBig).Data) == 0 {
+			return false
+		}
+		c.Send(&PTestRes{c.StreamID(), c.RemoteAddr().String()})
+		return true
+	})
+	return server, startEchoServer(t, server)
+}
+
+// dialMux 建立协商了Mux的连接，并在goroutine中读取连接，收到的消息写入返回的channel
+func dialMux(t *testing.T, addr string, config MuxConfig) (*YYConnect, chan packet.Marshallable) {
+	d := Dialer{Mux: config}
+	conn, err := d.Dial("tcp", addr)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	msgs := make(chan packet.Marshallable, 16)
+	go func() {
+		defer close(msgs)
+		for {
+			msg, err := conn.Recv(newTestRegister())
+			if err != nil {
+				return
+			}
+			msgs <- msg
+		}
+	}()
+	return conn, msgs
+}
+
+func openStream(t *testing.T, conn *YYConnect) *YYConnect {
+	stream, err := conn.OpenStream()
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	stream.SetTimeout(2*time.Second, 2*time.Second)
+	return stream
+}
+
+func TestServerMux(t *testing.T) {
+	for _, engine := range []Engine{EngineGoroutine, EngineEventLoop} {
+		config := MuxConfig{URI: testMuxURI}
+		server, addr := startMuxServer(t, engine, config)
+		conn, msgs := dialMux(t, addr, config)
+
+		// 回复在消息所在的流上，流之间互不影响
+		a := openStream(t, conn)
+		b := openStream(t, conn)
+		assert.Equal(t, uint32(1), a.StreamID())
+		assert.Equal(t, uint32(3), b.StreamID())
+		for i := 0; i < 3; i++ {
+			assertEcho(t, b, "b")
+			assertEcho(t, a, "a")
+		}
+		assert.Nil(t, a.Send(&PBig{Data: []byte{1}}))
+		msg, err := a.Recv(newTestRegister())
+		assert.Nil(t, err)
+		assert.Equal(t, a.StreamID(), msg.(*PTestRes).Int)
+		assert.Equal(t, conn.LocalAddr().String(), msg.(*PTestRes).Str)
+
+		// 连接本身的消息不在流上
+		assert.Nil(t, conn.Send(&PBig{Data: []byte{1}}))
+		assert.Equal(t, uint32(0), (<-msgs).(*PTestRes).Int)
+
+		// MessageHandle返回false只关闭该流
+		assert.Nil(t, a.Send(new(PBig)))
+		_, err = a.Recv(newTestRegister())
+		assert.NotNil(t, err)
+		assert.Equal(t, ErrStreamClosed, a.Send(&PTest{}))
+		assertEcho(t, b, "b")
+
+		// 没有协商的客户端不受影响
+		plain, err := Dial("tcp", addr)
+		assert.Nil(t, err)
+		plain.SetTimeout(time.Second, time.Second)
+		assertEcho(t, plain, "plain")
+		_, err = plain.OpenStream()
+		assert.Equal(t, ErrMuxUnsupported, err)
+
+		// 连接关闭后流的读写返回错误
+		conn.Close()
+		_, err = b.Recv(newTestRegister())
+		assert.Equal(t, ErrConnClosed, err)
+		assert.NotNil(t, b.Send(&PTest{}))
+		plain.Close()
+		stopServer(server)
+	}
+}
+
+func TestMuxUnsupported(t *testing.T) {
+	server := NewYYServer()
+	addr := startEchoServer(t, server)
+	defer stopServer(server)
+
+	d := Dialer{Mux: MuxConfig{URI: testMuxURI}}
+	_, err := d.Dial("tcp", addr)
+	assert.Equal(t, ErrMuxUnsupported, err)
+
+	other := NewYYServer()
+	assert.NotNil(t, other.SetMux(MuxConfig{}))
+	other.RegisterHandle(new(PBig), func(*YYConnect, packet.Marshallable) bool { return true })
+	assert.NotNil(t, other.SetMux(MuxConfig{URI: 3}))
+}
+
+func TestMuxConnectGreeting(t *testing.T) {
+	for _, engine := range []Engine{EngineGoroutine, EngineEventLoop} {
+		server := NewYYServer()
+		assert.Nil(t, server.SetEngine(engine, 1))
+		assert.Nil(t, server.SetMux(MuxConfig{URI: testMuxURI}))
+		// ConnectHandle中发送的消息在协商回复之前到达客户端
+		server.RegisterConnectFunc(func(c *YYConnect) bool {
+			return c.Send(&PTestRes{Int: 9, Str: "welcome"}) == nil
+		})
+		addr := startEchoServer(t, server)
+		conn, msgs := dialMux(t, addr, MuxConfig{URI: testMuxURI})
+
+		// 协商期间收到的消息由之后的Recv返回
+		assert.Equal(t, &PTestRes{Int: 9, Str: "welcome"}, <-msgs)
+		stream := openStream(t, conn)
+		assertEcho(t, stream, "stream")
+		conn.Close()
+		stopServer(server)
+	}
+}
+
+func TestMuxMaxStreams(t *testing.T) {
+	server, addr := startMuxServer(t, EngineGoroutine, MuxConfig{URI: testMuxURI, MaxStreams: 2})
+	defer stopServer(server)
+	conn, _ := dialMux(t, addr, MuxConfig{URI: testMuxURI})
+	defer conn.Close()
+
+	// 客户端使用服务端较小的上限
+	a := openStream(t, conn)
+	openStream(t, conn)
+	_, err := conn.OpenStream()
+	assert.Equal(t, ErrTooManyStreams, err)
+
+	// 关闭后可以打开新的流，服务端按顺序先处理关闭
+	a.Close()
+	c := openStream(t, conn)
+	assertEcho(t, c, "c")
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	const window = 4096
+	server := NewYYServer()
+	assert.Nil(t, server.SetMux(MuxConfig{URI: testMuxURI, Window: window}))
+	// 回复16个与请求相同的大消息
+	server.RegisterHandle(new(PBig), func(c *YYConnect, msg packet.Marshallable) bool {
+		for i := 0; i < 16; i++ {
+			if err := c.Send(msg); err != nil {
+				return false
+			}
+		}
+		return true
+	})
+	addr := startEchoServer(t, server)
+	defer stopServer(server)
+	conn, _ := dialMux(t, addr, MuxConfig{URI: testMuxURI, Window: window})
+	defer conn.Close()
+
+	bulk := openStream(t, conn)
+	assert.Nil(t, bulk.Send(bigMessage(10000, 'a')))
+	// bulk未读取时服务端最多发送一个窗口，其他流不受影响
+	fast := openStream(t, conn)
+	for i := 0; i < 5; i++ {
+		assertEcho(t, fast, "fast")
+	}
+	bulk.stream.mut.Lock()
+	assert.True(t, len(bulk.stream.buf) <= window)
+	bulk.stream.mut.Unlock()
+
+	reg := packet.NewYYRegister()
+	reg.Register(new(PBig))
+	for i := 0; i < 16; i++ {
+		msg, err := bulk.Recv(reg)
+		if !assert.Nil(t, err) {
+			break
+		}
+		assert.Equal(t, bigMessage(10000, 'a'), msg)
+	}
+}
+
+func TestMuxProtocolError(t *testing.T) {
+	server := NewYYServer()
+	assert.Nil(t, server.SetMux(MuxConfig{URI: testMuxURI}))
+	closed := make(chan error, 1)
+	server.RegisterCloseFunc(func(c *YYConnect, err error) {
+		closed <- err
+	})
+	addr := startEchoServer(t, server)
+	defer stopServer(server)
+
+	// 未协商时发送流数据帧关闭连接
+	conn, err := Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	body := []byte{1, 0, 0, 0, muxOpen}
+	assert.Nil(t, conn.writeFrame(packet.PackFrame(testMuxURI, 0, body)))
+	assert.Equal(t, ErrMuxProtocol, <-closed)
+}
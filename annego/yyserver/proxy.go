@@ -0,0 +1,339 @@
+package yyserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"goBase/annego/logger"
+	"goBase/annego/packet"
+)
+
+var (
+	// ErrProxyUnavailable 没有可用的后端，或者Sticky时后端连接断开
+	ErrProxyUnavailable = errors.New("yyserver: proxy backend unavailable")
+	// ErrProxyTimeout 转发后超过ProxyConfig.ResponseTimeout没有收到后端的任何数据
+	ErrProxyTimeout = errors.New("yyserver: proxy backend response timeout")
+)
+
+// ProxyBackend 选择后端地址，s2s.S2SPool实现该接口
+type ProxyBackend interface {
+	Pick() (addr string, serverID int64, err error)
+}
+
+// ProxyRoute 将[MinURI, MaxURI]范围内的消息转发到Backend选择的后端
+type ProxyRoute struct {
+	Name    string
+	MinURI  uint32
+	MaxURI  uint32
+	Backend ProxyBackend
+}
+
+// ProxyConfig 七层代理配置
+// 路由范围内的数据帧不解包直接转发，每个客户端连接对每个路由使用单独的后端连接
+// 后端连接收到的数据帧原样回复给该客户端，客户端连接关闭时关闭其后端连接
+type ProxyConfig struct {
+	Routes []ProxyRoute
+
+	// Dialer 建立后端连接的配置，包括建立连接超时、TLS和心跳
+	Dialer Dialer
+
+	// WriteTimeout 写入后端连接的超时时间，为0表示不超时
+	WriteTimeout time.Duration
+
+	// ResponseTimeout 转发后超过该时间没有收到后端的任何数据时关闭后端连接，为0表示不检测
+	// 只适用于每个请求都有回复的协议
+	ResponseTimeout time.Duration
+
+	// Retries 建立后端连接失败时重新选择后端的次数
+	Retries int
+
+	// Sticky 为true时客户端连接整个生命周期只使用同一个后端，后端连接断开时以ErrProxyUnavailable关闭客户端连接
+	// 为false时下一次转发重新选择后端
+	Sticky bool
+
+	// FailResCode 不为0时没有可用后端回复只有包头的数据帧，URI为FailURI，FailURI为0时使用请求的URI
+	// 为0时以ErrProxyUnavailable关闭客户端连接
+	FailResCode uint16
+	FailURI     uint32
+}
+
+// ProxyStats 单个路由的代理统计
+type ProxyStats struct {
+	Forwarded uint64 // 转发到后端的数据帧数
+	Relayed   uint64 // 回复给客户端的数据帧数
+	Dials     uint64 // 建立的后端连接数
+	Failures  uint64 // 建立连接失败、后端连接断开和回复超时的次数
+	Links     int64  // 当前的后端连接数
+}
+
+type proxyRoute struct {
+	ProxyRoute
+	index int
+
+	forwarded uint64
+	relayed   uint64
+	dials     uint64
+	failures  uint64
+	links     int64
+}
+
+type proxyHandler struct {
+	config ProxyConfig
+	routes []*proxyRoute // 按MinURI排序
+}
+
+// proxyLink 客户端连接在一个路由上的后端连接
+type proxyLink struct {
+	route    *proxyRoute
+	client   *YYConnect
+	conn     *YYConnect
+	addr     string
+	serverID int64
+	timeout  time.Duration
+
+	mut     sync.Mutex
+	waiting *time.Timer // 等待回复的计时器
+}
+
+// SetProxy 设置七层代理，应该在程序启动时调用，路由范围重叠时返回error
+// 路由范围内的URI不需要注册，也不交给MessageHandle，限流和认证白名单仍然生效
+// 代理只用于TCP、TLS和WebSocket连接，设置后EngineEventLoop使用goroutine处理连接
+func (self *YYServer) SetProxy(config ProxyConfig) error {
+	if self.running {
+		panic("YYServer is runing")
+	}
+	h := &proxyHandler{config: config}
+	for i, route := range config.Routes {
+		if route.Backend == nil || route.MinURI > route.MaxURI {
+			return fmt.Errorf("yyserver: proxy route %s invalid", route.Name)
+		}
+		h.routes = append(h.routes, &proxyRoute{ProxyRoute: route, index: i})
+	}
+	sort.Slice(h.routes, func(i, j int) bool {
+		return h.routes[i].MinURI < h.routes[j].MinURI
+	})
+	for i := 1; i < len(h.routes); i++ {
+		if h.routes[i].MinURI <= h.routes[i-1].MaxURI {
+			return fmt.Errorf("yyserver: proxy route %s overlaps %s", h.routes[i].Name, h.routes[i-1].Name)
+		}
+	}
+	self.forwarder = h
+	return nil
+}
+
+// ProxyStats 返回各路由的代理统计，未设置代理时返回nil
+func (self *YYServer) ProxyStats() map[string]ProxyStats {
+	if self.forwarder == nil {
+		return nil
+	}
+	stats := make(map[string]ProxyStats, len(self.forwarder.routes))
+	for _, r := range self.forwarder.routes {
+		stats[r.Name] = ProxyStats{
+			Forwarded: atomic.LoadUint64(&r.forwarded),
+			Relayed:   atomic.LoadUint64(&r.relayed),
+			Dials:     atomic.LoadUint64(&r.dials),
+			Failures:  atomic.LoadUint64(&r.failures),
+			Links:     atomic.LoadInt64(&r.links),
+		}
+	}
+	return stats
+}
+
+// match 返回URI所在的路由
+func (h *proxyHandler) match(uri uint32) *proxyRoute {
+	i := sort.Search(len(h.routes), func(i int) bool {
+		return h.routes[i].MaxURI >= uri
+	})
+	if i < len(h.routes) && h.routes[i].MinURI <= uri {
+		return h.routes[i]
+	}
+	return nil
+}
+
+// proxyIntercept 返回serveConnect读取数据帧时的转发函数，未设置代理时返回nil
+func (self *YYServer) proxyIntercept(yyconn *YYConnect) func([]byte) bool {
+	h := self.forwarder
+	if h == nil {
+		return nil
+	}
+	return func(frame []byte) bool {
+		header, _ := packet.PeekHeader(frame)
+		route := h.match(header.URI)
+		if route == nil {
+			return false
+		}
+		if !self.limit(yyconn, header.URI) || self.unauthenticated(yyconn, header.URI) {
+			return true
+		}
+		start := time.Now()
+		h.forward(yyconn, route, frame)
+		self.metrics.observe(header.URI, header.ResCode, time.Since(start))
+		return true
+	}
+}
+
+// forward 在客户端的读goroutine中同步转发，保证同一客户端的请求按顺序到达后端
+func (h *proxyHandler) forward(client *YYConnect, route *proxyRoute, frame []byte) {
+	link, err := h.link(client, route)
+	if err == nil {
+		if err = link.send(frame); err == nil {
+			atomic.AddUint64(&route.forwarded, 1)
+			return
+		}
+		link.conn.closeWith(err)
+	}
+	if closed, _ := client.closeReason(); closed {
+		return
+	}
+	logger.Info("proxy %v route %s uri %d error %v", client.RemoteAddr(), route.Name,
+		binary.LittleEndian.Uint32(frame[4:8]), err)
+	if h.config.FailResCode == 0 || (h.config.Sticky && err == ErrProxyUnavailable) {
+		// 由读取错误结束连接，CloseHandle收到记录的关闭原因
+		client.closeWith(ErrProxyUnavailable)
+		return
+	}
+	uri := h.config.FailURI
+	if uri == 0 {
+		uri = binary.LittleEndian.Uint32(frame[4:8])
+	}
+	client.sendFrame(packet.PackFrame(uri, h.config.FailResCode, nil))
+}
+
+// link 返回客户端在路由上的后端连接，没有时建立新连接
+func (h *proxyHandler) link(client *YYConnect, route *proxyRoute) (*proxyLink, error) {
+	client.proxyMut.Lock()
+	defer client.proxyMut.Unlock()
+	if client.proxyLinks == nil {
+		client.proxyLinks = make(map[int]*proxyLink)
+	}
+	if link, ok := client.proxyLinks[route.index]; ok {
+		if link == nil {
+			// Sticky时后端连接已经断开
+			return nil, ErrProxyUnavailable
+		}
+		return link, nil
+	}
+
+	var err error
+	for i := 0; i <= h.config.Retries; i++ {
+		var link *proxyLink
+		if link, err = h.dial(client, route); err == nil {
+			client.proxyLinks[route.index] = link
+			go link.relay(h)
+			return link, nil
+		}
+		atomic.AddUint64(&route.failures, 1)
+	}
+	return nil, err
+}
+
+func (h *proxyHandler) dial(client *YYConnect, route *proxyRoute) (*proxyLink, error) {
+	addr, serverID, err := route.Backend.Pick()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := h.config.Dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(0, h.config.WriteTimeout)
+	atomic.AddUint64(&route.dials, 1)
+	atomic.AddInt64(&route.links, 1)
+	return &proxyLink{route: route, client: client, conn: conn, addr: addr, serverID: serverID,
+		timeout: h.config.ResponseTimeout}, nil
+}
+
+// send 写入后端连接并开始等待回复
+func (l *proxyLink) send(frame []byte) error {
+	if err := l.conn.writeFrame(frame); err != nil {
+		return err
+	}
+	l.expect()
+	return nil
+}
+
+// relay 将后端连接收到的数据帧回复给客户端，直到后端连接关闭
+func (l *proxyLink) relay(h *proxyHandler) {
+	var err error
+	for {
+		var frame []byte
+		if frame, err = l.conn.recvFrame(); err != nil {
+			break
+		}
+		l.responded()
+		atomic.AddUint64(&l.route.relayed, 1)
+		if err = l.client.sendFrame(frame); err != nil {
+			break
+		}
+	}
+	l.responded()
+	l.conn.Close()
+	atomic.AddInt64(&l.route.links, -1)
+	if closed, reason := l.conn.closeReason(); closed && reason != io.ErrClosedPipe {
+		err = reason
+	}
+
+	l.client.proxyMut.Lock()
+	owned := l.client.proxyLinks[l.route.index] == l
+	if owned {
+		if h.config.Sticky {
+			l.client.proxyLinks[l.route.index] = nil
+		} else {
+			delete(l.client.proxyLinks, l.route.index)
+		}
+	}
+	l.client.proxyMut.Unlock()
+
+	// 客户端连接结束引起的后端连接关闭不是后端故障
+	if closed, _ := l.client.closeReason(); closed || !owned {
+		return
+	}
+	atomic.AddUint64(&l.route.failures, 1)
+	logger.Info("proxy %v route %s backend %s server %d error %v", l.client.RemoteAddr(), l.route.Name, l.addr, l.serverID, err)
+	if h.config.Sticky {
+		l.client.closeWith(ErrProxyUnavailable)
+	}
+}
+
+// expect 转发后开始计时，已经在等待回复时不重新计时
+func (l *proxyLink) expect() {
+	if l.timeout <= 0 {
+		return
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.waiting == nil {
+		l.waiting = time.AfterFunc(l.timeout, func() {
+			l.conn.closeWith(ErrProxyTimeout)
+		})
+	}
+}
+
+// responded 收到后端的数据，停止等待回复
+func (l *proxyLink) responded() {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.waiting != nil {
+		l.waiting.Stop()
+		l.waiting = nil
+	}
+}
+
+// closeProxyLinks 客户端连接结束时关闭所有后端连接
+func (c *YYConnect) closeProxyLinks() {
+	c.proxyMut.Lock()
+	links := c.proxyLinks
+	c.proxyLinks = nil
+	c.proxyMut.Unlock()
+	for _, link := range links {
+		if link != nil {
+			link.conn.Close()
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package yyserver
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+)
+
+// testBackends 轮询选择后端地址
+type testBackends struct {
+	mut   sync.Mutex
+	addrs []string
+	next  int
+}
+
+func (b *testBackends) Pick() (string, int64, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if len(b.addrs) == 0 {
+		return "", 0, errors.New("no backend")
+	}
+	addr := b.addrs[b.next%len(b.addrs)]
+	b.next++
+	return addr, int64(b.next), nil
+}
+
+// startNamedBackend 启动回复后端名字的后端服务，PTest.Int为0时不回复
+func startNamedBackend(t *testing.T, name string) (*YYServer, string) {
+	server := NewYYServer()
+	server.RegisterHandle(new(PTest), func(c *YYConnect, msg packet.Marshallable) bool {
+		if req := msg.(*PTest); req.Int != 0 {
+			c.Send(&PTestRes{req.Int, name})
+		}
+		return true
+	})
+	assert.Nil(t, server.Start("127.0.0.1:0"))
+	return server, server.GetListenAddr().String()
+}
+
+// startProxy 启动代理，PTest转发到backends，PBig在代理本地处理
+func startProxy(t *testing.T, config ProxyConfig, backends ProxyBackend, setup ...func(*YYServer)) (*YYServer, *YYConnect) {
+	config.Routes = []ProxyRoute{{Name: "test", MinURI: 1, MaxURI: 2, Backend: backends}}
+	proxy := NewYYServer()
+	assert.Nil(t, proxy.SetProxy(config))
+	proxy.RegisterHandle(new(PBig), func(c *YYConnect, msg packet.Marshallable) bool {
+		c.Send(&PTestRes{3, "local"})
+		return true
+	})
+	for _, f := range setup {
+		f(proxy)
+	}
+	assert.Nil(t, proxy.Start("127.0.0.1:0"))
+	conn, err := Dial("tcp", proxy.GetListenAddr().String())
+	assert.Nil(t, err)
+	conn.SetTimeout(2*time.Second, 2*time.Second)
+	return proxy, conn
+}
+
+// requestName 通过代理请求，返回后端的名字
+func requestName(t *testing.T, conn *YYConnect) string {
+	assert.Nil(t, conn.Send(&PTest{Int: 1}))
+	msg, err := conn.Recv(newTestRegister())
+	if !assert.Nil(t, err) {
+		return ""
+	}
+	return msg.(*PTestRes).Str
+}
+
+func TestProxyRoutes(t *testing.T) {
+	proxy := NewYYServer()
+	backends := new(testBackends)
+	assert.NotNil(t, proxy.SetProxy(ProxyConfig{Routes: []ProxyRoute{{Name: "a", MinURI: 2, MaxURI: 1, Backend: backends}}}))
+	assert.NotNil(t, proxy.SetProxy(ProxyConfig{Routes: []ProxyRoute{
+		{Name: "a", MinURI: 100, MaxURI: 200, Backend: backends},
+		{Name: "b", MinURI: 200, MaxURI: 300, Backend: backends},
+	}}))
+	assert.Nil(t, proxy.SetProxy(ProxyConfig{Routes: []ProxyRoute{
+		{Name: "b", MinURI: 201, MaxURI: 300, Backend: backends},
+		{Name: "a", MinURI: 100, MaxURI: 200, Backend: backends},
+	}}))
+	for uri, name := range map[uint32]string{99: "", 100: "a", 200: "a", 201: "b", 300: "b", 301: ""} {
+		route := proxy.forwarder.match(uri)
+		if name == "" {
+			assert.Nil(t, route, uri)
+		} else {
+			assert.Equal(t, name, route.Name, uri)
+		}
+	}
+}
+
+func TestProxyForward(t *testing.T) {
+	a, addrA := startNamedBackend(t, "a")
+	defer stopServer(a)
+	b, addrB := startNamedBackend(t, "b")
+	defer stopServer(b)
+	backends := &testBackends{addrs: []string{addrA, addrB}}
+	proxy, conn := startProxy(t, ProxyConfig{}, backends)
+	defer stopServer(proxy)
+	defer conn.Close()
+
+	// 同一客户端连接始终使用同一个后端
+	name := requestName(t, conn)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, name, requestName(t, conn))
+	}
+	// 路由范围外的消息在代理本地处理
+	assert.Nil(t, conn.Send(new(PBig)))
+	msg, err := conn.Recv(newTestRegister())
+	assert.Nil(t, err)
+	assert.Equal(t, "local", msg.(*PTestRes).Str)
+
+	// 其他客户端连接选择另一个后端
+	conn2, err := Dial("tcp", proxy.GetListenAddr().String())
+	assert.Nil(t, err)
+	conn2.SetTimeout(2*time.Second, 2*time.Second)
+	assert.NotEqual(t, name, requestName(t, conn2))
+	stats := proxy.ProxyStats()["test"]
+	assert.Equal(t, ProxyStats{Forwarded: 7, Relayed: 7, Dials: 2, Links: 2}, stats)
+
+	// 客户端连接关闭后关闭后端连接
+	conn2.Close()
+	assert.Eventually(t, func() bool {
+		return proxy.ProxyStats()["test"].Links == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint64(0), proxy.ProxyStats()["test"].Failures)
+}
+
+func TestProxyBackendFailure(t *testing.T) {
+	a, addrA := startNamedBackend(t, "a")
+	b, addrB := startNamedBackend(t, "b")
+	defer stopServer(b)
+	// 第二次选择到已经停止的a
+	backends := &testBackends{addrs: []string{addrA, addrA, addrB}}
+	proxy, conn := startProxy(t, ProxyConfig{Retries: 1}, backends)
+	defer stopServer(proxy)
+	defer conn.Close()
+	assert.Equal(t, "a", requestName(t, conn))
+
+	// 后端断开后重新选择后端，建立连接失败时重试
+	stopServer(a)
+	assert.Eventually(t, func() bool {
+		return proxy.ProxyStats()["test"].Links == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "b", requestName(t, conn))
+	assert.Equal(t, "b", requestName(t, conn))
+	stats := proxy.ProxyStats()["test"]
+	assert.Equal(t, uint64(2), stats.Failures)
+	assert.Equal(t, uint64(2), stats.Dials)
+}
+
+func TestProxySticky(t *testing.T) {
+	a, addrA := startNamedBackend(t, "a")
+	backends := &testBackends{addrs: []string{addrA}}
+	closed := make(chan error, 1)
+	proxy, conn := startProxy(t, ProxyConfig{Sticky: true}, backends, func(s *YYServer) {
+		s.RegisterCloseFunc(func(c *YYConnect, err error) {
+			closed <- err
+		})
+	})
+	defer stopServer(proxy)
+	defer conn.Close()
+	assert.Equal(t, "a", requestName(t, conn))
+
+	// Sticky时后端断开关闭客户端连接
+	stopServer(a)
+	assert.Equal(t, ErrProxyUnavailable, <-closed)
+	_, err := conn.Recv(newTestRegister())
+	assert.NotNil(t, err)
+}
+
+func TestProxyUnavailable(t *testing.T) {
+	backends := new(testBackends)
+	proxy, conn := startProxy(t, ProxyConfig{FailResCode: 503, FailURI: 2}, backends)
+	defer stopServer(proxy)
+	defer conn.Close()
+
+	// 没有可用后端时回复FailResCode
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, conn.Send(&PTest{Int: 1}))
+		frame, err := conn.recvFrame()
+		assert.Nil(t, err)
+		assert.Equal(t, packet.PackFrame(2, 503, nil), frame)
+	}
+	assert.Equal(t, uint64(2), proxy.ProxyStats()["test"].Failures)
+}
+
+func TestProxyResponseTimeout(t *testing.T) {
+	a, addrA := startNamedBackend(t, "a")
+	defer stopServer(a)
+	backends := &testBackends{addrs: []string{addrA}}
+	proxy, conn := startProxy(t, ProxyConfig{ResponseTimeout: 50 * time.Millisecond}, backends)
+	defer stopServer(proxy)
+	defer conn.Close()
+	assert.Equal(t, "a", requestName(t, conn))
+
+	// 后端没有回复，超时后关闭后端连接，下次转发重新建立
+	assert.Nil(t, conn.Send(&PTest{Int: 0}))
+	assert.Eventually(t, func() bool {
+		return proxy.ProxyStats()["test"].Failures == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "a", requestName(t, conn))
+	assert.Equal(t, uint64(2), proxy.ProxyStats()["test"].Dials)
+}
@@ -0,0 +1,223 @@
+package yyserver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"goBase/annego/logger"
+)
+
+// ErrProxyHeader PROXY协议头格式错误
+var ErrProxyHeader = errors.New("yyserver: invalid proxy protocol header")
+
+const (
+	// defaultProxyHeaderTimeout 读取PROXY协议头的默认超时时间
+	defaultProxyHeaderTimeout = 5 * time.Second
+	// proxyV1MaxLength v1协议头最大长度，包含\r\n
+	proxyV1MaxLength = 107
+)
+
+// proxyV2Signature v2协议头的固定签名
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolConfig HAProxy PROXY协议配置，支持v1和v2
+type ProxyProtocolConfig struct {
+	// Trusted 可信代理的CIDR列表，只解析来自这些地址的连接的协议头
+	// 来自可信地址的连接必须携带协议头，其他连接按普通连接处理，不解析协议头
+	Trusted []string
+
+	// Timeout 读取协议头的超时时间，为0使用5秒
+	Timeout time.Duration
+}
+
+type proxyProtocol struct {
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+// SetProxyProtocol 设置Serve接受的连接解析PROXY协议头，应该在程序启动时调用，CIDR格式错误返回error
+// 解析后YYConnect.RemoteAddr返回原始客户端地址，准入控制和按IP限流也使用该地址
+// 代理的地址通过YYConnect.ProxyAddr获取
+func (self *YYServer) SetProxyProtocol(config ProxyProtocolConfig) error {
+	if self.running {
+		panic("YYServer is runing")
+	}
+	trusted, err := parseCIDRList(config.Trusted)
+	if err != nil {
+		return err
+	}
+	p := &proxyProtocol{trusted: trusted, timeout: config.Timeout}
+	if p.timeout <= 0 {
+		p.timeout = defaultProxyHeaderTimeout
+	}
+	self.proxy = p
+	return nil
+}
+
+// isTrusted 连接是否来自可信代理
+func (p *proxyProtocol) isTrusted(addr net.Addr) bool {
+	ip := addrIP(addr)
+	return ip != nil && containsIP(p.trusted, ip)
+}
+
+// accept 读取协议头，返回以原始客户端地址作为RemoteAddr的连接
+// 协议头为LOCAL或UNKNOWN时返回原连接
+func (p *proxyProtocol) accept(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(p.timeout))
+	source, err := readProxyHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	if source == nil {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, source: source}, nil
+}
+
+// readProxyHeader 逐字节读取协议头，不读取之后的数据，返回原始客户端地址
+// LOCAL命令或UNKNOWN协议返回nil
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	head := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(head, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if !bytes.HasPrefix(head, []byte("PROXY ")) {
+		return nil, ErrProxyHeader
+	}
+	line := head
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, ErrProxyHeader
+		}
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	return parseProxyV1(string(line[:len(line)-2]))
+}
+
+// parseProxyV1 解析v1协议头，格式为PROXY TCP4 源IP 目的IP 源端口 目的端口
+func parseProxyV1(line string) (net.Addr, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || net.ParseIP(fields[3]) == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, ErrProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ErrProxyHeader
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, ErrProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 读取签名之后的v2协议头，忽略TLV扩展
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if head[0]>>4 != 2 {
+		return nil, ErrProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[2:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch head[0] & 0xf {
+	case 0x0: // LOCAL 代理自身的连接，例如健康检查
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, ErrProxyHeader
+	}
+	// 高4位为地址族，低4位为传输协议
+	switch head[1] >> 4 {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, ErrProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]).To16(), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, ErrProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	// AF_UNSPEC和AF_UNIX不能表示为客户端IP，按代理自身的连接处理
+	return nil, nil
+}
+
+// proxyConn RemoteAddr返回协议头中原始客户端地址的连接
+type proxyConn struct {
+	net.Conn
+	source net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr { return c.source }
+
+// ProxyAddr 返回代理的地址
+func (c *proxyConn) ProxyAddr() net.Addr { return c.Conn.RemoteAddr() }
+
+// SyscallConn 协议头已经读完，事件循环可以直接读取底层连接
+func (c *proxyConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("yyserver: %T is not syscall.Conn", c.Conn)
+	}
+	return sc.SyscallConn()
+}
+
+// proxyTLSConn 在proxyConn上完成握手的TLS连接，保留代理的地址
+type proxyTLSConn struct {
+	*tls.Conn
+	proxy net.Addr
+}
+
+func (c *proxyTLSConn) ProxyAddr() net.Addr { return c.proxy }
+
+// admitProxy 在新的goroutine中读取可信代理连接的协议头，读取完成后再做准入检查
+func (self *YYServer) admitProxy(conn net.Conn) {
+	go func() {
+		pconn, err := self.proxy.accept(conn)
+		if err != nil {
+			logger.Info("proxy protocol %v error %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		self.admit(pconn, self.handleConnect)
+	}()
+}
+
+// ProxyAddr 返回PROXY协议中代理的地址，此时RemoteAddr为原始客户端地址
+// 连接没有经过PROXY协议时返回nil
+func (c *YYConnect) ProxyAddr() net.Addr {
+	if p, ok := c.conn.(interface{ ProxyAddr() net.Addr }); ok {
+		return p.ProxyAddr()
+	}
+	return nil
+}
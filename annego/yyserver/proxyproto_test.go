@@ -0,0 +1,204 @@
+package yyserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// proxyV2Header 构造v2协议头，source为nil时为LOCAL命令
+func proxyV2Header(source *net.TCPAddr) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	if source == nil {
+		buf.Write([]byte{0x20, 0x00, 0, 0})
+		return buf.Bytes()
+	}
+	var body []byte
+	if ip := source.IP.To4(); ip != nil {
+		buf.WriteByte(0x21)
+		buf.WriteByte(0x11)
+		body = append(append(body, ip...), 10, 0, 0, 1)
+	} else {
+		buf.WriteByte(0x21)
+		buf.WriteByte(0x21)
+		body = append(append(body, source.IP.To16()...), net.IPv6loopback...)
+	}
+	body = append(body, byte(source.Port>>8), byte(source.Port), 0x27, 0x10)
+	// TLV扩展被忽略
+	body = append(body, 0x04, 0, 1, 0xff)
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(body)))
+	buf.Write(length)
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	cases := []struct {
+		header string
+		source string
+		err    bool
+	}{
+		{"PROXY TCP4 1.2.3.4 10.0.0.1 5555 10000\r\n", "1.2.3.4:5555", false},
+		{"PROXY TCP6 2001:db8::1 ::1 5555 10000\r\n", "[2001:db8::1]:5555", false},
+		{"PROXY UNKNOWN\r\n", "", false},
+		{"PROXY UNKNOWN 1.2.3.4 10.0.0.1 5555 10000\r\n", "", false},
+		{string(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5555})), "1.2.3.4:5555", false},
+		{string(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5555})), "[2001:db8::1]:5555", false},
+		{string(proxyV2Header(nil)), "", false},
+		{"PROXY TCP4 2001:db8::1 10.0.0.1 5555 10000\r\n", "", true},
+		{"PROXY TCP4 1.2.3.4 10.0.0.1 70000 10000\r\n", "", true},
+		{"PROXY TCP4 1.2.3.4\r\n", "", true},
+		{"GET / HTTP/1.1\r\n", "", true},
+		{"PROXY TCP4 " + string(bytes.Repeat([]byte("1"), 120)) + "\r\n", "", true},
+	}
+	for _, c := range cases {
+		// 协议头之后的数据不被读取
+		r := bytes.NewReader([]byte(c.header + "data"))
+		source, err := readProxyHeader(r)
+		if c.err {
+			assert.NotNil(t, err, c.header)
+			continue
+		}
+		assert.Nil(t, err, c.header)
+		if c.source == "" {
+			assert.Nil(t, source, c.header)
+		} else {
+			assert.Equal(t, c.source, source.String(), c.header)
+		}
+		rest, _ := ioutil.ReadAll(r)
+		assert.Equal(t, "data", string(rest), c.header)
+	}
+
+	// v2版本号错误
+	header := proxyV2Header(nil)
+	header[12] = 0x10
+	_, err := readProxyHeader(bytes.NewReader(header))
+	assert.Equal(t, ErrProxyHeader, err)
+}
+
+// dialProxy 建立连接并发送协议头，模拟经过代理的客户端
+func dialProxy(t *testing.T, addr string, header []byte) *YYConnect {
+	d := Dialer{DialContextFunc: func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := net.Dial(network, address)
+		if err == nil && header != nil {
+			_, err = conn.Write(header)
+		}
+		return conn, err
+	}}
+	conn, err := d.Dial("tcp", addr)
+	assert.Nil(t, err)
+	conn.SetTimeout(time.Second, time.Second)
+	return conn
+}
+
+func TestServerProxyProtocol(t *testing.T) {
+	for _, engine := range []Engine{EngineGoroutine, EngineEventLoop} {
+		server := NewYYServer()
+		assert.Nil(t, server.SetEngine(engine, 1))
+		assert.Nil(t, server.SetProxyProtocol(ProxyProtocolConfig{Trusted: []string{"127.0.0.0/8"}, Timeout: 100 * time.Millisecond}))
+		// 按原始客户端IP限制连接数
+		assert.Nil(t, server.SetAdmission(AdmissionConfig{MaxConnPerIP: 1}))
+		type addrs struct{ remote, proxy net.Addr }
+		connected := make(chan addrs, 4)
+		server.RegisterConnectFunc(func(c *YYConnect) bool {
+			connected <- addrs{c.RemoteAddr(), c.ProxyAddr()}
+			return true
+		})
+		addr := startEchoServer(t, server)
+
+		c1 := dialProxy(t, addr, []byte("PROXY TCP4 1.2.3.4 10.0.0.1 5555 10000\r\n"))
+		assertEcho(t, c1, "v1")
+		a := <-connected
+		assert.Equal(t, "1.2.3.4:5555", a.remote.String())
+		assert.Equal(t, "127.0.0.1", addrIP(a.proxy).String())
+
+		c2 := dialProxy(t, addr, proxyV2Header(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6666}))
+		assertEcho(t, c2, "v2")
+		a = <-connected
+		assert.Equal(t, "[2001:db8::1]:6666", a.remote.String())
+
+		// LOCAL命令按代理自身的连接处理
+		c3 := dialProxy(t, addr, proxyV2Header(nil))
+		assertEcho(t, c3, "local")
+		a = <-connected
+		assert.Equal(t, "127.0.0.1", addrIP(a.remote).String())
+		assert.Nil(t, a.proxy)
+
+		// 可信代理的连接没有协议头时关闭
+		c4 := dialProxy(t, addr, nil)
+		_, err := c4.Recv(newTestRegister())
+		assert.NotNil(t, err)
+
+		for _, c := range []*YYConnect{c1, c2, c3, c4} {
+			c.Close()
+		}
+		stopServer(server)
+	}
+}
+
+func TestServerProxyProtocolUntrusted(t *testing.T) {
+	server := NewYYServer()
+	assert.NotNil(t, server.SetProxyProtocol(ProxyProtocolConfig{Trusted: []string{"10.0.0.0"}}))
+	assert.Nil(t, server.SetProxyProtocol(ProxyProtocolConfig{Trusted: []string{"10.0.0.0/8"}}))
+	addr := startEchoServer(t, server)
+	defer stopServer(server)
+
+	// 不可信来源不解析协议头
+	conn := dialProxy(t, addr, nil)
+	defer conn.Close()
+	assertEcho(t, conn, "plain")
+	assert.Nil(t, conn.ProxyAddr())
+
+	// 伪造的协议头作为YY数据帧解析失败
+	spoof := dialProxy(t, addr, []byte("PROXY TCP4 1.2.3.4 10.0.0.1 5555 10000\r\n"))
+	defer spoof.Close()
+	_, err := spoof.Recv(newTestRegister())
+	assert.NotNil(t, err)
+}
+
+func TestServerProxyProtocolTLS(t *testing.T) {
+	ca := newTestCert(t, "test-ca", 1, nil)
+	serverCert := newTestCert(t, "server", 2, ca)
+	server := NewYYServer()
+	server.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{serverCert.tlsCert(t)}})
+	assert.Nil(t, server.SetProxyProtocol(ProxyProtocolConfig{Trusted: []string{"127.0.0.1/32"}}))
+	connected := make(chan *YYConnect, 1)
+	server.RegisterConnectFunc(func(c *YYConnect) bool {
+		connected <- c
+		return true
+	})
+	addr := startEchoServer(t, server)
+	defer stopServer(server)
+
+	// PROXY协议头在TLS握手之前发送
+	d := Dialer{
+		TLSConfig: &tls.Config{RootCAs: certPool(ca)},
+		DialContextFunc: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := net.Dial(network, address)
+			if err == nil {
+				_, err = conn.Write([]byte("PROXY TCP4 1.2.3.4 10.0.0.1 5555 10000\r\n"))
+			}
+			return conn, err
+		},
+	}
+	conn, err := d.Dial("tcp", addr)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	assertEcho(t, conn, "tls")
+
+	c := <-connected
+	assert.Equal(t, "1.2.3.4:5555", c.RemoteAddr().String())
+	assert.Equal(t, "127.0.0.1", addrIP(c.ProxyAddr()).String())
+	assert.NotNil(t, c.TLSState())
+}
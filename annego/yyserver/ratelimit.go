@@ -0,0 +1,506 @@
+package yyserver
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"goBase/annego/packet"
+	"goBase/annego/util"
+)
+
+// ErrRateLimited 超过限流规则，策略为LimitClose
+var ErrRateLimited = errors.New("yyserver: rate limited")
+
+// LimitScope 限流规则的计数范围
+type LimitScope int
+
+const (
+	// LimitConn 每个连接一个令牌桶
+	LimitConn LimitScope = iota
+	// LimitURI 每个URI一个所有连接共享的令牌桶
+	LimitURI
+	// LimitConnURI 每个连接的每个URI一个令牌桶
+	LimitConnURI
+	// LimitIP 每个来源IP一个令牌桶，非IP地址的连接不受限制
+	LimitIP
+)
+
+var limitScopeNames = []string{"conn", "uri", "conn_uri", "ip"}
+
+func (s LimitScope) String() string {
+	if s >= 0 && int(s) < len(limitScopeNames) {
+		return limitScopeNames[s]
+	}
+	return fmt.Sprintf("LimitScope(%d)", int(s))
+}
+
+// UnmarshalText 从配置中解析，取值为conn、uri、conn_uri、ip
+func (s *LimitScope) UnmarshalText(text []byte) error {
+	for i, name := range limitScopeNames {
+		if name == string(text) {
+			*s = LimitScope(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("yyserver: unknown limit scope %q", text)
+}
+
+// MarshalText 与UnmarshalText对应
+func (s LimitScope) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// LimitPolicy 超过限流规则时的处理策略
+type LimitPolicy int
+
+const (
+	// LimitDrop 丢弃消息
+	LimitDrop LimitPolicy = iota
+	// LimitReply 丢弃消息并回复只有包头的数据帧，ResCode为规则的ResCode
+	LimitReply
+	// LimitDelay 等待令牌后再处理，超过MaxDelay时丢弃
+	// 事件循环引擎和UDP的连接共享读goroutine，不等待直接丢弃
+	LimitDelay
+	// LimitClose 关闭连接，CloseHandle收到ErrRateLimited
+	LimitClose
+)
+
+var limitPolicyNames = []string{"drop", "reply", "delay", "close"}
+
+func (p LimitPolicy) String() string {
+	if p >= 0 && int(p) < len(limitPolicyNames) {
+		return limitPolicyNames[p]
+	}
+	return fmt.Sprintf("LimitPolicy(%d)", int(p))
+}
+
+// UnmarshalText 从配置中解析，取值为drop、reply、delay、close
+func (p *LimitPolicy) UnmarshalText(text []byte) error {
+	for i, name := range limitPolicyNames {
+		if name == string(text) {
+			*p = LimitPolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("yyserver: unknown limit policy %q", text)
+}
+
+// MarshalText 与UnmarshalText对应
+func (p LimitPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// DefaultLimitMaxDelay LimitDelay未设置MaxDelay时最多等待的时间
+const DefaultLimitMaxDelay = time.Second
+
+// RateLimitRule 一条令牌桶限流规则
+type RateLimitRule struct {
+	// Name 规则名，用于Console命令和统计，不能为空或重复
+	Name string `json:"name"`
+	// Scope 计数范围
+	Scope LimitScope `json:"scope"`
+	// URIs 规则生效的URI，为空表示所有URI
+	URIs []uint32 `json:"uris,omitempty"`
+	// Rate 每秒生成的令牌数，Burst为最多累积的令牌数
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+	// Policy 超过限制时的处理策略
+	Policy LimitPolicy `json:"policy"`
+	// ResCode LimitReply回复的ResCode，ReplyURI为回复的URI，为0时使用请求的URI
+	ResCode  uint16 `json:"rescode,omitempty"`
+	ReplyURI uint32 `json:"reply_uri,omitempty"`
+	// MaxDelay LimitDelay最多等待的时间，为0时使用DefaultLimitMaxDelay
+	MaxDelay time.Duration `json:"max_delay,omitempty"`
+}
+
+// RateLimitConfig 限流配置，消息依次检查所有匹配的规则，第一个超过限制的规则决定处理策略
+type RateLimitConfig struct {
+	Rules []RateLimitRule `json:"rules"`
+}
+
+// RateLimitStats 单条规则的当前状态
+type RateLimitStats struct {
+	Scope   string  `json:"scope"`
+	Policy  string  `json:"policy"`
+	Rate    float64 `json:"rate"`
+	Burst   int     `json:"burst"`
+	Allowed uint64  `json:"allowed"`
+	Limited uint64  `json:"limited"`
+	// Buckets LimitURI和LimitIP当前的令牌桶数量，按连接计数的令牌桶保存在连接中不统计
+	Buckets int `json:"buckets"`
+	// Tokens LimitURI各URI当前的令牌数
+	Tokens map[uint32]float64 `json:"tokens,omitempty"`
+}
+
+// limitIdleExpire LimitIP的令牌桶超过该时间未使用时删除
+const limitIdleExpire = time.Minute
+
+type limitBucket struct {
+	bucket  *util.TokenBucket
+	version uint64
+	last    int64 // UnixNano，原子操作
+}
+
+type limitRule struct {
+	RateLimitRule
+	index int
+	uris  map[uint32]bool
+
+	mut     sync.RWMutex
+	version uint64 // 修改Rate、Burst后增加，令牌桶使用时同步
+
+	allowed uint64
+	limited uint64
+
+	bucketMut sync.Mutex
+	buckets   map[string]*limitBucket // LimitURI和LimitIP的令牌桶
+	lastSweep time.Time
+}
+
+// connLimitKey 连接内令牌桶的索引
+type connLimitKey struct {
+	rule int
+	uri  uint32
+}
+
+type rateLimiter struct {
+	rules []*limitRule
+	names map[string]*limitRule
+}
+
+func newRateLimiter(config RateLimitConfig) (*rateLimiter, error) {
+	l := &rateLimiter{names: make(map[string]*limitRule)}
+	for i, rule := range config.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("yyserver: rate limit rule %d without name", i)
+		}
+		if _, ok := l.names[rule.Name]; ok {
+			return nil, fmt.Errorf("yyserver: rate limit rule %s duplicate", rule.Name)
+		}
+		if rule.Rate <= 0 {
+			return nil, fmt.Errorf("yyserver: rate limit rule %s rate %v", rule.Name, rule.Rate)
+		}
+		if rule.Scope < LimitConn || rule.Scope > LimitIP {
+			return nil, fmt.Errorf("yyserver: rate limit rule %s %v", rule.Name, rule.Scope)
+		}
+		if rule.Policy < LimitDrop || rule.Policy > LimitClose {
+			return nil, fmt.Errorf("yyserver: rate limit rule %s %v", rule.Name, rule.Policy)
+		}
+		if rule.MaxDelay <= 0 {
+			rule.MaxDelay = DefaultLimitMaxDelay
+		}
+		r := &limitRule{
+			RateLimitRule: rule,
+			index:         i,
+			buckets:       make(map[string]*limitBucket),
+		}
+		if len(rule.URIs) > 0 {
+			r.uris = make(map[uint32]bool, len(rule.URIs))
+			for _, uri := range rule.URIs {
+				r.uris[uri] = true
+			}
+		}
+		l.rules = append(l.rules, r)
+		l.names[rule.Name] = r
+	}
+	return l, nil
+}
+
+func (r *limitRule) match(uri uint32) bool {
+	return r.uris == nil || r.uris[uri]
+}
+
+func (r *limitRule) rate() (float64, int, uint64) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return r.Rate, r.Burst, r.version
+}
+
+func (r *limitRule) setRate(rate float64, burst int) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.Rate = rate
+	r.Burst = burst
+	atomic.AddUint64(&r.version, 1)
+}
+
+func (r *limitRule) newBucket() *limitBucket {
+	rate, burst, version := r.rate()
+	return &limitBucket{bucket: util.NewTokenBucket(rate, burst), version: version}
+}
+
+// sync 规则修改后更新令牌桶的速率，修改时未登记的连接在下次使用时更新
+func (r *limitRule) sync(b *limitBucket) *util.TokenBucket {
+	if version := atomic.LoadUint64(&b.version); version != atomic.LoadUint64(&r.version) {
+		rate, burst, version := r.rate()
+		b.bucket.SetRate(rate, burst)
+		atomic.StoreUint64(&b.version, version)
+	}
+	return b.bucket
+}
+
+// sharedBucket 返回LimitURI和LimitIP的令牌桶，定期删除长时间未使用的LimitIP令牌桶
+func (r *limitRule) sharedBucket(key string, now time.Time) *limitBucket {
+	r.bucketMut.Lock()
+	defer r.bucketMut.Unlock()
+	if r.Scope == LimitIP && now.Sub(r.lastSweep) > limitIdleExpire {
+		r.lastSweep = now
+		for k, b := range r.buckets {
+			if now.UnixNano()-atomic.LoadInt64(&b.last) > int64(limitIdleExpire) {
+				delete(r.buckets, k)
+			}
+		}
+	}
+	b, ok := r.buckets[key]
+	if !ok {
+		b = r.newBucket()
+		r.buckets[key] = b
+	}
+	atomic.StoreInt64(&b.last, now.UnixNano())
+	return b
+}
+
+// bucket 返回消息对应的令牌桶，规则不适用于该连接时返回nil
+func (r *limitRule) bucket(yyconn *YYConnect, uri uint32, now time.Time) *util.TokenBucket {
+	var b *limitBucket
+	switch r.Scope {
+	case LimitConn, LimitConnURI:
+		key := connLimitKey{rule: r.index}
+		if r.Scope == LimitConnURI {
+			key.uri = uri
+		}
+		// 流上的消息使用所在连接的令牌桶
+		conn := yyconn.root()
+		conn.limitMut.Lock()
+		if conn.limits == nil {
+			conn.limits = make(map[connLimitKey]*limitBucket)
+		}
+		if b = conn.limits[key]; b == nil {
+			b = r.newBucket()
+			conn.limits[key] = b
+		}
+		conn.limitMut.Unlock()
+	case LimitURI:
+		b = r.sharedBucket(strconv.FormatUint(uint64(uri), 10), now)
+	case LimitIP:
+		ip := addrIP(yyconn.RemoteAddr())
+		if ip == nil {
+			return nil
+		}
+		b = r.sharedBucket(ip.String(), now)
+	}
+	return r.sync(b)
+}
+
+func (r *limitRule) stats() RateLimitStats {
+	rate, burst, _ := r.rate()
+	s := RateLimitStats{
+		Scope:   r.Scope.String(),
+		Policy:  r.Policy.String(),
+		Rate:    rate,
+		Burst:   burst,
+		Allowed: atomic.LoadUint64(&r.allowed),
+		Limited: atomic.LoadUint64(&r.limited),
+	}
+	r.bucketMut.Lock()
+	defer r.bucketMut.Unlock()
+	s.Buckets = len(r.buckets)
+	if r.Scope == LimitURI {
+		s.Tokens = make(map[uint32]float64, len(r.buckets))
+		for key, b := range r.buckets {
+			uri, _ := strconv.ParseUint(key, 10, 32)
+			s.Tokens[uint32(uri)] = r.sync(b).Tokens()
+		}
+	}
+	return s
+}
+
+// check 检查消息是否超过限制，返回超过限制的规则和允许时需要等待的时间
+// delay为false时LimitDelay的规则不等待
+// 被某个规则拒绝时归还之前规则已获取的令牌，只有通过所有规则的消息计入allowed
+func (l *rateLimiter) check(yyconn *YYConnect, uri uint32, delay bool) (*limitRule, time.Duration) {
+	now := time.Now()
+	var wait time.Duration
+	var rules [8]*limitRule
+	var buckets [8]*util.TokenBucket
+	passed, taken := rules[:0], buckets[:0]
+	for _, r := range l.rules {
+		if !r.match(uri) {
+			continue
+		}
+		bucket := r.bucket(yyconn, uri, now)
+		if bucket == nil {
+			continue
+		}
+		ok := true
+		if r.Policy == LimitDelay && delay {
+			var d time.Duration
+			if d, ok = bucket.ReserveN(now, 1, r.MaxDelay); ok && d > wait {
+				wait = d
+			}
+		} else {
+			ok = bucket.AllowN(now, 1)
+		}
+		if !ok {
+			atomic.AddUint64(&r.limited, 1)
+			for _, b := range taken {
+				b.RefundN(1)
+			}
+			return r, 0
+		}
+		passed = append(passed, r)
+		taken = append(taken, bucket)
+	}
+	for _, r := range passed {
+		atomic.AddUint64(&r.allowed, 1)
+	}
+	return nil, wait
+}
+
+func (l *rateLimiter) stats() map[string]RateLimitStats {
+	stats := make(map[string]RateLimitStats, len(l.rules))
+	for _, r := range l.rules {
+		stats[r.Name] = r.stats()
+	}
+	return stats
+}
+
+// SetRateLimit 设置消息限流规则，应该在程序启动时调用，规则错误返回error
+// 运行时可以通过SetRateLimitRate或Console的ratelimit命令修改规则的速率
+func (self *YYServer) SetRateLimit(config RateLimitConfig) error {
+	if self.running {
+		panic("YYServer is runing")
+	}
+	l, err := newRateLimiter(config)
+	if err != nil {
+		return err
+	}
+	self.limiter = l
+	self.metrics.limiter = l
+	return nil
+}
+
+// SetRateLimitRate 修改规则的速率和最多累积的令牌数，立即应用到已有的令牌桶
+func (self *YYServer) SetRateLimitRate(name string, rate float64, burst int) error {
+	if self.limiter == nil {
+		return fmt.Errorf("yyserver: rate limit rule %s not found", name)
+	}
+	r, ok := self.limiter.names[name]
+	if !ok {
+		return fmt.Errorf("yyserver: rate limit rule %s not found", name)
+	}
+	if rate <= 0 {
+		return fmt.Errorf("yyserver: rate limit rule %s rate %v", name, rate)
+	}
+	r.setRate(rate, burst)
+	r.bucketMut.Lock()
+	for _, b := range r.buckets {
+		r.sync(b)
+	}
+	r.bucketMut.Unlock()
+	for _, conn := range self.registry.snapshot() {
+		conn.limitMut.Lock()
+		for key, b := range conn.limits {
+			if key.rule == r.index {
+				r.sync(b)
+			}
+		}
+		conn.limitMut.Unlock()
+	}
+	return nil
+}
+
+// RateLimitStats 返回各规则的当前状态，未设置限流时返回nil
+func (self *YYServer) RateLimitStats() map[string]RateLimitStats {
+	if self.limiter == nil {
+		return nil
+	}
+	return self.limiter.stats()
+}
+
+// limit 按限流规则处理URI的消息，返回false表示消息不再交给MessageHandle
+func (self *YYServer) limit(yyconn *YYConnect, uri uint32) bool {
+	if self.limiter == nil {
+		return true
+	}
+	rule, wait := self.limiter.check(yyconn, uri, !yyconn.shared)
+	if rule == nil {
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-yyconn.closed:
+				return false
+			}
+		}
+		return true
+	}
+
+	switch rule.Policy {
+	case LimitReply:
+		replyURI := rule.ReplyURI
+		if replyURI == 0 {
+			replyURI = uri
+		}
+		yyconn.sendFrame(packet.PackFrame(replyURI, rule.ResCode, nil))
+	case LimitClose:
+		// 由读取错误结束连接，CloseHandle收到记录的关闭原因
+		yyconn.root().closeWith(ErrRateLimited)
+	}
+	return false
+}
+
+// rateLimitText Console ratelimit命令的输出
+func (self *YYServer) rateLimitText() string {
+	if self.limiter == nil {
+		return "rate limit not set\n"
+	}
+	stats := self.limiter.stats()
+	var b strings.Builder
+	for _, r := range self.limiter.rules {
+		s := stats[r.Name]
+		fmt.Fprintf(&b, "rule %s scope %s policy %s rate %g burst %d allowed %d limited %d buckets %d\n",
+			r.Name, s.Scope, s.Policy, s.Rate, s.Burst, s.Allowed, s.Limited, s.Buckets)
+		uris := make([]uint32, 0, len(s.Tokens))
+		for uri := range s.Tokens {
+			uris = append(uris, uri)
+		}
+		sort.Slice(uris, func(i, j int) bool { return uris[i] < uris[j] })
+		for _, uri := range uris {
+			fmt.Fprintf(&b, "  uri %d tokens %.1f\n", uri, s.Tokens[uri])
+		}
+	}
+	return b.String()
+}
+
+// AddRateLimitCommand 添加ratelimit命令，查看限流状态或修改规则的速率
+func (self *Console) AddRateLimitCommand(server *YYServer) {
+	const usage = "usage: ratelimit [set name rate burst]"
+	self.AddCommand("ratelimit", "print or set rate limit, "+usage, func(params []string) string {
+		if len(params) == 1 {
+			return server.rateLimitText()
+		}
+		if len(params) != 5 || params[1] != "set" {
+			return usage + "\n"
+		}
+		rate, err := strconv.ParseFloat(params[3], 64)
+		if err != nil {
+			return usage + "\n"
+		}
+		burst, err := strconv.Atoi(params[4])
+		if err != nil {
+			return usage + "\n"
+		}
+		if err := server.SetRateLimitRate(params[2], rate, burst); err != nil {
+			return err.Error() + "\n"
+		}
+		return fmt.Sprintf("set rate limit %s rate %g burst %d\n", params[2], rate, burst)
+	})
+}
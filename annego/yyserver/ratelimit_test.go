@@ -0,0 +1,162 @@
+package yyserver
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitConfig(t *testing.T) {
+	var config RateLimitConfig
+	data := `{"rules": [
+		{"name": "conn", "scope": "conn", "rate": 1, "burst": 1, "policy": "drop"},
+		{"name": "login", "scope": "conn_uri", "uris": [1], "rate": 10, "policy": "reply", "rescode": 429}
+	]}`
+	assert.Nil(t, json.Unmarshal([]byte(data), &config))
+	assert.Equal(t, LimitConnURI, config.Rules[1].Scope)
+	assert.Equal(t, LimitReply, config.Rules[1].Policy)
+	assert.NotNil(t, json.Unmarshal([]byte(`{"rules": [{"scope": "host"}]}`), &config))
+
+	l, err := newRateLimiter(config)
+	assert.Nil(t, err)
+	conn := newPipeConnect()
+	defer conn.Close()
+	rule, _ := l.check(conn, 1, true)
+	assert.Nil(t, rule)
+	rule, _ = l.check(conn, 2, true)
+	assert.Equal(t, "conn", rule.Name)
+	// 其他连接有各自的令牌桶
+	other := newPipeConnect()
+	defer other.Close()
+	rule, _ = l.check(other, 2, true)
+	assert.Nil(t, rule)
+
+	config.Rules = append(config.Rules, RateLimitRule{Name: "conn", Rate: 1})
+	_, err = newRateLimiter(config)
+	assert.NotNil(t, err)
+}
+
+func TestRateLimitReply(t *testing.T) {
+	server := NewYYServer()
+	err := server.SetRateLimit(RateLimitConfig{Rules: []RateLimitRule{
+		{Name: "test", Scope: LimitConnURI, URIs: []uint32{1}, Rate: 1, Burst: 2, Policy: LimitReply, ResCode: 429},
+	}})
+	assert.Nil(t, err)
+	addr := startEchoServer(t, server)
+	defer stopServer(server)
+
+	conn, err := Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetTimeout(5*time.Second, 5*time.Second)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, conn.Send(&PTest{Int: uint32(i)}))
+	}
+	for i := 0; i < 2; i++ {
+		frame, err := conn.recvFrame()
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(2), binary.LittleEndian.Uint32(frame[4:8]))
+	}
+	frame, err := conn.recvFrame()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), binary.LittleEndian.Uint32(frame[4:8]))
+	assert.Equal(t, uint16(429), binary.LittleEndian.Uint16(frame[8:10]))
+
+	stats := server.RateLimitStats()["test"]
+	assert.Equal(t, uint64(2), stats.Allowed)
+	assert.Equal(t, uint64(1), stats.Limited)
+	var b strings.Builder
+	server.Metrics().WritePrometheus(&b, "yy")
+	assert.Contains(t, b.String(), `yy_ratelimit_limited_total{rule="test"} 1`)
+
+	// 运行时修改速率
+	console := NewConsole()
+	console.AddRateLimitCommand(server)
+	handle := console.commands["ratelimit"].handle
+	assert.Contains(t, handle([]string{"ratelimit", "set", "test", "1000", "10"}), "set rate limit test")
+	assert.Contains(t, handle([]string{"ratelimit", "set", "none", "1", "1"}), "not found")
+	assert.Contains(t, handle([]string{"ratelimit"}), "rule test scope conn_uri policy reply rate 1000 burst 10")
+	time.Sleep(20 * time.Millisecond)
+	assertEcho(t, conn, "after set")
+}
+
+func TestRateLimitRefund(t *testing.T) {
+	l, err := newRateLimiter(RateLimitConfig{Rules: []RateLimitRule{
+		{Name: "wide", Scope: LimitURI, Rate: 0.001, Burst: 3, Policy: LimitReply},
+		{Name: "narrow", Scope: LimitURI, URIs: []uint32{1}, Rate: 0.001, Burst: 1, Policy: LimitReply},
+	}})
+	assert.Nil(t, err)
+
+	// 后面的规则拒绝时不消耗前面规则的令牌，也不计入allowed
+	rule, _ := l.check(nil, 1, false)
+	assert.Nil(t, rule)
+	for i := 0; i < 3; i++ {
+		rule, _ = l.check(nil, 1, false)
+		assert.Equal(t, "narrow", rule.Name)
+	}
+	stats := l.stats()
+	assert.Equal(t, uint64(1), stats["wide"].Allowed)
+	assert.Equal(t, uint64(0), stats["wide"].Limited)
+	assert.Equal(t, uint64(1), stats["narrow"].Allowed)
+	assert.Equal(t, uint64(3), stats["narrow"].Limited)
+	assert.InDelta(t, 2, stats["wide"].Tokens[1], 0.01)
+}
+
+func TestRateLimitClose(t *testing.T) {
+	server := NewYYServer()
+	server.SetRateLimit(RateLimitConfig{Rules: []RateLimitRule{
+		{Name: "ip", Scope: LimitIP, Rate: 1, Burst: 1, Policy: LimitClose},
+	}})
+	closed := make(chan error, 1)
+	server.RegisterCloseFunc(func(c *YYConnect, err error) {
+		closed <- err
+	})
+	addr := startEchoServer(t, server)
+	defer stopServer(server)
+
+	conn, err := Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetTimeout(5*time.Second, 5*time.Second)
+	assertEcho(t, conn, "first")
+	conn.Send(&PTest{Str: "second"})
+	select {
+	case err := <-closed:
+		assert.Equal(t, ErrRateLimited, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+	assert.Equal(t, 1, server.RateLimitStats()["ip"].Buckets)
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	server := NewYYServer()
+	server.SetRateLimit(RateLimitConfig{Rules: []RateLimitRule{
+		{Name: "uri", Scope: LimitURI, Rate: 20, Burst: 1, Policy: LimitDelay},
+	}})
+	addr := startEchoServer(t, server)
+	defer stopServer(server)
+
+	conn, err := Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetTimeout(5*time.Second, 5*time.Second)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, conn.Send(&PTest{Int: uint32(i)}))
+	}
+	for i := 0; i < 3; i++ {
+		msg, err := conn.Recv(newTestRegister())
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(i), msg.(*PTestRes).Int)
+	}
+	// 第2、3个消息各等待50ms
+	assert.True(t, time.Since(start) >= 90*time.Millisecond)
+	stats := server.RateLimitStats()["uri"]
+	assert.Equal(t, uint64(3), stats.Allowed)
+	assert.Contains(t, stats.Tokens, uint32(1))
+}
@@ -0,0 +1,195 @@
+package yyserver
+
+import (
+	"sync"
+
+	"goBase/annego/packet"
+)
+
+// ConnFilter 广播时过滤连接，返回true的连接才会发送
+type ConnFilter func(*YYConnect) bool
+
+// connRegistry 记录YYServer接受的所有连接以及分组关系
+type connRegistry struct {
+	mut    sync.RWMutex
+	conns  map[uint64]*YYConnect
+	groups map[string]map[uint64]*YYConnect
+	joined map[uint64]map[string]struct{}
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{
+		conns:  make(map[uint64]*YYConnect),
+		groups: make(map[string]map[uint64]*YYConnect),
+		joined: make(map[uint64]map[string]struct{}),
+	}
+}
+
+func (r *connRegistry) add(conn *YYConnect) {
+	r.mut.Lock()
+	r.conns[conn.ID()] = conn
+	r.mut.Unlock()
+}
+
+// remove 删除连接，同时退出所有分组
+func (r *connRegistry) remove(conn *YYConnect) {
+	id := conn.ID()
+	r.mut.Lock()
+	delete(r.conns, id)
+	for group := range r.joined[id] {
+		r.leaveLocked(group, id)
+	}
+	delete(r.joined, id)
+	r.mut.Unlock()
+}
+
+func (r *connRegistry) leaveLocked(group string, id uint64) {
+	members, ok := r.groups[group]
+	if !ok {
+		return
+	}
+	delete(members, id)
+	if len(members) == 0 {
+		delete(r.groups, group)
+	}
+}
+
+// snapshot 复制连接列表，回调在锁外执行
+func (r *connRegistry) snapshot() []*YYConnect {
+	r.mut.RLock()
+	list := make([]*YYConnect, 0, len(r.conns))
+	for _, conn := range r.conns {
+		list = append(list, conn)
+	}
+	r.mut.RUnlock()
+	return list
+}
+
+func (r *connRegistry) groupSnapshot(group string) []*YYConnect {
+	r.mut.RLock()
+	members := r.groups[group]
+	list := make([]*YYConnect, 0, len(members))
+	for _, conn := range members {
+		list = append(list, conn)
+	}
+	r.mut.RUnlock()
+	return list
+}
+
+// fanout 将已打包的数据发送到所有连接，返回成功发送的连接数
+func fanout(list []*YYConnect, data []byte, filter ConnFilter) int {
+	count := 0
+	for _, conn := range list {
+		if filter != nil && !filter(conn) {
+			continue
+		}
+		if conn.sendFrame(data) == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// Count 返回当前连接数
+func (self *YYServer) Count() int {
+	self.registry.mut.RLock()
+	defer self.registry.mut.RUnlock()
+	return len(self.registry.conns)
+}
+
+// Range 遍历所有连接，fn返回false停止遍历
+// 遍历的是调用时的连接快照，fn中可以调用Kick等函数
+func (self *YYServer) Range(fn func(*YYConnect) bool) {
+	for _, conn := range self.registry.snapshot() {
+		if !fn(conn) {
+			return
+		}
+	}
+}
+
+// Get 根据连接ID获取连接，不存在返回nil
+func (self *YYServer) Get(id uint64) *YYConnect {
+	self.registry.mut.RLock()
+	defer self.registry.mut.RUnlock()
+	return self.registry.conns[id]
+}
+
+// Kick 关闭指定连接，CloseHandle收到reason。连接不存在返回false
+func (self *YYServer) Kick(id uint64, reason error) bool {
+	conn := self.Get(id)
+	if conn == nil {
+		return false
+	}
+	conn.closeWith(reason)
+	return true
+}
+
+// Broadcast 向filter选中的所有连接发送msg，filter为nil时发送给所有连接
+// msg只打包一次，返回成功发送的连接数
+// 设置SetSendQueue后通过异步队列发送，避免慢连接阻塞广播
+func (self *YYServer) Broadcast(msg packet.Marshallable, filter ConnFilter) int {
+	data := packet.GetMarshalPack(msg).Bytes()
+	return fanout(self.registry.snapshot(), data, filter)
+}
+
+// Join 连接加入分组，连接不属于该YYServer返回false
+func (self *YYServer) Join(group string, conn *YYConnect) bool {
+	r := self.registry
+	id := conn.ID()
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if _, ok := r.conns[id]; !ok {
+		return false
+	}
+
+	members, ok := r.groups[group]
+	if !ok {
+		members = make(map[uint64]*YYConnect)
+		r.groups[group] = members
+	}
+	members[id] = conn
+	joined, ok := r.joined[id]
+	if !ok {
+		joined = make(map[string]struct{})
+		r.joined[id] = joined
+	}
+	joined[group] = struct{}{}
+	return true
+}
+
+// Leave 连接退出分组，连接关闭时自动退出所有分组
+func (self *YYServer) Leave(group string, conn *YYConnect) {
+	r := self.registry
+	id := conn.ID()
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.leaveLocked(group, id)
+	if joined, ok := r.joined[id]; ok {
+		delete(joined, group)
+		if len(joined) == 0 {
+			delete(r.joined, id)
+		}
+	}
+}
+
+// GroupCount 返回分组内的连接数
+func (self *YYServer) GroupCount(group string) int {
+	self.registry.mut.RLock()
+	defer self.registry.mut.RUnlock()
+	return len(self.registry.groups[group])
+}
+
+// GroupRange 遍历分组内的连接，fn返回false停止遍历
+func (self *YYServer) GroupRange(group string, fn func(*YYConnect) bool) {
+	for _, conn := range self.registry.groupSnapshot(group) {
+		if !fn(conn) {
+			return
+		}
+	}
+}
+
+// GroupBroadcast 向分组内filter选中的连接发送msg，msg只打包一次，返回成功发送的连接数
+func (self *YYServer) GroupBroadcast(group string, msg packet.Marshallable, filter ConnFilter) int {
+	data := packet.GetMarshalPack(msg).Bytes()
+	return fanout(self.registry.groupSnapshot(group), data, filter)
+}
@@ -0,0 +1,120 @@
+package yyserver
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+)
+
+func TestRegistryBroadcast(t *testing.T) {
+	server := NewYYServer()
+	joined := make(chan *YYConnect, 4)
+	closed := make(chan error, 4)
+	server.RegisterConnectFunc(func(c *YYConnect) bool {
+		return true
+	})
+	server.RegisterCloseFunc(func(c *YYConnect, err error) {
+		closed <- err
+	})
+	// PTest.Int为奇数的连接加入odd分组
+	server.RegisterHandle(new(PTest), func(c *YYConnect, msg packet.Marshallable) bool {
+		if msg.(*PTest).Int%2 == 1 {
+			server.Join("odd", c)
+		}
+		joined <- c
+		return true
+	})
+	assert.Nil(t, server.Start("127.0.0.1:0"))
+	addr := server.GetListenAddr().String()
+
+	const total = 4
+	clients := make([]*YYConnect, total)
+	ids := make(map[uint64]int)
+	for i := 0; i < total; i++ {
+		conn, err := Dial("tcp", addr)
+		assert.Nil(t, err)
+		defer conn.Close()
+		conn.SetTimeout(time.Second, time.Second)
+		conn.Send(&PTest{Int: uint32(i)})
+		ids[(<-joined).ID()] = i
+		clients[i] = conn
+	}
+	assert.Equal(t, total, server.Count())
+	assert.Equal(t, 2, server.GroupCount("odd"))
+	for id := range ids {
+		assert.NotNil(t, server.Get(id))
+	}
+
+	reg := newTestRegister()
+	n := server.Broadcast(&PTestRes{Int: 100}, nil)
+	assert.Equal(t, total, n)
+	for _, conn := range clients {
+		msg, err := conn.Recv(reg)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(100), msg.(*PTestRes).Int)
+	}
+
+	n = server.GroupBroadcast("odd", &PTestRes{Int: 200}, nil)
+	assert.Equal(t, 2, n)
+	for i, conn := range clients {
+		if i%2 == 1 {
+			msg, err := conn.Recv(reg)
+			assert.Nil(t, err)
+			assert.Equal(t, uint32(200), msg.(*PTestRes).Int)
+		}
+	}
+
+	n = server.Broadcast(&PTestRes{Int: 300}, func(c *YYConnect) bool {
+		return ids[c.ID()] == 0
+	})
+	assert.Equal(t, 1, n)
+	msg, err := clients[0].Recv(reg)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(300), msg.(*PTestRes).Int)
+
+	// Kick之后退出所有分组，CloseHandle收到reason
+	reason := errors.New("kick test")
+	for id, i := range ids {
+		if i == 1 {
+			assert.True(t, server.Kick(id, reason))
+			assert.Equal(t, reason, <-closed)
+			assert.Nil(t, server.Get(id))
+			assert.False(t, server.Kick(id, reason))
+		}
+	}
+	assert.Equal(t, total-1, server.Count())
+	assert.Equal(t, 1, server.GroupCount("odd"))
+
+	count := 0
+	server.Range(func(c *YYConnect) bool {
+		count++
+		return true
+	})
+	assert.Equal(t, total-1, count)
+}
+
+func TestRegistryLeave(t *testing.T) {
+	r := newConnRegistry()
+	server := &YYServer{registry: r}
+	conn := newPipeConnect()
+	defer conn.Close()
+
+	assert.False(t, server.Join("room", conn))
+	r.add(conn)
+	assert.True(t, server.Join("room", conn))
+	assert.True(t, server.Join("hall", conn))
+	assert.Equal(t, 1, server.GroupCount("room"))
+
+	server.Leave("room", conn)
+	assert.Equal(t, 0, server.GroupCount("room"))
+	assert.Equal(t, 1, server.GroupCount("hall"))
+
+	r.remove(conn)
+	assert.Equal(t, 0, server.GroupCount("hall"))
+	assert.Equal(t, 0, len(r.groups))
+	assert.Equal(t, 0, len(r.joined))
+}
@@ -0,0 +1,246 @@
+package yyserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"goBase/annego/packet"
+)
+
+// Replayer 将抓包文件中的会话重新发送到目标服务，并将收到的回复与记录的回复比较
+// 每个记录的连接为一个会话，会话内按记录顺序发送接收方向的数据帧
+type Replayer struct {
+	Network string
+	Address string
+	Dialer  *Dialer // 为nil时使用默认配置
+
+	// Speed 回放速度倍数，按记录的时间间隔除以Speed等待，为0时不等待
+	Speed float64
+	// Concurrency 同时回放的会话数，默认为1
+	Concurrency int
+	// Timeout 会话发送完成后等待回复的时间，默认为5秒
+	Timeout time.Duration
+	// Compare 比较记录的回复与实际回复，默认逐字节比较
+	Compare func(expected, actual []byte) bool
+}
+
+// ReplayDiff 回复不一致的记录，Expected为nil表示多出的回复，Actual为nil表示缺少的回复
+type ReplayDiff struct {
+	ConnID   uint64
+	Index    int
+	Expected []byte
+	Actual   []byte
+}
+
+func (d ReplayDiff) String() string {
+	return fmt.Sprintf("conn %d reply %d: expected %s actual %s",
+		d.ConnID, d.Index, describeFrame(d.Expected), describeFrame(d.Actual))
+}
+
+func describeFrame(frame []byte) string {
+	if frame == nil {
+		return "none"
+	}
+	header, err := packet.PeekHeader(frame)
+	if err != nil {
+		return fmt.Sprintf("invalid frame %x", frame)
+	}
+	return fmt.Sprintf("uri %d rescode %d length %d", header.URI, header.ResCode, len(frame))
+}
+
+// ReplayResult 回放结果
+type ReplayResult struct {
+	Sessions int
+	Sent     int
+	Received int
+	Errors   []error
+	Diffs    []ReplayDiff
+}
+
+type replaySession struct {
+	connID uint64
+	in     []*CaptureRecord
+	out    [][]byte
+}
+
+// groupSessions 按连接ID划分会话，按连接首条记录的时间排序
+func groupSessions(records []*CaptureRecord) []*replaySession {
+	sessions := make(map[uint64]*replaySession)
+	order := make([]*replaySession, 0)
+	for _, record := range records {
+		sess, ok := sessions[record.ConnID]
+		if !ok {
+			sess = &replaySession{connID: record.ConnID}
+			sessions[record.ConnID] = sess
+			order = append(order, sess)
+		}
+		switch record.Direction {
+		case CaptureIn:
+			sess.in = append(sess.in, record)
+		case CaptureOut:
+			sess.out = append(sess.out, record.Frame)
+		}
+	}
+	return order
+}
+
+// Replay 回放records中的所有会话，ctx取消时停止回放
+func (r *Replayer) Replay(ctx context.Context, records []*CaptureRecord) *ReplayResult {
+	concurrency := r.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sessions := groupSessions(records)
+	result := &ReplayResult{Sessions: len(sessions)}
+
+	var mut sync.Mutex
+	var wg sync.WaitGroup
+	tokens := make(chan struct{}, concurrency)
+	for _, sess := range sessions {
+		select {
+		case tokens <- struct{}{}:
+		case <-ctx.Done():
+			mut.Lock()
+			result.Errors = append(result.Errors, ctx.Err())
+			mut.Unlock()
+			wg.Wait()
+			return result
+		}
+		wg.Add(1)
+		go func(sess *replaySession) {
+			defer wg.Done()
+			defer func() { <-tokens }()
+			sent, replies, err := r.replaySession(ctx, sess)
+			diffs := r.diff(sess, replies)
+
+			mut.Lock()
+			defer mut.Unlock()
+			result.Sent += sent
+			result.Received += len(replies)
+			if err != nil {
+				result.Errors = append(result.Errors, fmt.Errorf("conn %d: %v", sess.connID, err))
+			}
+			result.Diffs = append(result.Diffs, diffs...)
+		}(sess)
+	}
+	wg.Wait()
+
+	sort.Slice(result.Diffs, func(i, j int) bool {
+		if result.Diffs[i].ConnID != result.Diffs[j].ConnID {
+			return result.Diffs[i].ConnID < result.Diffs[j].ConnID
+		}
+		return result.Diffs[i].Index < result.Diffs[j].Index
+	})
+	return result
+}
+
+// replaySession 发送会话的数据帧，返回发送的数量和收到的回复
+func (r *Replayer) replaySession(ctx context.Context, sess *replaySession) (int, [][]byte, error) {
+	dialer := r.Dialer
+	if dialer == nil {
+		dialer = &Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, r.Network, r.Address)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+
+	var mut sync.Mutex
+	replies := make([][]byte, 0, len(sess.out))
+	collect := func() [][]byte {
+		mut.Lock()
+		defer mut.Unlock()
+		return append([][]byte(nil), replies...)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			frame, err := conn.recvFrame()
+			if err != nil {
+				return
+			}
+			mut.Lock()
+			replies = append(replies, frame)
+			enough := len(replies) >= len(sess.out)
+			mut.Unlock()
+			if enough {
+				return
+			}
+		}
+	}()
+
+	sent := 0
+	start := time.Now()
+	for _, record := range sess.in {
+		if r.Speed > 0 {
+			offset := time.Duration(float64(record.Time.Sub(sess.in[0].Time)) / r.Speed)
+			if wait := time.Until(start.Add(offset)); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return sent, collect(), ctx.Err()
+				}
+			}
+		}
+		if err := conn.writeFrame(record.Frame); err != nil {
+			return sent, collect(), err
+		}
+		sent++
+	}
+
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	if len(sess.out) > 0 {
+		select {
+		case <-done:
+		case <-time.After(timeout):
+		case <-ctx.Done():
+		}
+	}
+	conn.Close()
+	<-done
+	return sent, collect(), nil
+}
+
+func (r *Replayer) diff(sess *replaySession, replies [][]byte) []ReplayDiff {
+	compare := r.Compare
+	if compare == nil {
+		compare = bytes.Equal
+	}
+	diffs := make([]ReplayDiff, 0)
+	for i := 0; i < len(sess.out) || i < len(replies); i++ {
+		var expected, actual []byte
+		if i < len(sess.out) {
+			expected = sess.out[i]
+		}
+		if i < len(replies) {
+			actual = replies[i]
+		}
+		if expected == nil || actual == nil || !compare(expected, actual) {
+			diffs = append(diffs, ReplayDiff{sess.connID, i, expected, actual})
+		}
+	}
+	return diffs
+}
+
+// recvFrame 读取一个完整的数据帧并复制
+func (c *YYConnect) recvFrame() ([]byte, error) {
+	c.readMut.Lock()
+	defer c.readMut.Unlock()
+	frame, whole, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	if whole {
+		return frame, nil
+	}
+	return append([]byte(nil), frame...), nil
+}
@@ -0,0 +1,215 @@
+package yyserver
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"goBase/annego/packet"
+)
+
+// ErrSendQueueFull 异步发送队列已满
+var ErrSendQueueFull = errors.New("yyserver: send queue full")
+
+// OverflowPolicy 异步发送队列满时的处理策略
+type OverflowPolicy int
+
+const (
+	// OverflowBlock 阻塞等待队列有空闲位置
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDrop 丢弃当前消息，返回ErrSendQueueFull
+	OverflowDrop
+	// OverflowClose 关闭连接，返回ErrSendQueueFull
+	OverflowClose
+)
+
+// DefaultSendQueueSize 未设置时异步发送队列的默认长度
+const DefaultSendQueueSize = 1024
+
+// maxFlushBatch 单次Flush最多合并的消息数
+const maxFlushBatch = 128
+
+// SendQueueStats 异步发送队列统计
+type SendQueueStats struct {
+	Sent    uint64 // 已写入连接的消息数
+	Dropped uint64 // 因队列满丢弃的消息数
+	Flushes uint64 // Flush次数，Sent/Flushes反映合并程度
+	Len     int    // 当前排队消息数
+	Cap     int    // 队列容量
+	MaxLen  int    // 历史最大排队消息数
+}
+
+type sendQueue struct {
+	sent    uint64
+	dropped uint64
+	flushes uint64
+	maxLen  int32
+
+	ch     chan []byte
+	policy OverflowPolicy
+	start  sync.Once
+}
+
+func newSendQueue(size int, policy OverflowPolicy) *sendQueue {
+	if size <= 0 {
+		size = DefaultSendQueueSize
+	}
+	return &sendQueue{
+		ch:     make(chan []byte, size),
+		policy: policy,
+	}
+}
+
+func (q *sendQueue) updateMaxLen() {
+	l := int32(len(q.ch))
+	for {
+		old := atomic.LoadInt32(&q.maxLen)
+		if l <= old || atomic.CompareAndSwapInt32(&q.maxLen, old, l) {
+			return
+		}
+	}
+}
+
+func (q *sendQueue) stats() SendQueueStats {
+	return SendQueueStats{
+		Sent:    atomic.LoadUint64(&q.sent),
+		Dropped: atomic.LoadUint64(&q.dropped),
+		Flushes: atomic.LoadUint64(&q.flushes),
+		Len:     len(q.ch),
+		Cap:     cap(q.ch),
+		MaxLen:  int(atomic.LoadInt32(&q.maxLen)),
+	}
+}
+
+// SetSendQueue 设置异步发送队列长度和溢出策略，只能在首次SendAsync前设置一次
+func (c *YYConnect) SetSendQueue(size int, policy OverflowPolicy) {
+	c.queueMut.Lock()
+	defer c.queueMut.Unlock()
+	if c.queue != nil {
+		panic("YYConnect: SetSendQueue again")
+	}
+	c.queue = newSendQueue(size, policy)
+}
+
+func (c *YYConnect) getSendQueue() *sendQueue {
+	c.queueMut.Lock()
+	defer c.queueMut.Unlock()
+	if c.queue == nil {
+		c.queue = newSendQueue(DefaultSendQueueSize, OverflowBlock)
+	}
+	return c.queue
+}
+
+// SendAsync 将消息放入发送队列后立即返回，由单独的写goroutine批量写入并Flush
+// 队列满时根据OverflowPolicy处理，与Send之间不保证发送顺序
+func (c *YYConnect) SendAsync(msg packet.Marshallable) error {
+	pack := packet.GetMarshalPack(msg)
+	return c.enqueueFrame(pack.Bytes())
+}
+
+func (c *YYConnect) enqueueFrame(data []byte) error {
+	if split, err := c.sendFragments(data, c.enqueueFrame); split {
+		return err
+	}
+	if err := c.checkFrame(data); err != nil {
+		return err
+	}
+	if c.capture != nil {
+		return c.capture(data)
+	}
+	q := c.getSendQueue()
+	q.start.Do(func() {
+		go c.writeLoop(q)
+	})
+
+	select {
+	case <-c.closed:
+		return ErrConnClosed
+	default:
+	}
+
+	switch q.policy {
+	case OverflowDrop, OverflowClose:
+		select {
+		case q.ch <- data:
+		default:
+			atomic.AddUint64(&q.dropped, 1)
+			if q.policy == OverflowClose {
+				c.closeWith(ErrSendQueueFull)
+			}
+			return ErrSendQueueFull
+		}
+	default:
+		select {
+		case q.ch <- data:
+		case <-c.closed:
+			return ErrConnClosed
+		}
+	}
+	q.updateMaxLen()
+	return nil
+}
+
+// SendQueueStats 返回异步发送队列的统计信息
+func (c *YYConnect) SendQueueStats() SendQueueStats {
+	c.queueMut.Lock()
+	q := c.queue
+	c.queueMut.Unlock()
+	if q == nil {
+		return SendQueueStats{}
+	}
+	return q.stats()
+}
+
+// writeLoop 连接唯一的异步写goroutine，连接关闭后退出
+func (c *YYConnect) writeLoop(q *sendQueue) {
+	for {
+		select {
+		case data := <-q.ch:
+			if err := c.writeBatch(q, data); err != nil {
+				c.closeWith(err)
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// writeBatch 写入data以及队列中已有的消息，合并为一次Flush
+func (c *YYConnect) writeBatch(q *sendQueue, data []byte) error {
+	c.writeMut.Lock()
+	defer c.writeMut.Unlock()
+
+	if err := c.setWriteDeadline(); err != nil {
+		return err
+	}
+	count, bytes, messages := 0, 0, 0
+	for {
+		if err := c.write(data); err != nil {
+			return err
+		}
+		count++
+		bytes += len(data)
+		c.record(CaptureOut, data)
+		if c.isMessage(data) {
+			messages++
+		}
+		if count >= maxFlushBatch {
+			break
+		}
+		select {
+		case data = <-q.ch:
+			continue
+		default:
+		}
+		break
+	}
+	if err := c.flush(); err != nil {
+		return err
+	}
+	c.recordOutBatch(bytes, messages)
+	atomic.AddUint64(&q.sent, uint64(count))
+	atomic.AddUint64(&q.flushes, 1)
+	return nil
+}
@@ -0,0 +1,101 @@
+package yyserver
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendQueueDrop(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := NewYYConnect(client)
+	conn.SetSendQueue(2, OverflowDrop)
+
+	// 对端不读取，写goroutine阻塞在第一条消息，队列很快被填满
+	var dropped int
+	for i := 0; i < 10; i++ {
+		if err := conn.SendAsync(&PTest{uint32(i), "drop"}); err == ErrSendQueueFull {
+			dropped++
+		}
+	}
+	assert.True(t, dropped >= 7)
+	stats := conn.SendQueueStats()
+	assert.Equal(t, uint64(dropped), stats.Dropped)
+	assert.Equal(t, 2, stats.Cap)
+	assert.Equal(t, 2, stats.MaxLen)
+
+	conn.Close()
+	assert.Equal(t, ErrConnClosed, conn.SendAsync(&PTest{}))
+}
+
+func TestSendQueueClose(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := NewYYConnect(client)
+	conn.SetSendQueue(1, OverflowClose)
+
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = conn.SendAsync(&PTest{uint32(i), "close"})
+	}
+	assert.Equal(t, ErrSendQueueFull, err)
+	closed, reason := conn.closeReason()
+	assert.True(t, closed)
+	assert.Equal(t, ErrSendQueueFull, reason)
+}
+
+func TestSendQueueBlock(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := NewYYConnect(client)
+	conn.SetSendQueue(1, OverflowBlock)
+
+	done := make(chan error)
+	go func() {
+		var err error
+		for i := 0; i < 10 && err == nil; i++ {
+			err = conn.SendAsync(&PTest{uint32(i), "block"})
+		}
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("SendAsync should block when queue full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	conn.Close()
+	assert.Equal(t, ErrConnClosed, <-done)
+	_, err := server.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestSendQueueCoalesce(t *testing.T) {
+	client, server := net.Pipe()
+	conn := NewYYConnect(client)
+	defer conn.Close()
+	conn.SetSendQueue(64, OverflowBlock)
+
+	const total = 64
+	for i := 0; i < total; i++ {
+		assert.Nil(t, conn.SendAsync(&PTest{uint32(i), "coalesce"}))
+	}
+
+	peer := NewYYConnect(server)
+	reg := newTestRegister()
+	for i := 0; i < total; i++ {
+		msg, err := peer.Recv(reg)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(i), msg.(*PTest).Int)
+	}
+	// Flush返回后才更新统计
+	assert.Eventually(t, func() bool {
+		return conn.SendQueueStats().Sent == total
+	}, time.Second, time.Millisecond)
+	assert.True(t, conn.SendQueueStats().Flushes < total)
+}
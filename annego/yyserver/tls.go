@@ -0,0 +1,158 @@
+package yyserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"goBase/annego/logger"
+)
+
+// tlsHandshakeTimeout 服务端TLS握手超时时间
+const tlsHandshakeTimeout = 10 * time.Second
+
+// SetTLSConfig 设置TLS配置，新连接完成TLS握手后才调用ConnectHandle，应该在程序启动时调用
+// 需要客户端证书时设置config.ClientAuth和config.ClientCAs，通过YYConnect.PeerIdentity获取客户端身份
+// 证书需要热更新时使用CertReloader.GetCertificate
+func (self *YYServer) SetTLSConfig(config *tls.Config) {
+	if self.running {
+		panic("YYServer is runing")
+	}
+	self.tlsConfig = config
+}
+
+// serverHandshake 完成服务端TLS握手
+func serverHandshake(conn net.Conn, config *tls.Config) (*tls.Conn, error) {
+	tlsConn := tls.Server(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// TLSState 返回TLS连接状态，非TLS连接返回nil
+func (c *YYConnect) TLSState() *tls.ConnectionState {
+	tlsConn, ok := c.conn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	return &state
+}
+
+// PeerCertificate 返回对端证书，非TLS连接或对端未提供证书返回nil
+func (c *YYConnect) PeerCertificate() *x509.Certificate {
+	state := c.TLSState()
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
+
+// PeerIdentity 返回对端证书的CommonName，没有对端证书返回空字符串
+// 服务端只有在ClientAuth要求验证客户端证书时，该身份才是可信的
+func (c *YYConnect) PeerIdentity() string {
+	cert := c.PeerCertificate()
+	if cert == nil {
+		return ""
+	}
+	return cert.Subject.CommonName
+}
+
+// CertReloader 从文件加载证书，Reload后新的握手使用新证书，已建立的连接不受影响
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Value // *tls.Certificate
+
+	mut     sync.Mutex
+	modTime time.Time
+}
+
+// NewCertReloader 加载证书文件，文件错误返回error
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload 重新加载证书文件，失败时继续使用原有证书
+func (r *CertReloader) Reload() error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.reloadLocked()
+}
+
+func (r *CertReloader) reloadLocked() error {
+	modTime := r.fileModTime()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert.Store(&cert)
+	r.modTime = modTime
+	return nil
+}
+
+// fileModTime 返回证书和私钥文件中较新的修改时间
+func (r *CertReloader) fileModTime() time.Time {
+	var modTime time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime
+}
+
+// Watch 按interval检查证书文件，修改后自动Reload，返回的函数用来停止检查
+func (r *CertReloader) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.mut.Lock()
+				if r.fileModTime().After(r.modTime) {
+					if err := r.reloadLocked(); err != nil {
+						logger.Warning("reload cert %s error %v", r.certFile, err)
+					} else {
+						logger.Info("reload cert %s", r.certFile)
+					}
+				}
+				r.mut.Unlock()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// Certificate 返回当前使用的证书
+func (r *CertReloader) Certificate() *tls.Certificate {
+	return r.cert.Load().(*tls.Certificate)
+}
+
+// GetCertificate 用于服务端tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// GetClientCertificate 用于客户端tls.Config.GetClientCertificate
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
@@ -0,0 +1,198 @@
+package yyserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func (c *testCert) tlsCert(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	assert.Nil(t, err)
+	return cert
+}
+
+// newTestCert 生成证书，parent为nil时生成自签名CA
+func newTestCert(t *testing.T, name string, serial int64, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func certPool(ca *testCert) *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func TestTLSMutualAuth(t *testing.T) {
+	ca := newTestCert(t, "test-ca", 1, nil)
+	serverCert := newTestCert(t, "server", 2, ca)
+	clientCert := newTestCert(t, "client-001", 3, ca)
+
+	identity := make(chan string, 1)
+	server := NewYYServer()
+	server.SetTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{serverCert.tlsCert(t)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    certPool(ca),
+	})
+	server.RegisterConnectFunc(func(c *YYConnect) bool {
+		identity <- c.PeerIdentity()
+		return true
+	})
+	addr := startEchoServer(t, server)
+
+	dialer := Dialer{
+		Timeout: time.Second,
+		TLSConfig: &tls.Config{
+			RootCAs:      certPool(ca),
+			Certificates: []tls.Certificate{clientCert.tlsCert(t)},
+		},
+	}
+	conn, err := dialer.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	assert.Equal(t, "client-001", <-identity)
+	assert.Equal(t, "server", conn.PeerIdentity())
+	assert.NotNil(t, conn.TLSState())
+
+	conn.Send(&PTest{Int: 1, Str: "tls"})
+	msg, err := conn.Recv(newTestRegister())
+	assert.Nil(t, err)
+	assert.Equal(t, &PTestRes{Int: 1, Str: "tls"}, msg)
+
+	// 没有客户端证书无法建立连接
+	dialer.TLSConfig = &tls.Config{RootCAs: certPool(ca)}
+	conn2, err := dialer.Dial("tcp", addr)
+	if err == nil {
+		// TLS1.3客户端在握手后才会收到服务端的拒绝
+		_, err = conn2.Recv(newTestRegister())
+		conn2.Close()
+	}
+	assert.Error(t, err)
+}
+
+func TestTLSCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yytls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	writeCert := func(c *testCert) {
+		assert.Nil(t, ioutil.WriteFile(certFile, c.certPEM, 0600))
+		assert.Nil(t, ioutil.WriteFile(keyFile, c.keyPEM, 0600))
+	}
+
+	ca := newTestCert(t, "test-ca", 1, nil)
+	writeCert(newTestCert(t, "server-v1", 10, ca))
+	reloader, err := NewCertReloader(certFile, keyFile)
+	assert.Nil(t, err)
+
+	server := NewYYServer()
+	server.SetTLSConfig(&tls.Config{GetCertificate: reloader.GetCertificate})
+	server.RegisterHandle(new(PTest), func(c *YYConnect, msg packet.Marshallable) bool {
+		return true
+	})
+	assert.Nil(t, server.Start("127.0.0.1:0"))
+	dialer := Dialer{TLSConfig: &tls.Config{RootCAs: certPool(ca)}}
+
+	conn1, err := dialer.Dial("tcp", server.GetListenAddr().String())
+	assert.Nil(t, err)
+	defer conn1.Close()
+	assert.Equal(t, "server-v1", conn1.PeerIdentity())
+
+	writeCert(newTestCert(t, "server-v2", 11, ca))
+	assert.Nil(t, reloader.Reload())
+	conn2, err := dialer.Dial("tcp", server.GetListenAddr().String())
+	assert.Nil(t, err)
+	defer conn2.Close()
+	assert.Equal(t, "server-v2", conn2.PeerIdentity())
+
+	// 加载失败时保留原证书
+	assert.Nil(t, ioutil.WriteFile(keyFile, []byte("broken"), 0600))
+	assert.Error(t, reloader.Reload())
+	parsed, err := x509.ParseCertificate(reloader.Certificate().Certificate[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "server-v2", parsed.Subject.CommonName)
+}
+
+func TestTLSCertWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yytls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+
+	ca := newTestCert(t, "test-ca", 1, nil)
+	c1 := newTestCert(t, "server-v1", 10, ca)
+	ioutil.WriteFile(certFile, c1.certPEM, 0600)
+	ioutil.WriteFile(keyFile, c1.keyPEM, 0600)
+	reloader, err := NewCertReloader(certFile, keyFile)
+	assert.Nil(t, err)
+	stop := reloader.Watch(10 * time.Millisecond)
+	defer stop()
+
+	c2 := newTestCert(t, "server-v2", 11, ca)
+	ioutil.WriteFile(certFile, c2.certPEM, 0600)
+	ioutil.WriteFile(keyFile, c2.keyPEM, 0600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	os.Chtimes(keyFile, future, future)
+
+	assert.Eventually(t, func() bool {
+		cert, _ := reloader.GetCertificate(nil)
+		parsed, _ := x509.ParseCertificate(cert.Certificate[0])
+		return parsed.Subject.CommonName == "server-v2"
+	}, time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,332 @@
+package yyserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"goBase/annego/logger"
+	"goBase/annego/packet"
+)
+
+// MaxDatagramLength 单个UDP数据报可以携带的最大YY包长度
+const MaxDatagramLength = 65507
+
+// DefaultUDPSessionTimeout 未设置SetIdleTimeout时UDP会话的空闲超时时间
+const DefaultUDPSessionTimeout = 60 * time.Second
+
+// ErrMessageTooLarge 消息超过传输允许的最大长度，例如UDP数据报
+var ErrMessageTooLarge = errors.New("yyserver: message too large")
+
+var errUDPSessionRead = errors.New("yyserver: udp session does not support read")
+
+// checkDatagram 检查数据报是否恰好是一个完整的YY包
+func checkDatagram(data []byte) error {
+	length, err := packet.FrameLength(data)
+	if err == packet.ErrInputNotEnough {
+		if header, _ := packet.PeekHeader(data); header != nil {
+			return fmt.Errorf("datagram truncated, header length %d datagram %d", header.Length, len(data))
+		}
+		return fmt.Errorf("datagram too short, length %d", len(data))
+	} else if err != nil {
+		return err
+	}
+	if length != len(data) {
+		return fmt.Errorf("datagram has trailing data, header length %d datagram %d", length, len(data))
+	}
+	return nil
+}
+
+// udpConn UDP会话使用的伪连接，写入的每个YY包作为一个数据报发送到对端地址
+type udpConn struct {
+	pc      net.PacketConn
+	addr    net.Addr
+	writer  frameWriter
+	once    sync.Once
+	onClose func()
+}
+
+func newUDPConn(pc net.PacketConn, addr net.Addr, onClose func()) *udpConn {
+	c := &udpConn{pc: pc, addr: addr, onClose: onClose}
+	c.writer.writeFrame = func(frame []byte) error {
+		_, err := c.pc.WriteTo(frame, c.addr)
+		return err
+	}
+	return c
+}
+
+func (c *udpConn) Read(b []byte) (int, error) {
+	return 0, errUDPSessionRead
+}
+
+// Write 调用者持有YYConnect.writeMut，不会并发调用
+func (c *udpConn) Write(b []byte) (int, error) {
+	return c.writer.Write(b)
+}
+
+func (c *udpConn) Close() error {
+	c.once.Do(c.onClose)
+	return nil
+}
+
+func (c *udpConn) LocalAddr() net.Addr                { return c.pc.LocalAddr() }
+func (c *udpConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *udpConn) SetDeadline(t time.Time) error      { return nil }
+func (c *udpConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *udpConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type udpSession struct {
+	conn       *YYConnect
+	lastActive int64 // UnixNano，原子操作
+}
+
+// udpServer 在PacketConn上按对端地址维护会话
+type udpServer struct {
+	server  *YYServer
+	pc      net.PacketConn
+	timeout time.Duration
+
+	mut      sync.Mutex
+	sessions map[string]*udpSession
+}
+
+// StartUDP 监听UDP地址，每个数据报携带一个完整的YY包
+func (self *YYServer) StartUDP(addr string) error {
+	pc, err := self.sockopt.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	self.ServeUDP(pc)
+	return nil
+}
+
+// ServeUDP 在pc上处理YY数据报，立即返回，pc关闭后停止服务
+// 每个对端地址对应一个伪连接，与TCP连接一样调用ConnectHandle、MessageHandle和CloseHandle
+// 新会话与TCP连接一样经过准入控制，并使用服务器的发送队列和读缓冲区设置，被拒绝的数据报直接丢弃
+// 会话超过空闲超时时间(默认DefaultUDPSessionTimeout)没有收到数据时以ErrIdleTimeout关闭
+// 伪连接只能发送长度不超过MaxDatagramLength的消息，否则返回ErrMessageTooLarge
+func (self *YYServer) ServeUDP(pc net.PacketConn) {
+	self.prepare()
+	u := &udpServer{
+		server:   self,
+		pc:       pc,
+		timeout:  self.idleTimeout,
+		sessions: make(map[string]*udpSession),
+	}
+	if u.timeout <= 0 {
+		u.timeout = DefaultUDPSessionTimeout
+	}
+	go u.readLoop()
+	go u.expireLoop()
+}
+
+func (u *udpServer) readLoop() {
+	buf := make([]byte, MaxDatagramLength+1)
+	for {
+		n, addr, err := u.pc.ReadFrom(buf)
+		if err != nil {
+			if neterr, ok := err.(net.Error); ok && neterr.Temporary() {
+				continue
+			}
+			logger.Warning("udp read %v error %v, stop serve", u.pc.LocalAddr(), err)
+			u.closeAll()
+			return
+		}
+
+		data := buf[:n]
+		if err := checkDatagram(data); err != nil {
+			logger.Info("udp drop datagram from %v: %v", addr, err)
+			continue
+		}
+		sess := u.session(addr)
+		if sess == nil {
+			continue
+		}
+		atomic.StoreInt64(&sess.lastActive, time.Now().UnixNano())
+		u.handleDatagram(sess.conn, data)
+	}
+}
+
+// session 返回对端地址的会话，不存在时创建，准入控制或ConnectHandle拒绝时返回nil
+// 准入控制拒绝时不回复，避免向伪造的源地址发送数据
+func (u *udpServer) session(addr net.Addr) *udpSession {
+	key := addr.String()
+	u.mut.Lock()
+	sess, ok := u.sessions[key]
+	u.mut.Unlock()
+	if ok {
+		return sess
+	}
+	if a := u.server.admission; a != nil {
+		if _, ok := a.acquire(addr); !ok {
+			return nil
+		}
+	}
+
+	// 在加入会话表之前设置活跃时间，避免ConnectHandle返回前被当作超时清理
+	sess = &udpSession{lastActive: time.Now().UnixNano()}
+	conn := NewYYConnect(newUDPConn(u.pc, addr, func() {
+		go u.finish(key, sess)
+	}))
+	conn.maxFrame = MaxDatagramLength
+	conn.shared = true
+	conn.reader.datagram = true
+	if u.server.sendQueueSize > 0 {
+		conn.SetSendQueue(u.server.sendQueueSize, u.server.sendQueuePolicy)
+	}
+	conn.SetReadBuffer(u.server.readBuffer)
+	conn.SetHeartbeat(u.server.heartbeat)
+	conn.metrics = u.server.metrics
+	conn.recorder = u.server.recorder
+	u.server.startAuth(conn)
+	u.server.metrics.connAccepted()
+	sess.conn = conn
+
+	u.server.registry.add(conn)
+	u.mut.Lock()
+	u.sessions[key] = sess
+	u.mut.Unlock()
+	if u.server.connectHandle != nil && !u.server.connectHandle(conn) {
+		conn.closeWith(nil)
+		return nil
+	}
+	return sess
+}
+
+func (u *udpServer) handleDatagram(conn *YYConnect, data []byte) {
+	if conn.handleHeartbeat(data) {
+		conn.recordIn(data, false)
+		return
+	}
+	if err := checkFrameLength(data, conn.reader.maxsize); err != nil {
+		logger.Info("udp drop datagram from %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	start := time.Now()
+	conn.recordIn(data, true)
+	frame := append([]byte(nil), data...)
+	msg, _, err := u.server.register.UnmarshalBytes(frame)
+	if err != nil {
+		logger.Info("udp drop datagram from %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	if !u.server.handleRecv(conn, msg, newRecvInfo(frame, start)) {
+		conn.closeWith(nil)
+	}
+}
+
+// finish 会话关闭后调用，等待消息处理完成后调用CloseHandle
+func (u *udpServer) finish(key string, sess *udpSession) {
+	u.mut.Lock()
+	if u.sessions[key] == sess {
+		delete(u.sessions, key)
+	}
+	u.mut.Unlock()
+
+	u.server.registry.remove(sess.conn)
+	sess.conn.pending.Wait()
+	if a := u.server.admission; a != nil {
+		a.release(sess.conn.RemoteAddr())
+	}
+	u.server.metrics.connClosed()
+	if u.server.closeHandle != nil {
+		_, reason := sess.conn.closeReason()
+		u.server.closeHandle(sess.conn, reason)
+	}
+}
+
+// expireLoop 关闭空闲超时的会话
+func (u *udpServer) expireLoop() {
+	ticker := time.NewTicker(u.timeout / 2)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		expired := make([]*udpSession, 0)
+		u.mut.Lock()
+		if u.sessions == nil {
+			u.mut.Unlock()
+			return
+		}
+		for _, sess := range u.sessions {
+			last := time.Unix(0, atomic.LoadInt64(&sess.lastActive))
+			if now.Sub(last) >= u.timeout {
+				expired = append(expired, sess)
+			}
+		}
+		u.mut.Unlock()
+
+		for _, sess := range expired {
+			sess.conn.closeWith(ErrIdleTimeout)
+		}
+	}
+}
+
+// closeAll PacketConn关闭后关闭所有会话
+func (u *udpServer) closeAll() {
+	u.mut.Lock()
+	sessions := u.sessions
+	u.sessions = nil
+	u.mut.Unlock()
+	for _, sess := range sessions {
+		sess.conn.closeWith(ErrConnClosed)
+	}
+}
+
+// datagramConn 客户端使用的UDP连接
+// 写入的每个YY包作为一个数据报发送，读取时丢弃不是完整YY包的数据报
+type datagramConn struct {
+	net.Conn
+	writer frameWriter
+	buf    []byte
+}
+
+func newDatagramConn(c net.Conn) *datagramConn {
+	d := &datagramConn{Conn: c, buf: make([]byte, MaxDatagramLength+1)}
+	d.writer.writeFrame = func(frame []byte) error {
+		_, err := c.Write(frame)
+		return err
+	}
+	return d
+}
+
+func (d *datagramConn) Read(b []byte) (int, error) {
+	for {
+		n, err := d.Conn.Read(d.buf)
+		if err != nil {
+			return 0, err
+		}
+		if err := checkDatagram(d.buf[:n]); err != nil {
+			logger.Info("udp drop datagram from %v: %v", d.RemoteAddr(), err)
+			continue
+		}
+		if n > len(b) {
+			return 0, ErrMessageTooLarge
+		}
+		return copy(b, d.buf[:n]), nil
+	}
+}
+
+func (d *datagramConn) Write(b []byte) (int, error) {
+	return d.writer.Write(b)
+}
+
+// isDatagramNetwork 是否为UDP网络
+func isDatagramNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6":
+		return true
+	}
+	return false
+}
+
+// newDatagramConnect 将UDP连接包装为YYConnect
+func newDatagramConnect(c net.Conn) *YYConnect {
+	conn := NewYYConnect(newDatagramConn(c))
+	conn.maxFrame = MaxDatagramLength
+	conn.reader.SetReadsize(MaxDatagramLength + 1)
+	conn.reader.datagram = true
+	return conn
+}
@@ -0,0 +1,261 @@
+package yyserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+)
+
+type PBig struct {
+	Data []byte `yyp:"str32"`
+}
+
+func (self *PBig) GetURI() uint32 {
+	return 3
+}
+
+func (self *PBig) Marshal(pk *packet.Pack) {
+	packet.DefaultMarshal(self, pk)
+}
+
+func (self *PBig) Unmarshal(up *packet.Unpack) error {
+	return packet.DefaultUnmarshal(self, up)
+}
+
+func startUDPServer(t *testing.T, server *YYServer) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server.RegisterHandle(new(PTest), func(c *YYConnect, msg packet.Marshallable) bool {
+		req := msg.(*PTest)
+		c.Send(&PTestRes{req.Int, req.Str})
+		return req.Str != "bye"
+	})
+	server.ServeUDP(pc)
+	return pc.LocalAddr().String()
+}
+
+func dialUDP(t *testing.T, addr string) *YYConnect {
+	conn, err := Dial("udp", addr)
+	assert.Nil(t, err)
+	conn.SetTimeout(time.Second, time.Second)
+	return conn
+}
+
+func TestUDPEcho(t *testing.T) {
+	closed := make(chan error, 2)
+	server := NewYYServer()
+	server.RegisterCloseFunc(func(c *YYConnect, err error) {
+		closed <- err
+	})
+	addr := startUDPServer(t, server)
+
+	c1 := dialUDP(t, addr)
+	defer c1.Close()
+	c2 := dialUDP(t, addr)
+	defer c2.Close()
+	assertEcho(t, c1, "udp1")
+	assertEcho(t, c2, "udp2")
+	assert.Equal(t, 2, server.Count())
+
+	// 每个会话都能收到广播
+	assert.Equal(t, 2, server.Broadcast(&PTestRes{Int: 9}, nil))
+	reg := newTestRegister()
+	for _, c := range []*YYConnect{c1, c2} {
+		msg, err := c.Recv(reg)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(9), msg.(*PTestRes).Int)
+	}
+
+	// MessageHandle返回false关闭会话
+	assertEcho(t, c1, "bye")
+	assert.Nil(t, <-closed)
+	assert.Equal(t, 1, server.Count())
+}
+
+func TestUDPMessageTooLarge(t *testing.T) {
+	server := NewYYServer()
+	sendErr := make(chan error, 1)
+	server.RegisterHandle(new(PBig), func(c *YYConnect, msg packet.Marshallable) bool {
+		sendErr <- c.Send(&PBig{Data: make([]byte, MaxDatagramLength)})
+		return true
+	})
+	addr := startUDPServer(t, server)
+	conn := dialUDP(t, addr)
+	defer conn.Close()
+
+	assert.Equal(t, ErrMessageTooLarge, conn.Send(&PBig{Data: make([]byte, MaxDatagramLength)}))
+	assert.Equal(t, ErrMessageTooLarge, conn.SendAsync(&PBig{Data: make([]byte, MaxDatagramLength)}))
+	assert.Nil(t, conn.Send(&PBig{Data: make([]byte, 60000)}))
+	assert.Equal(t, ErrMessageTooLarge, <-sendErr)
+
+	// 超长消息被拒绝后连接仍然可用
+	assertEcho(t, conn, "after")
+}
+
+func TestUDPDialReadBuffer(t *testing.T) {
+	server := NewYYServer()
+	server.RegisterHandle(new(PBig), func(c *YYConnect, msg packet.Marshallable) bool {
+		c.Send(msg)
+		return true
+	})
+	addr := startUDPServer(t, server)
+
+	// Dialer的读缓冲区配置不影响按数据报读取
+	for _, config := range []ReadBufferConfig{{Pooled: true}, {ReadSize: 1024}} {
+		d := Dialer{ReadBuffer: config}
+		conn, err := d.Dial("udp", addr)
+		assert.Nil(t, err)
+		conn.SetTimeout(time.Second, time.Second)
+		assertEcho(t, conn, "small")
+		reg := packet.NewYYRegister()
+		reg.Register(new(PBig))
+		assert.Nil(t, conn.Send(&PBig{Data: make([]byte, 60000)}))
+		msg, err := conn.Recv(reg)
+		assert.Nil(t, err)
+		assert.Equal(t, 60000, len(msg.(*PBig).Data))
+		conn.Close()
+	}
+}
+
+func TestUDPInvalidDatagram(t *testing.T) {
+	server := NewYYServer()
+	addr := startUDPServer(t, server)
+
+	raw, err := net.Dial("udp", addr)
+	assert.Nil(t, err)
+	defer raw.Close()
+	frame := packet.GetMarshalPack(&PTest{Int: 1, Str: "raw"}).Bytes()
+	raw.Write(frame[:len(frame)-1])           // 截断
+	raw.Write(append(frame, 0))               // 多余数据
+	raw.Write([]byte{1, 2, 3})                // 不足包头
+	raw.Write(packet.PackFrame(99, 200, nil)) // 未注册URI
+	raw.Write(frame)
+	conn := NewYYConnect(newDatagramConn(raw))
+	conn.reader.SetReadsize(MaxDatagramLength + 1)
+	conn.SetTimeout(time.Second, time.Second)
+	msg, err := conn.Recv(newTestRegister())
+	assert.Nil(t, err)
+	assert.Equal(t, &PTestRes{Int: 1, Str: "raw"}, msg)
+	assert.Equal(t, 1, server.Count())
+}
+
+func TestUDPSessionTimeout(t *testing.T) {
+	closed := make(chan error, 1)
+	server := NewYYServer()
+	server.SetIdleTimeout(100 * time.Millisecond)
+	server.RegisterCloseFunc(func(c *YYConnect, err error) {
+		closed <- err
+	})
+	addr := startUDPServer(t, server)
+	conn := dialUDP(t, addr)
+	defer conn.Close()
+	assertEcho(t, conn, "timeout")
+
+	select {
+	case err := <-closed:
+		assert.Equal(t, ErrIdleTimeout, err)
+	case <-time.After(time.Second):
+		t.Fatal("udp session not expired")
+	}
+	assert.Equal(t, 0, server.Count())
+}
+
+func TestUDPSessionSlowConnect(t *testing.T) {
+	server := NewYYServer()
+	server.SetIdleTimeout(100 * time.Millisecond)
+	// ConnectHandle执行期间会话已在会话表中，不能被当作超时清理
+	server.RegisterConnectFunc(func(c *YYConnect) bool {
+		time.Sleep(80 * time.Millisecond)
+		return true
+	})
+	addr := startUDPServer(t, server)
+	conn := dialUDP(t, addr)
+	defer conn.Close()
+	assertEcho(t, conn, "slow")
+	assert.Equal(t, 1, server.Count())
+}
+
+func TestUDPAdmission(t *testing.T) {
+	server := NewYYServer()
+	assert.Nil(t, server.SetAdmission(AdmissionConfig{Deny: []string{"127.0.0.0/8"}}))
+	connected := make(chan struct{}, 1)
+	server.RegisterConnectFunc(func(c *YYConnect) bool {
+		connected <- struct{}{}
+		return true
+	})
+	addr := startUDPServer(t, server)
+	conn, err := Dial("udp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetTimeout(100*time.Millisecond, time.Second)
+
+	// 被拒绝的对端没有会话，也收不到回复
+	assert.Nil(t, conn.Send(&PTest{Int: 1, Str: "deny"}))
+	_, err = conn.Recv(newTestRegister())
+	assert.Error(t, err)
+	select {
+	case <-connected:
+		t.Fatal("ConnectHandle called for denied address")
+	default:
+	}
+	assert.Equal(t, 0, server.Count())
+	assert.Equal(t, uint64(1), server.RefuseStats()[RefuseDeny])
+}
+
+func TestUDPAdmissionRelease(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	server := NewYYServer()
+	assert.Nil(t, server.SetAdmission(AdmissionConfig{MaxConn: 1}))
+	server.RegisterCloseFunc(func(c *YYConnect, err error) {
+		closed <- struct{}{}
+	})
+	addr := startUDPServer(t, server)
+
+	c1 := dialUDP(t, addr)
+	defer c1.Close()
+	assertEcho(t, c1, "bye")
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("session not closed")
+	}
+
+	// 会话关闭后释放准入名额
+	c2 := dialUDP(t, addr)
+	defer c2.Close()
+	assertEcho(t, c2, "hello")
+	assert.Equal(t, uint64(0), server.RefuseStats()[RefuseMaxConn])
+}
+
+func TestUDPSessionReadBuffer(t *testing.T) {
+	server := NewYYServer()
+	server.SetReadBuffer(ReadBufferConfig{MaxSize: 1024})
+	addr := startUDPServer(t, server)
+	conn, err := Dial("udp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetTimeout(100*time.Millisecond, time.Second)
+
+	// 超过服务端读缓冲区最大长度的数据报被丢弃
+	assert.Nil(t, conn.Send(&PTest{Int: 1, Str: string(make([]byte, 2048))}))
+	_, err = conn.Recv(newTestRegister())
+	assert.Error(t, err)
+	assertEcho(t, conn, "small")
+}
+
+func TestUDPMetricsResCode(t *testing.T) {
+	server := NewYYServer()
+	addr := startUDPServer(t, server)
+	conn := dialUDP(t, addr)
+	defer conn.Close()
+	assert.Nil(t, conn.writeFrame(packet.PackFrame(1, 404, packet.MarshalBody(&PTest{1, "code"}))))
+	_, err := conn.Recv(newTestRegister())
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return server.Metrics().Snapshot().CodeLatency[404].Count == 1
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,308 @@
+package yyserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"goBase/annego/logger"
+	"goBase/annego/packet"
+)
+
+// wsGUID RFC 6455 握手使用的固定GUID
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsCloseTimeout 发送关闭帧的超时时间
+const wsCloseTimeout = time.Second
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn 将WebSocket连接包装为net.Conn，YY包在二进制消息中传输
+// 写入的每个YY包作为一个二进制消息发送，读取时将二进制消息拼接为字节流
+// 数据帧的负载直接读入调用者的缓冲区，数据帧长度由YYConnect的读缓冲区MaxSize限制
+type wsConn struct {
+	net.Conn
+	reader   io.Reader
+	isClient bool
+
+	writeSem chan struct{} // 写入锁，容量为1，关闭时可以不等待正在阻塞的写入
+	writer   frameWriter
+
+	frame     *wsFrame // 当前未读取完的数据帧
+	remaining uint64   // frame未读取的负载长度
+	closing   bool     // 已收到或已发送关闭帧
+}
+
+func newWSConn(conn net.Conn, reader io.Reader, isClient bool) *wsConn {
+	c := &wsConn{Conn: conn, reader: reader, isClient: isClient, writeSem: make(chan struct{}, 1)}
+	c.writer.writeFrame = func(frame []byte) error {
+		return writeWSFrame(c.Conn, wsOpBinary, frame, c.isClient)
+	}
+	return c
+}
+
+// Read YYConnect在持有readMut时调用，不会并发调用
+func (c *wsConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		f, err := readWSHeader(c.reader, packet.MaxPacketLength, !c.isClient)
+		if err == nil && f.isControl() {
+			err = f.readPayload(c.reader)
+		}
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				c.sendClose(wsCloseProtocol, "")
+			}
+			return 0, err
+		}
+
+		switch f.opcode {
+		case wsOpBinary, wsOpContinuation:
+			c.frame = f
+			c.remaining = f.length
+		case wsOpPing:
+			c.writeControl(wsOpPong, f.payload)
+		case wsOpPong:
+		case wsOpClose:
+			c.sendClose(wsCloseNormal, "")
+			return 0, io.EOF
+		default:
+			c.sendClose(wsCloseUnsupported, "binary message only")
+			return 0, fmt.Errorf("%v: unsupported opcode %d", errWSProtocol, f.opcode)
+		}
+	}
+
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.reader.Read(b)
+	if c.frame.masked {
+		offset := c.frame.length - c.remaining
+		for i := 0; i < n; i++ {
+			b[i] ^= c.frame.mask[(offset+uint64(i))&3]
+		}
+	}
+	c.remaining -= uint64(n)
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Write YYConnect在持有writeMut时调用，与控制帧之间使用writeSem互斥
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.writeSem <- struct{}{}
+	defer func() { <-c.writeSem }()
+	return c.writer.Write(b)
+}
+
+func (c *wsConn) writeControl(opcode byte, payload []byte) error {
+	c.writeSem <- struct{}{}
+	defer func() { <-c.writeSem }()
+	return writeWSFrame(c.Conn, opcode, payload, c.isClient)
+}
+
+// sendClose 发送关闭帧，只发送一次
+// 正在写入时不等待也不发送，写入可能因为对端不读取而一直阻塞
+func (c *wsConn) sendClose(code uint16, reason string) {
+	select {
+	case c.writeSem <- struct{}{}:
+	default:
+		return
+	}
+	defer func() { <-c.writeSem }()
+	if c.closing {
+		return
+	}
+	c.closing = true
+	c.Conn.SetWriteDeadline(time.Now().Add(wsCloseTimeout))
+	writeWSFrame(c.Conn, wsOpClose, wsClosePayload(code, reason), c.isClient)
+}
+
+// Close 尽量发送关闭帧后关闭底层连接，关闭底层连接使阻塞的写入返回
+func (c *wsConn) Close() error {
+	c.sendClose(wsCloseNormal, "")
+	return c.Conn.Close()
+}
+
+// WebSocketHandler 返回WebSocket网关，升级后的连接与TCP连接使用相同的handle、准入控制和连接管理
+// 每个YY包使用一个二进制消息传输，SetTLSConfig对该网关无效，需要TLS时使用http.Server的TLS
+// checkOrigin为nil时接受所有Origin
+func (self *YYServer) WebSocketHandler(checkOrigin func(*http.Request) bool) http.Handler {
+	self.prepare()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !headerContains(r.Header, "Connection", "upgrade") ||
+			!headerContains(r.Header, "Upgrade", "websocket") {
+			http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Sec-WebSocket-Version") != "13" {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+			return
+		}
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if key == "" {
+			http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+			return
+		}
+		if checkOrigin != nil && !checkOrigin(r) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "websocket not supported", http.StatusInternalServerError)
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			logger.Warning("websocket hijack %v error %v", r.RemoteAddr, err)
+			return
+		}
+		// 清除http.Server按ReadTimeout、WriteTimeout设置的期限，升级后的连接由YYConnect设置超时
+		conn.SetDeadline(time.Time{})
+
+		response := "HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n"
+		if _, err := conn.Write([]byte(response)); err != nil {
+			conn.Close()
+			return
+		}
+		self.admit(newWSConn(conn, rw.Reader, false), func(conn net.Conn, release func()) {
+			defer release()
+			self.serveConnect(conn)
+		})
+	})
+}
+
+// DialWebSocket 使用WebSocket连接YYServer.WebSocketHandler，rawurl为ws://或wss://
+// wss使用d.TLSConfig，为nil时使用默认配置
+// 与Dial一样，没有设置DialContextFunc时按d.Socket建立TCP连接
+func (d *Dialer) DialWebSocket(ctx context.Context, rawurl string) (*YYConnect, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("yyserver: unsupported websocket scheme %s", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	if d.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	dial := d.DialContextFunc
+	if dial == nil {
+		dial = d.Socket.DialContext
+	}
+	conn, err := dial(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		tlsDialer := *d
+		if tlsDialer.TLSConfig == nil {
+			tlsDialer.TLSConfig = &tls.Config{}
+		}
+		if conn, err = tlsDialer.clientHandshake(ctx, conn, host); err != nil {
+			return nil, err
+		}
+	}
+
+	reader, err := wsClientHandshake(ctx, conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	yyconn := NewYYConnect(newWSConn(conn, reader, true))
+	yyconn.SetFragment(d.Fragment)
+	if err := d.negotiateMux(ctx, yyconn); err != nil {
+		return nil, err
+	}
+	d.setupConnect(yyconn)
+	return yyconn, nil
+}
+
+// DialWebSocket 使用默认配置建立WebSocket连接
+func DialWebSocket(rawurl string) (*YYConnect, error) {
+	var d Dialer
+	return d.DialWebSocket(context.Background(), rawurl)
+}
+
+// wsClientHandshake 发送升级请求并校验回复，返回后续读取使用的reader
+func wsClientHandshake(ctx context.Context, conn net.Conn, u *url.URL) (io.Reader, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	path := u.RequestURI()
+	request := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + u.Host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("yyserver: websocket handshake status %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		return nil, fmt.Errorf("yyserver: websocket handshake accept key mismatch")
+	}
+	return reader, nil
+}
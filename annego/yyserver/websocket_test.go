@@ -0,0 +1,258 @@
+package yyserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+)
+
+func TestWSFrameRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, 125, 126, 0xFFFF, 0x10000} {
+		payload := bytes.Repeat([]byte{'a'}, size)
+		for _, mask := range []bool{false, true} {
+			var buf bytes.Buffer
+			assert.Nil(t, writeWSFrame(&buf, wsOpBinary, payload, mask))
+			f, err := readWSFrame(&buf, packet.MaxPacketLength, mask)
+			assert.Nil(t, err)
+			assert.True(t, f.fin)
+			assert.Equal(t, byte(wsOpBinary), f.opcode)
+			assert.Equal(t, payload, f.payload)
+			assert.Equal(t, 0, buf.Len())
+		}
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(t, writeWSFrame(&buf, wsOpBinary, []byte("abc"), false))
+	_, err := readWSFrame(&buf, packet.MaxPacketLength, true)
+	assert.NotNil(t, err)
+
+	buf.Reset()
+	assert.Nil(t, writeWSFrame(&buf, wsOpBinary, make([]byte, 200), false))
+	_, err = readWSFrame(&buf, 100, false)
+	assert.NotNil(t, err)
+}
+
+func startWebSocketServer(t *testing.T, server *YYServer) (*httptest.Server, string) {
+	server.RegisterHandle(new(PTest), func(c *YYConnect, msg packet.Marshallable) bool {
+		req := msg.(*PTest)
+		c.Send(&PTestRes{req.Int, req.Str})
+		return true
+	})
+	hs := httptest.NewServer(server.WebSocketHandler(nil))
+	return hs, "ws" + strings.TrimPrefix(hs.URL, "http") + "/yy"
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	server := NewYYServer()
+	hs, url := startWebSocketServer(t, server)
+	defer hs.Close()
+
+	conn, err := DialWebSocket(url)
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetTimeout(5*time.Second, 5*time.Second)
+
+	assertEcho(t, conn, "websocket")
+	// 使用16位扩展长度的消息
+	assertEcho(t, conn, strings.Repeat("x", 60000))
+	assert.Equal(t, 1, server.Count())
+}
+
+func TestWebSocketFragment(t *testing.T) {
+	config := FragmentConfig{URI: testFragmentURI, Size: 1000}
+	server := NewYYServer()
+	assert.Nil(t, server.SetFragment(config))
+	// 未分片的大消息超过读缓冲区最大长度会被关闭连接
+	server.SetReadBuffer(ReadBufferConfig{MaxSize: 2048})
+	hs, url := startWebSocketServer(t, server)
+	defer hs.Close()
+
+	d := &Dialer{Fragment: config}
+	conn, err := d.DialWebSocket(context.Background(), url)
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetTimeout(5*time.Second, 5*time.Second)
+	assertEcho(t, conn, strings.Repeat("f", 5000))
+}
+
+func TestWebSocketBroadcast(t *testing.T) {
+	server := NewYYServer()
+	hs, url := startWebSocketServer(t, server)
+	defer hs.Close()
+	// TCP与WebSocket连接共享同一个连接管理
+	assert.Nil(t, server.Start("127.0.0.1:0"))
+
+	wsConn, err := DialWebSocket(url)
+	assert.Nil(t, err)
+	defer wsConn.Close()
+	tcpConn, err := Dial("tcp", server.GetListenAddr().String())
+	assert.Nil(t, err)
+	defer tcpConn.Close()
+
+	assertEcho(t, wsConn, "ws")
+	assertEcho(t, tcpConn, "tcp")
+	assert.Equal(t, 2, server.Broadcast(&PTestRes{Int: 7, Str: "all"}, nil))
+
+	for _, conn := range []*YYConnect{wsConn, tcpConn} {
+		conn.SetTimeout(5*time.Second, 5*time.Second)
+		msg, err := conn.Recv(newTestRegister())
+		assert.Nil(t, err)
+		assert.Equal(t, &PTestRes{Int: 7, Str: "all"}, msg)
+	}
+}
+
+func TestWebSocketPingAndClose(t *testing.T) {
+	server := NewYYServer()
+	closed := make(chan error, 1)
+	server.RegisterCloseFunc(func(c *YYConnect, reason error) {
+		closed <- reason
+	})
+	hs, url := startWebSocketServer(t, server)
+	defer hs.Close()
+
+	raw, reader := dialRawWebSocket(t, hs, url)
+	defer raw.Close()
+
+	assert.Nil(t, writeWSFrame(raw, wsOpPing, []byte("hi"), true))
+	f, err := readWSFrame(reader, packet.MaxPacketLength, false)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(wsOpPong), f.opcode)
+	assert.Equal(t, []byte("hi"), f.payload)
+
+	assert.Nil(t, writeWSFrame(raw, wsOpClose, wsClosePayload(wsCloseNormal, ""), true))
+	f, err = readWSFrame(reader, packet.MaxPacketLength, false)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(wsOpClose), f.opcode)
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close handle not called")
+	}
+}
+
+// dialRawWebSocket 完成握手并返回原始连接，用于发送自定义的帧
+func dialRawWebSocket(t *testing.T, hs *httptest.Server, url string) (net.Conn, io.Reader) {
+	raw, err := net.Dial("tcp", strings.TrimPrefix(hs.URL, "http://"))
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	u, _ := neturl.Parse(url)
+	reader, err := wsClientHandshake(context.Background(), raw, u)
+	assert.Nil(t, err)
+	return raw, reader
+}
+
+func TestWebSocketDeclaredLength(t *testing.T) {
+	server := NewYYServer()
+	hs, url := startWebSocketServer(t, server)
+	defer hs.Close()
+
+	// 声明32MB的数据帧，负载按到达的数据读取，不等待也不预先分配整个帧
+	raw, reader := dialRawWebSocket(t, hs, url)
+	defer raw.Close()
+	header := []byte{0x80 | wsOpBinary, 0x80 | 127, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(header[2:], 32*1024*1024)
+	raw.Write(header)
+	raw.Write(packet.GetMarshalPack(&PTest{Int: 1, Str: "partial"}).Bytes())
+	f, err := readWSFrame(reader, packet.MaxPacketLength, false)
+	assert.Nil(t, err)
+	assert.Equal(t, packet.GetMarshalPack(&PTestRes{Int: 1, Str: "partial"}).Bytes(), f.payload)
+
+	// 声明长度超过上限时读取帧头后关闭连接
+	raw, reader = dialRawWebSocket(t, hs, url)
+	defer raw.Close()
+	binary.BigEndian.PutUint64(header[2:], 1<<40)
+	raw.Write(header)
+	f, err = readWSFrame(reader, packet.MaxPacketLength, false)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(wsOpClose), f.opcode)
+}
+
+func TestWebSocketKickStalledPeer(t *testing.T) {
+	server := NewYYServer()
+	writing := make(chan *YYConnect, 1)
+	// 连接建立后持续发送大消息，对端不读取时写入阻塞
+	server.RegisterConnectFunc(func(c *YYConnect) bool {
+		go func() {
+			writing <- c
+			for c.Send(&PBig{Data: make([]byte, 64*1024)}) == nil {
+			}
+		}()
+		return true
+	})
+	hs, url := startWebSocketServer(t, server)
+	defer hs.Close()
+	raw, _ := dialRawWebSocket(t, hs, url)
+	defer raw.Close()
+
+	conn := <-writing
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	assert.True(t, server.Kick(conn.ID(), ErrIdleTimeout))
+	assert.True(t, time.Since(start) < wsCloseTimeout/2, time.Since(start))
+}
+
+func TestWebSocketUnsupportedScheme(t *testing.T) {
+	dialed := 0
+	d := &Dialer{DialContextFunc: func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed++
+		return nil, errors.New("unexpected dial")
+	}}
+	_, err := d.DialWebSocket(context.Background(), "http://127.0.0.1:1/yy")
+	assert.EqualError(t, err, "yyserver: unsupported websocket scheme http")
+	assert.Equal(t, 0, dialed)
+}
+
+func TestWebSocketServerTimeout(t *testing.T) {
+	server := NewYYServer()
+	server.RegisterHandle(new(PTest), func(c *YYConnect, msg packet.Marshallable) bool {
+		req := msg.(*PTest)
+		c.Send(&PTestRes{req.Int, req.Str})
+		return true
+	})
+	hs := httptest.NewUnstartedServer(server.WebSocketHandler(nil))
+	hs.Config.ReadTimeout = 100 * time.Millisecond
+	hs.Config.WriteTimeout = 100 * time.Millisecond
+	hs.Start()
+	defer hs.Close()
+
+	// 升级后的连接不受http.Server超时的影响
+	conn, err := DialWebSocket("ws" + strings.TrimPrefix(hs.URL, "http") + "/yy")
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetTimeout(5*time.Second, 5*time.Second)
+	assertEcho(t, conn, "before")
+	time.Sleep(300 * time.Millisecond)
+	assertEcho(t, conn, "after")
+}
+
+func TestWebSocketRejectPlainRequest(t *testing.T) {
+	server := NewYYServer()
+	hs := httptest.NewServer(server.WebSocketHandler(func(r *http.Request) bool {
+		return r.Header.Get("Origin") == "http://example.com"
+	}))
+	defer hs.Close()
+
+	resp, err := http.Get(hs.URL)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	_, err = DialWebSocket("ws" + strings.TrimPrefix(hs.URL, "http"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,190 @@
+package yyserver
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// WebSocket帧格式 RFC 6455 5.2
+/*
+ 0                   1                   2                   3
+ 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
++-+-+-+-+-------+-+-------------+-------------------------------+
+|F|R|R|R| opcode|M| Payload len |    Extended payload length    |
+|I|S|S|S|  (4)  |A|     (7)     |             (16/64)           |
+|N|V|V|V|       |S|             |   (if payload len==126/127)   |
+| |1|2|3|       |K|             |                               |
++-+-+-+-+-------+-+-------------+ - - - - - - - - - - - - - - - +
+|     Extended payload length continued, if payload len == 127  |
++ - - - - - - - - - - - - - - - +-------------------------------+
+|                               |Masking-key, if MASK set to 1  |
++-------------------------------+-------------------------------+
+| Masking-key (continued)       |          Payload Data         |
++-------------------------------- - - - - - - - - - - - - - - - +
+*/
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// 关闭帧状态码
+const (
+	wsCloseNormal      = 1000
+	wsCloseProtocol    = 1002
+	wsCloseUnsupported = 1003
+	wsCloseTooBig      = 1009
+)
+
+// wsMaxControlPayload 控制帧最大负载长度
+const wsMaxControlPayload = 125
+
+var errWSProtocol = errors.New("yyserver: websocket protocol error")
+
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	length  uint64
+	masked  bool
+	mask    [4]byte
+	payload []byte
+}
+
+func (f *wsFrame) isControl() bool {
+	return f.opcode&0x8 != 0
+}
+
+// readWSFrame 读取一个完整的WebSocket帧，负载超过maxPayload返回错误
+// requireMask为true时要求帧带掩码（服务端读取客户端帧）
+func readWSFrame(r io.Reader, maxPayload int, requireMask bool) (*wsFrame, error) {
+	f, err := readWSHeader(r, maxPayload, requireMask)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.readPayload(r); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// readWSHeader 只读取帧头和掩码，负载由调用者读取，不按对端声明的长度分配内存
+func readWSHeader(r io.Reader, maxPayload int, requireMask bool) (*wsFrame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	f := &wsFrame{
+		fin:    head[0]&0x80 != 0,
+		opcode: head[0] & 0x0F,
+	}
+	if head[0]&0x70 != 0 {
+		return nil, fmt.Errorf("%v: reserved bits set", errWSProtocol)
+	}
+	masked := head[1]&0x80 != 0
+	if masked != requireMask {
+		return nil, fmt.Errorf("%v: mask bit %v", errWSProtocol, masked)
+	}
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if f.isControl() && (length > wsMaxControlPayload || !f.fin) {
+		return nil, fmt.Errorf("%v: invalid control frame", errWSProtocol)
+	}
+	if length > uint64(maxPayload) {
+		return nil, fmt.Errorf("%v: payload length %d exceeds %d", errWSProtocol, length, maxPayload)
+	}
+
+	f.length = length
+	f.masked = masked
+	if masked {
+		if _, err := io.ReadFull(r, f.mask[:]); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// readPayload 读取完整的负载，用于控制帧等长度已经受限的帧
+func (f *wsFrame) readPayload(r io.Reader) error {
+	f.payload = make([]byte, f.length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return err
+	}
+	if f.masked {
+		maskBytes(f.mask, f.payload)
+	}
+	return nil
+}
+
+// writeWSFrame 写入单个完整的WebSocket帧，mask为true时使用随机掩码（客户端发送）
+func writeWSFrame(w io.Writer, opcode byte, payload []byte, mask bool) error {
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|opcode)
+
+	var maskBit byte
+	if mask {
+		maskBit = 0x80
+	}
+	length := len(payload)
+	switch {
+	case length <= 125:
+		buf = append(buf, maskBit|byte(length))
+	case length <= 0xFFFF:
+		buf = append(buf, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(length))
+	default:
+		buf = append(buf, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[len(buf)-8:], uint64(length))
+	}
+
+	if mask {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		buf = append(buf, key[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		maskBytes(key, buf[start:])
+	} else {
+		buf = append(buf, payload...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i&3]
+	}
+}
+
+// wsClosePayload 生成关闭帧负载
+func wsClosePayload(code uint16, reason string) []byte {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	if len(reason) > wsMaxControlPayload-2 {
+		reason = reason[:wsMaxControlPayload-2]
+	}
+	return append(payload, reason...)
+}
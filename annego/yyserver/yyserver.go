@@ -1,16 +1,19 @@
 package yyserver
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"goBase/annego/logger"
 	"goBase/annego/packet"
+	"goBase/annego/util"
 )
 
-// 回调函数在各自连接的goroutine中执行
+// 回调函数默认在各自连接的goroutine中执行，可通过SetDispatch修改MessageHandle的执行方式
 // 回调函数必须做到可重入
 
 // ConnectHandle 建立连接时调用，返回false终止连接
@@ -23,17 +26,56 @@ type MessageHandle func(*YYConnect, packet.Marshallable) bool
 // nil 用户通过ConnechHandle或MessageHandle主动关闭
 // io.ErrClosedPipe 连接goroutine外关闭连接
 // io.EOF 对端关闭连接
+// ErrIdleTimeout 连接空闲超时
+// Kick传入的reason
+// ErrSendQueueFull 异步发送队列溢出，策略为OverflowClose
+// ErrRateLimited 超过限流规则，策略为LimitClose
+// ErrAuthTimeout、ErrAuthFailed、ErrUnauthenticated 认证失败，见AuthConfig
+// ErrMuxProtocol 流数据帧不符合协议，见MuxConfig
 type CloseHandle func(*YYConnect, error)
 
 // YYServer YY协议处理服务，对应一个监听端口
 // 可以设置回调函数，对划分好的YY协议进行处理
 type YYServer struct {
+	running   bool
 	listener  net.Listener
 	uriHandle map[uint32]MessageHandle
 	register  *packet.YYRegister
 
 	connectHandle ConnectHandle
 	closeHandle   CloseHandle
+
+	sendQueueSize   int
+	sendQueuePolicy OverflowPolicy
+
+	dispatchConfig DispatchConfig
+	dispatcher     *dispatcher
+
+	registry *connRegistry
+
+	idleTimeout time.Duration
+	heartbeat   Heartbeat
+	readBuffer  ReadBufferConfig
+
+	fragment       FragmentConfig
+	fragmentBudget *fragmentBudget
+
+	mux MuxConfig
+
+	forwarder *proxyHandler
+
+	admission *admission
+	proxy     *proxyProtocol
+	sockopt   util.SocketOptions
+	tlsConfig *tls.Config
+	metrics   *Metrics
+	recorder  *Recorder
+	limiter   *rateLimiter
+	auth      *authState
+
+	engine      Engine
+	engineLoops int
+	events      *eventEngine
 }
 
 func NewYYServer() *YYServer {
@@ -41,12 +83,14 @@ func NewYYServer() *YYServer {
 	server.listener = nil
 	server.uriHandle = map[uint32]MessageHandle{}
 	server.register = packet.NewYYRegister()
+	server.registry = newConnRegistry()
+	server.metrics = newMetrics()
 	return &server
 }
 
 // RegisterConnectFunc 应该在程序启动时调用
 func (self *YYServer) RegisterConnectFunc(handle ConnectHandle) {
-	if self.listener != nil {
+	if self.running {
 		panic("YYServer is runing")
 	}
 	self.connectHandle = handle
@@ -54,15 +98,78 @@ func (self *YYServer) RegisterConnectFunc(handle ConnectHandle) {
 
 // RegisterCloseFunc 应该在程序启动时调用
 func (self *YYServer) RegisterCloseFunc(handle CloseHandle) {
-	if self.listener != nil {
+	if self.running {
 		panic("YYServer is runing")
 	}
 	self.closeHandle = handle
 }
 
+// SetSendQueue 设置新连接SendAsync使用的发送队列长度和溢出策略，应该在程序启动时调用
+func (self *YYServer) SetSendQueue(size int, policy OverflowPolicy) {
+	if self.running {
+		panic("YYServer is runing")
+	}
+	self.sendQueueSize = size
+	self.sendQueuePolicy = policy
+}
+
+// SetIdleTimeout 设置新连接的空闲超时时间，超时的连接关闭并以ErrIdleTimeout调用CloseHandle
+// 应该在程序启动时调用，单个连接可以在ConnectHandle中通过YYConnect.SetIdleTimeout修改
+func (self *YYServer) SetIdleTimeout(timeout time.Duration) {
+	if self.running {
+		panic("YYServer is runing")
+	}
+	self.idleTimeout = timeout
+}
+
+// SetHeartbeat 设置心跳协议，收到PingURI自动回复PongURI，不会调用MessageHandle
+// 应该在程序启动时调用，客户端可以使用Dialer.KeepAlive定期发送心跳
+func (self *YYServer) SetHeartbeat(heartbeat Heartbeat) {
+	if self.running {
+		panic("YYServer is runing")
+	}
+	self.heartbeat = heartbeat
+}
+
+// SetReadBuffer 设置新连接的读缓冲区，应该在程序启动时调用
+// MaxSize限制了可以接收的数据帧长度，Pooled为true时空闲连接的读缓冲区归还共享的缓冲池
+// 事件循环引擎只使用MaxSize
+func (self *YYServer) SetReadBuffer(config ReadBufferConfig) {
+	if self.running {
+		panic("YYServer is runing")
+	}
+	self.readBuffer = config
+}
+
+// maxReadBuffer 返回可以接收的最大数据帧长度
+func (self *YYServer) maxReadBuffer() int {
+	if self.readBuffer.MaxSize > 0 {
+		return self.readBuffer.MaxSize
+	}
+	return DefaultMaxReadBuffer
+}
+
+// SetSocketOptions 设置Start、StartRange和StartUDP监听时的套接字选项，应该在程序启动时调用
+// 多个进程设置ReusePort后可以监听同一端口
+func (self *YYServer) SetSocketOptions(options util.SocketOptions) {
+	if self.running {
+		panic("YYServer is runing")
+	}
+	self.sockopt = options
+}
+
+// SetDispatch 设置MessageHandle的调度方式，应该在程序启动时调用
+// ConnectHandle仍在连接goroutine中执行，CloseHandle在该连接所有MessageHandle执行完后调用
+func (self *YYServer) SetDispatch(config DispatchConfig) {
+	if self.running {
+		panic("YYServer is runing")
+	}
+	self.dispatchConfig = config
+}
+
 // RegisterHandle 应该在程序启动时调用，如果已经存在引起panic
 func (self *YYServer) RegisterHandle(msg packet.Marshallable, handle MessageHandle) {
-	if self.listener != nil {
+	if self.running {
 		panic("YYServer is runing")
 	}
 	if !self.register.Register(msg) {
@@ -77,22 +184,74 @@ func (self *YYServer) Start(addr string) error {
 		panic("YYServer is runing")
 	}
 
-	listener, err := net.Listen("tcp", addr)
+	listener, err := self.sockopt.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
+	self.Serve(listener)
+	return nil
+}
+
+// Serve 在listener上接受连接，可以使用Unix域套接字、ListenFD继承的fd或PipeListener
+// 接受连接在单独的goroutine中进行，Serve立即返回，listener关闭后停止接受
+func (self *YYServer) Serve(listener net.Listener) {
+	if self.listener != nil {
+		panic("YYServer is runing")
+	}
+
+	self.prepare()
 	self.listener = listener
-	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err == nil {
-				go self.handleConnect(conn)
-			} else {
-				logger.Warning("accept %v error %v", addr, err)
-			}
+	go acceptLoop(listener, self.admitConnect)
+}
+
+// prepare 开始服务前调用，之后不能再修改配置
+// 同一个YYServer可以同时在多个传输上服务，只在第一次调用时生效
+func (self *YYServer) prepare() {
+	if self.running {
+		return
+	}
+	self.running = true
+	if self.dispatchConfig.Mode != DispatchSerial {
+		self.dispatcher = newDispatcher(self.dispatchConfig, self.handleMessage)
+		self.dispatcher.observe = self.observe
+	}
+	if self.engine == EngineEventLoop && self.forwarder == nil {
+		events, err := newEventEngine(self, self.engineLoops)
+		if err != nil {
+			logger.Warning("create event loop error %v, use goroutine engine", err)
+			return
 		}
-	}()
-	return nil
+		self.events = events
+	}
+}
+
+// admitConnect 通过准入检查的连接进入handleConnect，否则拒绝
+// 来自可信代理的连接先读取PROXY协议头
+func (self *YYServer) admitConnect(conn net.Conn) {
+	if self.proxy != nil && self.proxy.isTrusted(conn.RemoteAddr()) {
+		self.admitProxy(conn)
+		return
+	}
+	self.admit(conn, self.handleConnect)
+}
+
+// admit 通过准入检查的连接在新的goroutine中调用handle，否则拒绝
+// handle在连接结束后调用release
+func (self *YYServer) admit(conn net.Conn, handle func(conn net.Conn, release func())) {
+	if self.admission == nil {
+		go handle(conn, func() {})
+		return
+	}
+
+	addr := conn.RemoteAddr()
+	if reason, ok := self.admission.acquire(addr); !ok {
+		logger.Info("refuse connect %v reason %v", addr, reason)
+		go self.admission.refuseConn(conn, reason)
+		return
+	}
+	go handle(conn, func() {
+		self.admission.release(addr)
+	})
 }
 
 // StartRange 以此探测从addr开始的，trytime个端口
@@ -127,11 +286,42 @@ func (self *YYServer) GetListenAddr() net.Addr {
 	return self.listener.Addr()
 }
 
-func (self *YYServer) handleConnect(conn net.Conn) {
+func (self *YYServer) handleConnect(conn net.Conn, release func()) {
+	if self.tlsConfig != nil {
+		tlsConn, err := serverHandshake(conn, self.tlsConfig)
+		if err != nil {
+			logger.Info("tls handshake %v error %v", conn.RemoteAddr(), err)
+			conn.Close()
+			release()
+			return
+		}
+		if p, ok := conn.(*proxyConn); ok {
+			conn = &proxyTLSConn{Conn: tlsConn, proxy: p.ProxyAddr()}
+		} else {
+			conn = tlsConn
+		}
+	}
+	// 事件循环接管连接后在连接结束时调用release
+	if self.events != nil && self.events.add(conn, release) {
+		return
+	}
+	defer release()
+	self.serveConnect(conn)
+}
+
+// serveConnect 在已建立的连接上处理YY协议，直到连接关闭
+func (self *YYServer) serveConnect(conn net.Conn) {
 	yyconn := NewYYConnect(conn)
-	defer conn.Close()
+	self.setupConnect(yyconn)
+	self.metrics.connAccepted()
+	defer self.metrics.connClosed()
+	defer yyconn.closeWith(nil)
+
+	// ConnectHandle中可以加入分组，需要先登记连接
+	self.registry.add(yyconn)
 
 	var readerr error
+	intercept := self.proxyIntercept(yyconn)
 	if self.connectHandle != nil {
 		if self.connectHandle(yyconn) == false {
 			goto FIN
@@ -140,21 +330,80 @@ func (self *YYServer) handleConnect(conn net.Conn) {
 
 	for {
 		var msg packet.Marshallable
-		msg, readerr = yyconn.Recv(self.register)
+		var info recvInfo
+		msg, info, readerr = yyconn.recvWith(self.register, intercept)
 		if readerr != nil {
 			break
 		}
-
 		// MessageHandle返回false，主动关闭连接
-		handle, _ := self.uriHandle[msg.GetURI()]
-		if !handle(yyconn, msg) {
+		if !self.handleRecv(yyconn, msg, info) {
 			goto FIN
 		}
 	}
 
 FIN:
+	// 等待工作goroutine中该连接的消息处理完成
+	yyconn.pending.Wait()
+	yyconn.closeProxyLinks()
+	// 连接在goroutine外被关闭时，使用记录的关闭原因
+	if closed, reason := yyconn.closeReason(); closed && readerr != nil {
+		readerr = reason
+	}
+	// CloseHandle中的广播不再发送给该连接
+	self.registry.remove(yyconn)
 	// 关闭调用CloseHandle
 	if self.closeHandle != nil {
 		self.closeHandle(yyconn, readerr)
 	}
 }
+
+// setupConnect 按服务的配置设置新连接
+func (self *YYServer) setupConnect(yyconn *YYConnect) {
+	if self.sendQueueSize > 0 {
+		yyconn.SetSendQueue(self.sendQueueSize, self.sendQueuePolicy)
+	}
+	yyconn.SetIdleTimeout(self.idleTimeout)
+	yyconn.SetHeartbeat(self.heartbeat)
+	yyconn.SetReadBuffer(self.readBuffer)
+	if self.fragment.URI != 0 {
+		yyconn.fragment = newFragmenter(self.fragment, self.fragmentBudget)
+	}
+	if self.mux.URI != 0 {
+		yyconn.mux = newMuxSession(yyconn, self.mux, false)
+		yyconn.mux.accept = self.acceptStream
+	}
+	yyconn.metrics = self.metrics
+	yyconn.recorder = self.recorder
+	self.startAuth(yyconn)
+}
+
+// handleRecv 将收到的消息交给工作goroutine，或者直接调用MessageHandle并返回结果
+func (self *YYServer) handleRecv(yyconn *YYConnect, msg packet.Marshallable, info recvInfo) bool {
+	if !self.limit(yyconn, msg.GetURI()) || self.deferAuth(yyconn, msg, info) {
+		return true
+	}
+	return self.handleAuth(yyconn, msg, info)
+}
+
+// handleAuth 认证后将消息交给工作goroutine或MessageHandle
+func (self *YYServer) handleAuth(yyconn *YYConnect, msg packet.Marshallable, info recvInfo) bool {
+	if self.authenticate(yyconn, msg) {
+		return true
+	}
+	if self.dispatcher != nil {
+		self.dispatcher.dispatchInfo(yyconn, msg, info)
+		return true
+	}
+	ok := self.handleMessage(yyconn, msg)
+	self.observe(msg, info)
+	return ok
+}
+
+func (self *YYServer) observe(msg packet.Marshallable, info recvInfo) {
+	self.metrics.observe(msg.GetURI(), info.resCode, time.Since(info.start))
+}
+
+func (self *YYServer) handleMessage(yyconn *YYConnect, msg packet.Marshallable) bool {
+	handle, _ := self.uriHandle[msg.GetURI()]
+	return handle(yyconn, msg)
+}
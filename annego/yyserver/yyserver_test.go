@@ -0,0 +1,96 @@
+package yyserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+)
+
+type PTest struct {
+	Int uint32
+	Str string
+}
+
+func (self *PTest) GetURI() uint32 {
+	return 1
+}
+
+func (self *PTest) Marshal(pk *packet.Pack) {
+	packet.DefaultMarshal(self, pk)
+}
+
+func (self *PTest) Unmarshal(up *packet.Unpack) error {
+	return packet.DefaultUnmarshal(self, up)
+}
+
+type PTestRes struct {
+	Int uint32
+	Str string
+}
+
+func (self *PTestRes) GetURI() uint32 {
+	return 2
+}
+
+func (self *PTestRes) Marshal(pk *packet.Pack) {
+	packet.DefaultMarshal(self, pk)
+}
+
+func (self *PTestRes) Unmarshal(up *packet.Unpack) error {
+	return packet.DefaultUnmarshal(self, up)
+}
+
+func newTestRegister() *packet.YYRegister {
+	reg := packet.NewYYRegister()
+	reg.Register(new(PTest))
+	reg.Register(new(PTestRes))
+	return reg
+}
+
+// startEchoServer 启动回显服务，PTest回复相同内容的PTestRes
+func startEchoServer(t testing.TB, server *YYServer) string {
+	server.RegisterHandle(new(PTest), func(c *YYConnect, msg packet.Marshallable) bool {
+		req := msg.(*PTest)
+		c.SendAsync(&PTestRes{req.Int, req.Str})
+		return true
+	})
+	if err := server.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	return server.GetListenAddr().String()
+}
+
+func TestServerSendAsync(t *testing.T) {
+	server := NewYYServer()
+	server.SetSendQueue(16, OverflowBlock)
+	addr := startEchoServer(t, server)
+
+	conn, err := Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetTimeout(5*time.Second, 5*time.Second)
+
+	reg := newTestRegister()
+	const total = 1000
+	go func() {
+		for i := 0; i < total; i++ {
+			conn.SendAsync(&PTest{uint32(i), "abc"})
+		}
+	}()
+	for i := 0; i < total; i++ {
+		msg, err := conn.Recv(reg)
+		assert.Nil(t, err)
+		res := msg.(*PTestRes)
+		assert.Equal(t, uint32(i), res.Int)
+	}
+
+	assert.Eventually(t, func() bool {
+		return conn.SendQueueStats().Sent == total
+	}, time.Second, time.Millisecond)
+	stats := conn.SendQueueStats()
+	assert.Equal(t, DefaultSendQueueSize, stats.Cap)
+	assert.True(t, stats.Flushes <= stats.Sent)
+}
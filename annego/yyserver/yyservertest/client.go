@@ -0,0 +1,202 @@
+package yyservertest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"goBase/annego/packet"
+	"goBase/annego/yyserver"
+)
+
+// maxPendingFrames 客户端缓存的未读取消息数，超过后服务端的发送阻塞
+const maxPendingFrames = 1024
+
+// Client 测试服务的客户端，后台持续读取服务端发送的消息
+type Client struct {
+	owner  *Server
+	addr   string
+	conn   *yyserver.YYConnect
+	server *yyserver.YYConnect
+
+	frames    chan []byte
+	done      chan struct{}
+	quit      chan struct{}
+	quitOnce  sync.Once
+	readErr   error
+	connected chan Event
+	closed    chan Event
+
+	closeMut   sync.Mutex
+	closeEvent *Event
+}
+
+func newClient(owner *Server, addr string) *Client {
+	return &Client{
+		owner:     owner,
+		addr:      addr,
+		frames:    make(chan []byte, maxPendingFrames),
+		done:      make(chan struct{}),
+		quit:      make(chan struct{}),
+		connected: make(chan Event, 1),
+		closed:    make(chan Event, 1),
+	}
+}
+
+func (c *Client) start(raw net.Conn) {
+	c.conn = yyserver.NewYYConnect(raw)
+	go c.readLoop(raw)
+}
+
+// readLoop 读取数据帧直到连接关闭
+func (c *Client) readLoop(raw net.Conn) {
+	defer close(c.done)
+	reader := bufio.NewReader(raw)
+	for {
+		header := make([]byte, packet.HeaderLength)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			c.readErr = err
+			return
+		}
+		h, _ := packet.PeekHeader(header)
+		if h.Length < packet.HeaderLength || h.Length > packet.MaxPacketLength {
+			c.readErr = fmt.Errorf("bad frame length %d uri %d", h.Length, h.URI)
+			return
+		}
+		frame := make([]byte, h.Length)
+		copy(frame, header)
+		if _, err := io.ReadFull(reader, frame[packet.HeaderLength:]); err != nil {
+			c.readErr = err
+			return
+		}
+		select {
+		case c.frames <- frame:
+		case <-c.quit:
+			c.readErr = io.ErrClosedPipe
+			return
+		}
+	}
+}
+
+// Addr 客户端地址，即服务端连接的RemoteAddr
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+// Conn 客户端的连接
+func (c *Client) Conn() *yyserver.YYConnect {
+	return c.conn
+}
+
+// ServerConn 服务端对应的连接，可以用于Join、Kick或检查UserData
+func (c *Client) ServerConn() *yyserver.YYConnect {
+	return c.server
+}
+
+// Send 发送消息到服务端
+func (c *Client) Send(msg packet.Marshallable) error {
+	return c.conn.Send(msg)
+}
+
+// Close 关闭客户端，服务端CloseHandle收到io.EOF
+func (c *Client) Close() error {
+	c.quitOnce.Do(func() { close(c.quit) })
+	return c.conn.Close()
+}
+
+// Kick 在服务端以reason关闭连接，模拟服务端主动断开
+func (c *Client) Kick(reason error) bool {
+	return c.owner.Kick(c.server.ID(), reason)
+}
+
+// Expect 等待下一个消息并断言为msgType类型，返回解包后的消息
+// 超时、连接关闭或收到其他消息时测试失败
+func (c *Client) Expect(t testing.TB, msgType packet.Marshallable, timeout time.Duration) packet.Marshallable {
+	t.Helper()
+	frame := c.next(t, timeout)
+	if frame == nil {
+		t.Fatalf("yyservertest: client %s expect uri %d, timeout after %v", c.addr, msgType.GetURI(), timeout)
+	}
+	header, _ := packet.PeekHeader(frame)
+	if header.URI != msgType.GetURI() {
+		t.Fatalf("yyservertest: client %s expect uri %d, got uri %d", c.addr, msgType.GetURI(), header.URI)
+	}
+	register := packet.NewYYRegister()
+	register.Register(msgType)
+	msg, _, err := register.UnmarshalBytes(frame)
+	if err != nil {
+		t.Fatalf("yyservertest: client %s unmarshal uri %d: %v", c.addr, header.URI, err)
+	}
+	return msg
+}
+
+// ExpectNone 断言timeout内没有收到消息
+func (c *Client) ExpectNone(t testing.TB, timeout time.Duration) {
+	t.Helper()
+	select {
+	case frame := <-c.frames:
+		header, _ := packet.PeekHeader(frame)
+		t.Fatalf("yyservertest: client %s expect no message, got uri %d", c.addr, header.URI)
+	case <-time.After(timeout):
+	}
+}
+
+// ExpectClosed 等待服务端关闭连接并且CloseHandle返回，返回CloseHandle收到的关闭原因
+// 关闭前未读取的消息被丢弃
+func (c *Client) ExpectClosed(t testing.TB, timeout time.Duration) error {
+	t.Helper()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.frames:
+			continue
+		case <-c.done:
+		case <-timer.C:
+			t.Fatalf("yyservertest: client %s expect closed, timeout after %v", c.addr, timeout)
+		}
+		break
+	}
+	return c.WaitClose(t, timeout)
+}
+
+// WaitClose 等待服务端CloseHandle返回，返回关闭原因，不要求服务端先关闭连接
+func (c *Client) WaitClose(t testing.TB, timeout time.Duration) error {
+	t.Helper()
+	c.closeMut.Lock()
+	defer c.closeMut.Unlock()
+	if c.closeEvent == nil {
+		select {
+		case ev := <-c.closed:
+			c.closeEvent = &ev
+		case <-time.After(timeout):
+		}
+	}
+	if c.closeEvent == nil {
+		t.Fatalf("yyservertest: client %s wait CloseHandle timeout after %v", c.addr, timeout)
+	}
+	return c.closeEvent.Err
+}
+
+// next 返回下一个数据帧，超时返回nil，连接关闭时测试失败
+func (c *Client) next(t testing.TB, timeout time.Duration) []byte {
+	t.Helper()
+	select {
+	case frame := <-c.frames:
+		return frame
+	case <-c.done:
+		// 关闭前收到的数据帧仍然可以读取
+		select {
+		case frame := <-c.frames:
+			return frame
+		default:
+		}
+		t.Fatalf("yyservertest: client %s connection closed: %v", c.addr, c.readErr)
+	case <-time.After(timeout):
+	}
+	return nil
+}
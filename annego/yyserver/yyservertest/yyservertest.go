@@ -0,0 +1,270 @@
+// Package yyservertest 进程内运行YYServer的测试工具
+// 客户端通过内存连接访问服务，不占用端口，测试可以并行执行
+package yyservertest
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"goBase/annego/packet"
+	"goBase/annego/yyserver"
+)
+
+// DefaultTimeout 等待ConnectHandle和CloseHandle的超时时间
+const DefaultTimeout = 5 * time.Second
+
+// EventType 连接事件类型
+type EventType int
+
+const (
+	// EventConnect ConnectHandle已返回
+	EventConnect EventType = iota + 1
+	// EventClose CloseHandle已返回
+	EventClose
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventConnect:
+		return "connect"
+	case EventClose:
+		return "close"
+	}
+	return fmt.Sprintf("event(%d)", int(e))
+}
+
+// Event 服务端的连接事件
+type Event struct {
+	Type     EventType
+	Conn     *yyserver.YYConnect // 服务端的连接
+	Accepted bool                // EventConnect时ConnectHandle的返回值
+	Err      error               // EventClose时CloseHandle收到的关闭原因
+}
+
+// Server 在内存listener上运行的YYServer
+// ConnectHandle和CloseHandle需要通过Server注册，Server在其返回后记录连接事件
+type Server struct {
+	*yyserver.YYServer
+
+	listener *listener
+	connect  yyserver.ConnectHandle
+	close    yyserver.CloseHandle
+
+	mut     sync.Mutex
+	seq     int
+	clients map[string]*Client
+	events  []Event
+}
+
+// NewServer 创建测试服务，完成RegisterHandle等设置后调用Start
+func NewServer() *Server {
+	s := &Server{
+		YYServer: yyserver.NewYYServer(),
+		listener: newListener(),
+		clients:  make(map[string]*Client),
+	}
+	s.YYServer.RegisterConnectFunc(s.handleConnect)
+	s.YYServer.RegisterCloseFunc(s.handleClose)
+	return s
+}
+
+// RegisterConnectFunc 应该在Start前调用
+func (s *Server) RegisterConnectFunc(handle yyserver.ConnectHandle) {
+	s.YYServer.RegisterConnectFunc(s.handleConnect)
+	s.connect = handle
+}
+
+// RegisterCloseFunc 应该在Start前调用
+func (s *Server) RegisterCloseFunc(handle yyserver.CloseHandle) {
+	s.YYServer.RegisterCloseFunc(s.handleClose)
+	s.close = handle
+}
+
+// Start 开始服务，测试结束时关闭listener和所有客户端
+func (s *Server) Start(t testing.TB) {
+	s.Serve(s.listener)
+	t.Cleanup(s.Close)
+}
+
+// Close 停止接受连接并关闭所有客户端
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mut.Lock()
+	clients := make([]*Client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mut.Unlock()
+	for _, c := range clients {
+		c.Close()
+	}
+}
+
+// Events 返回目前为止记录的所有连接事件
+func (s *Server) Events() []Event {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return append([]Event(nil), s.events...)
+}
+
+// Dial 建立新的客户端，等待服务端ConnectHandle返回
+// 客户端地址为127.0.0.1上递增的端口
+func (s *Server) Dial(t testing.TB) *Client {
+	t.Helper()
+	s.mut.Lock()
+	s.seq++
+	addr := fmt.Sprintf("127.0.0.1:%d", 10000+s.seq)
+	s.mut.Unlock()
+	return s.DialFrom(t, addr)
+}
+
+// DialFrom 使用指定的客户端地址建立连接，服务端的RemoteAddr为该地址
+// 可以用于测试按IP处理的逻辑，同一时间地址不能重复
+func (s *Server) DialFrom(t testing.TB, addr string) *Client {
+	t.Helper()
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatalf("yyservertest: bad client addr %s: %v", addr, err)
+	}
+	key := tcpAddr.String()
+	c := newClient(s, key)
+
+	s.mut.Lock()
+	if _, ok := s.clients[key]; ok {
+		s.mut.Unlock()
+		t.Fatalf("yyservertest: client addr %s in use", key)
+	}
+	s.clients[key] = c
+	s.mut.Unlock()
+
+	raw, err := s.listener.dial(tcpAddr)
+	if err != nil {
+		s.remove(c)
+		t.Fatalf("yyservertest: dial %s: %v", key, err)
+	}
+	c.start(raw)
+
+	select {
+	case ev := <-c.connected:
+		c.server = ev.Conn
+	case <-time.After(DefaultTimeout):
+		t.Fatalf("yyservertest: client %s wait ConnectHandle timeout", key)
+	}
+	return c
+}
+
+// ExpectBroadcast 断言receivers中的客户端都收到msgType类型的消息，excluded中的客户端没有收到任何消息
+// 返回receivers收到的消息
+func ExpectBroadcast(t testing.TB, msgType packet.Marshallable, timeout time.Duration, receivers []*Client, excluded ...*Client) []packet.Marshallable {
+	t.Helper()
+	msgs := make([]packet.Marshallable, 0, len(receivers))
+	for _, c := range receivers {
+		msgs = append(msgs, c.Expect(t, msgType, timeout))
+	}
+	// 已确认receivers都收到后，excluded只需要短暂等待
+	for _, c := range excluded {
+		c.ExpectNone(t, 10*time.Millisecond)
+	}
+	return msgs
+}
+
+func (s *Server) handleConnect(conn *yyserver.YYConnect) bool {
+	ok := true
+	if s.connect != nil {
+		ok = s.connect(conn)
+	}
+	s.emit(Event{Type: EventConnect, Conn: conn, Accepted: ok})
+	return ok
+}
+
+func (s *Server) handleClose(conn *yyserver.YYConnect, err error) {
+	if s.close != nil {
+		s.close(conn, err)
+	}
+	s.emit(Event{Type: EventClose, Conn: conn, Err: err})
+}
+
+// emit 记录事件并通知对应的客户端
+func (s *Server) emit(ev Event) {
+	s.mut.Lock()
+	s.events = append(s.events, ev)
+	c := s.clients[ev.Conn.RemoteAddr().String()]
+	if ev.Type == EventClose {
+		delete(s.clients, ev.Conn.RemoteAddr().String())
+	}
+	s.mut.Unlock()
+	if c == nil {
+		return
+	}
+	switch ev.Type {
+	case EventConnect:
+		c.connected <- ev
+	case EventClose:
+		c.closed <- ev
+	}
+}
+
+func (s *Server) remove(c *Client) {
+	s.mut.Lock()
+	if s.clients[c.addr] == c {
+		delete(s.clients, c.addr)
+	}
+	s.mut.Unlock()
+}
+
+// listener 内存listener，服务端连接的RemoteAddr为客户端指定的地址
+type listener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newListener() *listener {
+	return &listener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, yyserver.ErrListenerClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return serverAddr
+}
+
+func (l *listener) dial(addr net.Addr) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- &addrConn{Conn: server, local: serverAddr, remote: addr}:
+		return &addrConn{Conn: client, local: addr, remote: serverAddr}, nil
+	case <-l.done:
+		return nil, yyserver.ErrListenerClosed
+	}
+}
+
+var serverAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+// addrConn 替换net.Pipe的地址
+type addrConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *addrConn) LocalAddr() net.Addr  { return c.local }
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
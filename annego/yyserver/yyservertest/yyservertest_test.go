@@ -0,0 +1,150 @@
+package yyservertest
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"goBase/annego/packet"
+	"goBase/annego/yyserver"
+)
+
+type PJoin struct {
+	Room string
+}
+
+func (self *PJoin) GetURI() uint32 {
+	return 1
+}
+
+func (self *PJoin) Marshal(pk *packet.Pack) {
+	packet.DefaultMarshal(self, pk)
+}
+
+func (self *PJoin) Unmarshal(up *packet.Unpack) error {
+	return packet.DefaultUnmarshal(self, up)
+}
+
+type PSay struct {
+	Room string
+	Text string
+}
+
+func (self *PSay) GetURI() uint32 {
+	return 2
+}
+
+func (self *PSay) Marshal(pk *packet.Pack) {
+	packet.DefaultMarshal(self, pk)
+}
+
+func (self *PSay) Unmarshal(up *packet.Unpack) error {
+	return packet.DefaultUnmarshal(self, up)
+}
+
+type PJoinRes struct {
+	Room  string
+	Count uint32
+}
+
+func (self *PJoinRes) GetURI() uint32 {
+	return 3
+}
+
+func (self *PJoinRes) Marshal(pk *packet.Pack) {
+	packet.DefaultMarshal(self, pk)
+}
+
+func (self *PJoinRes) Unmarshal(up *packet.Unpack) error {
+	return packet.DefaultUnmarshal(self, up)
+}
+
+// newRoomServer 简单的聊天室服务，PSay广播给同一房间的其他连接
+func newRoomServer(t *testing.T) *Server {
+	server := NewServer()
+	server.RegisterConnectFunc(func(c *yyserver.YYConnect) bool {
+		return c.RemoteAddr().String() != "10.0.0.1:1000"
+	})
+	server.RegisterHandle(new(PJoin), func(c *yyserver.YYConnect, msg packet.Marshallable) bool {
+		room := msg.(*PJoin).Room
+		server.Join(room, c)
+		c.Send(&PJoinRes{room, uint32(server.GroupCount(room))})
+		return true
+	})
+	server.RegisterHandle(new(PSay), func(c *yyserver.YYConnect, msg packet.Marshallable) bool {
+		say := msg.(*PSay)
+		if say.Text == "bye" {
+			return false
+		}
+		server.GroupBroadcast(say.Room, say, func(conn *yyserver.YYConnect) bool {
+			return conn != c
+		})
+		return true
+	})
+	server.Start(t)
+	return server
+}
+
+func TestExpect(t *testing.T) {
+	t.Parallel()
+	server := newRoomServer(t)
+	client := server.Dial(t)
+	assert.Nil(t, client.Send(&PJoin{"a"}))
+	assert.Equal(t, &PJoinRes{"a", 1}, client.Expect(t, new(PJoinRes), time.Second))
+	client.ExpectNone(t, 10*time.Millisecond)
+	assert.Equal(t, client.Addr(), client.ServerConn().RemoteAddr().String())
+}
+
+func TestBroadcast(t *testing.T) {
+	t.Parallel()
+	server := newRoomServer(t)
+	clients := make([]*Client, 4)
+	for i := range clients {
+		clients[i] = server.Dial(t)
+		room := "a"
+		if i == 3 {
+			room = "b"
+		}
+		clients[i].Send(&PJoin{room})
+		clients[i].Expect(t, new(PJoinRes), time.Second)
+	}
+
+	clients[0].Send(&PSay{"a", "hello"})
+	msgs := ExpectBroadcast(t, new(PSay), time.Second, clients[1:3], clients[0], clients[3])
+	assert.Equal(t, []packet.Marshallable{&PSay{"a", "hello"}, &PSay{"a", "hello"}}, msgs)
+}
+
+func TestEvents(t *testing.T) {
+	t.Parallel()
+	server := newRoomServer(t)
+
+	// ConnectHandle拒绝
+	refused := server.DialFrom(t, "10.0.0.1:1000")
+	assert.Nil(t, refused.ExpectClosed(t, time.Second))
+
+	// 对端关闭
+	client := server.Dial(t)
+	client.Close()
+	assert.Equal(t, io.EOF, client.WaitClose(t, time.Second))
+
+	// 服务端踢出
+	reason := errors.New("kicked")
+	client = server.Dial(t)
+	assert.True(t, client.Kick(reason))
+	assert.Equal(t, reason, client.ExpectClosed(t, time.Second))
+
+	// MessageHandle返回false
+	client = server.Dial(t)
+	client.Send(&PSay{"a", "bye"})
+	assert.Nil(t, client.ExpectClosed(t, time.Second))
+
+	events := server.Events()
+	assert.Equal(t, 8, len(events))
+	assert.Equal(t, EventConnect, events[0].Type)
+	assert.False(t, events[0].Accepted)
+	assert.Equal(t, EventClose, events[1].Type)
+	assert.Equal(t, "10.0.0.1:1000", events[1].Conn.RemoteAddr().String())
+}